@@ -5,6 +5,7 @@ import (
 	"log" // Logging is crucial for both debugging and runtime monitoring.
 	"net"
 	"net/http"
+	"net/netip"
 
 	// Networking package for handling sockets.
 	// HTTP server functionalities.
@@ -17,23 +18,47 @@ import (
 	nd "github.com/kerwenwwer/eGossip/modules/nodeList"
 	"github.com/kerwenwwer/eGossip/pkg/bpf"
 	"github.com/kerwenwwer/eGossip/pkg/common"
+	"github.com/kerwenwwer/eGossip/pkg/controlpb"
 	logger "github.com/kerwenwwer/eGossip/pkg/logger"
+	"github.com/kerwenwwer/eGossip/pkg/transport"
 	"github.com/spf13/cobra" // Cobra package for CLI interactions.
+	"google.golang.org/grpc"
 )
 
 // Constants for default configuration values.
 const (
 	DefaultLinkName = "eth0"
 	DefaultProtocol = "UDP"
-	DefaultPort     = "8000" // Ports are strings in Go's http package.
+	DefaultPort     = 8000 // Gossip (UDP) port
+	DefaultAPIPort  = 8000 // HTTP command server (TCP) port
+	DefaultGRPCPort = 0    // gRPC control server (TCP) port, disabled
 )
 
 // Config struct to hold all configuration needed across the application.
 type Config struct {
-	NodeName string
-	LinkName string
-	Protocol string
-	Debug    bool
+	NodeName    string
+	LinkName    string
+	Port        int
+	APIPort     int
+	GRPCPort    int
+	Protocol    string
+	ProbeLink   bool
+	Labels      map[string]string
+	Piggyback   bool
+	Infection   string
+	Selector    string
+	Adaptive    bool
+	KernelNodes bool
+	Allowlist   bool
+	AllowCIDRs  []string
+	RateLimit   uint64
+	RateBurst   uint64
+	PinPath     string
+	TCPriority  uint16
+	XDPChain    string
+	Tunnels     bool
+	Xsk         transport.XskConfig
+	Debug       bool
 }
 
 func main() {
@@ -57,9 +82,35 @@ func main() {
 		},
 	}
 	// Flags for the server command.
-	serverCmd.Flags().StringVar(&config.NodeName, "name", "", "Node name for identifying in the network.")
+	serverCmd.Flags().StringVar(&config.NodeName, "name", "", "Node name for identifying in the network (also used as node ID, a UUID is generated if empty).")
 	serverCmd.Flags().StringVar(&config.LinkName, "link", DefaultLinkName, "Network link interface name.")
-	serverCmd.Flags().StringVar(&config.Protocol, "proto", DefaultProtocol, "Networking protocol (UDP/TC/XDP).")
+	serverCmd.Flags().StringVar(&config.Protocol, "proto", DefaultProtocol, "Networking protocol (UDP/TC/XDP, auto picks the best one supported by the kernel and the link). Falls back from XDP to TC to UDP.")
+	serverCmd.Flags().BoolVar(&config.ProbeLink, "probe-link", false, "With --proto auto, also probes native XDP and zero-copy AF_XDP on the link itself, which resets the queues of many NICs and drops traffic meanwhile.")
+	serverCmd.Flags().IntVar(&config.Port, "port", DefaultPort, "Gossip UDP port, also used by the XDP program (all nodes of a cluster use the same port).")
+	serverCmd.Flags().IntVar(&config.APIPort, "api-port", DefaultAPIPort, "HTTP command server TCP port.")
+	serverCmd.Flags().IntVar(&config.GRPCPort, "grpc-port", DefaultGRPCPort, "gRPC control server TCP port, 0 disables it.")
+	serverCmd.Flags().StringToStringVar(&config.Labels, "labels", nil, "Node labels advertised as private metadata (e.g. role=db,zone=a).")
+	serverCmd.Flags().BoolVar(&config.Piggyback, "piggyback", false, "Piggyback membership/metadata updates on heartbeats instead of broadcasting each change.")
+	serverCmd.Flags().StringVar(&config.Infection, "infection", nd.InfectionMap, "Infection tracking of broadcast packets (map/bloom/ttl).")
+	serverCmd.Flags().StringVar(&config.Selector, "selector", "random", "Peer selection of broadcast and swap (random/roundrobin/zone, zone uses the \"zone\" label).")
+	serverCmd.Flags().BoolVar(&config.Adaptive, "adaptive", false, "Computes fanout, cycle and timeout from the cluster size and observed RTT.")
+	serverCmd.Flags().BoolVar(&config.KernelNodes, "kernel-nodes", false, "Mirrors the node list into a BPF map and lets the TC program pick broadcast targets from it (XDP protocol).")
+	serverCmd.Flags().BoolVar(&config.Allowlist, "allowlist", false, "Drops packets from sources other than known nodes and --allow-cidr in XDP (XDP protocol).")
+	serverCmd.Flags().StringSliceVar(&config.AllowCIDRs, "allow-cidr", nil, "Source CIDRs always allowed by the XDP allowlist, must cover joining nodes (e.g. 10.0.0.0/24).")
+	serverCmd.Flags().Uint64Var(&config.RateLimit, "rate-limit", 0, "Packets per second accepted from a single source in XDP, 0 disables the limit (XDP protocol).")
+	serverCmd.Flags().Uint64Var(&config.RateBurst, "rate-burst", 0, "Burst size of the per-source rate limit (defaults to --rate-limit).")
+	serverCmd.Flags().StringVar(&config.PinPath, "pin-path", bpf.DefaultPinPath, "bpffs directory where BPF maps, programs and links are pinned and reused across restarts, empty disables pinning.")
+	serverCmd.Flags().Uint16Var(&config.TCPriority, "tc-priority", bpf.DefaultTCPriority, "Priority of the tc filter on kernels without TCX, pick one not used by other software on the link.")
+	serverCmd.Flags().StringVar(&config.XDPChain, "xdp-chain", "", "XDP program receiving the packets that are not for eGossip: \"attached\" (the program attached to the link, restored on cleanup, requires --pin-path) or the bpffs path of a pinned program.")
+	serverCmd.Flags().BoolVar(&config.Tunnels, "tunnels", false, "Also receives gossip packets encapsulated in VXLAN (port 4789) or Geneve (port 6081) on the link, for overlay networks (XDP protocol).")
+	serverCmd.Flags().IntVar(&config.Xsk.NumFrames, "xsk-frames", transport.DefaultXskConfig.NumFrames, "Frames of the AF_XDP UMEM, at least --xsk-fill-ring (XDP protocol).")
+	serverCmd.Flags().IntVar(&config.Xsk.FrameSize, "xsk-frame-size", transport.DefaultXskConfig.FrameSize, "Size of an AF_XDP UMEM frame, 2048 or 4096 (XDP protocol).")
+	serverCmd.Flags().IntVar(&config.Xsk.FillRingSize, "xsk-fill-ring", transport.DefaultXskConfig.FillRingSize, "Descriptors of the AF_XDP fill ring, a power of 2 (XDP protocol).")
+	serverCmd.Flags().IntVar(&config.Xsk.CompletionRingSize, "xsk-completion-ring", transport.DefaultXskConfig.CompletionRingSize, "Descriptors of the AF_XDP completion ring, a power of 2 (XDP protocol).")
+	serverCmd.Flags().IntVar(&config.Xsk.RxRingSize, "xsk-rx-ring", transport.DefaultXskConfig.RxRingSize, "Descriptors of the AF_XDP rx ring, a power of 2 (XDP protocol).")
+	serverCmd.Flags().IntVar(&config.Xsk.TxRingSize, "xsk-tx-ring", transport.DefaultXskConfig.TxRingSize, "Descriptors of the AF_XDP tx ring, a power of 2 or 0 (XDP protocol).")
+	serverCmd.Flags().BoolVar(&config.Xsk.ZeroCopy, "xsk-zerocopy", transport.DefaultXskConfig.ZeroCopy, "Binds the AF_XDP socket in zero-copy mode, falls back to copy mode if the driver does not support it (XDP protocol).")
+	serverCmd.Flags().BoolVar(&config.Xsk.NeedWakeup, "xsk-need-wakeup", transport.DefaultXskConfig.NeedWakeup, "Uses need-wakeup on the AF_XDP rings, falls back without it on older kernels (XDP protocol).")
 	serverCmd.Flags().BoolVar(&config.Debug, "debug", false, "Enables debug mode for verbose logging.")
 
 	// Client command configuration.
@@ -68,14 +119,32 @@ func main() {
 		Short: "Starts the eGossip Dummy Client",
 		Long:  `Launches a UDP client for testing the eGossip communication.`,
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := startDummyClient(); err != nil {
+			if err := startDummyClient(config.Port); err != nil {
 				log.Fatalf("Error starting the client: %v", err)
 			}
 		},
 	}
 
-	// Add server and client commands to root.
-	rootCmd.AddCommand(serverCmd, dummyClientCmd)
+	dummyClientCmd.Flags().IntVar(&config.Port, "port", DefaultPort, "Gossip UDP port to listen on.")
+
+	// Cleanup command configuration.
+	cleanupCmd := &cobra.Command{
+		Use:   "cleanup",
+		Short: "Removes the eGossip programs from a link",
+		Long:  `Detaches the eGossip TC filter and XDP program from a link, removes the pinned BPF objects and the clsact qdisc if eGossip added it. Filters and programs of other software are left untouched.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := bpf.Cleanup(config.LinkName, config.PinPath); err != nil {
+				log.Fatalf("Failed to clean up %s: %v", config.LinkName, err)
+			}
+			log.Printf("[Cleanup]: eGossip programs removed from %s.", config.LinkName)
+		},
+	}
+
+	cleanupCmd.Flags().StringVar(&config.LinkName, "link", DefaultLinkName, "Network link interface name.")
+	cleanupCmd.Flags().StringVar(&config.PinPath, "pin-path", bpf.DefaultPinPath, "bpffs directory of the pinned BPF objects, empty skips them.")
+
+	// Add server, client and cleanup commands to root.
+	rootCmd.AddCommand(serverCmd, dummyClientCmd, cleanupCmd)
 
 	// Execute the root command.
 	if err := rootCmd.Execute(); err != nil {
@@ -89,6 +158,7 @@ func startServer(cfg Config) error {
 	log.Println("---------- Starting eGossip node ----------")
 	log.Printf("Node name: %s", cfg.NodeName)
 	log.Printf("Protocol: %s", cfg.Protocol)
+	log.Printf("Port: %d (API: %d)", cfg.Port, cfg.APIPort)
 	log.Printf("DEBUG: %t", cfg.Debug)
 	log.Println("---------------------------------------------")
 
@@ -102,18 +172,39 @@ func startServer(cfg Config) error {
 		return fmt.Errorf("[Init]: Failed to initialize node list: %w", err)
 	}
 
-	nodeList.Logger = logger.NewLogger(&logger.LoggerConfig{Development: true})
+	if len(cfg.Labels) != 0 {
+		nodeList.SetPrivate(cfg.Labels, nil) // Advertise node labels.
+	}
 
-	nodeList.Join() // Join the network.
+	// Join the network.
+	if err := nodeList.Join(); err != nil {
+		return fmt.Errorf("[Init]: Failed to join: %w", err)
+	}
+
+	// Additional clusters are created through /clusters, the top-level routes serve the default cluster
+	clusters := nd.NewClusters(nodeList, clusterFactory(cfg, nodeList))
+	http.Handle("/", nodeList.Handler())
+	http.HandleFunc("/clusters", clusters.Handler())
+	http.HandleFunc("/clusters/", clusters.Handler())
 
-	http.HandleFunc("/set", nodeList.SetNodeHandler())
-	http.HandleFunc("/list", nodeList.ListNodeHandler())
-	http.HandleFunc("/stop", nodeList.StopNodeHandler())
-	http.HandleFunc("/publish", nodeList.PublishHandler())
-	http.HandleFunc("/metadata", nodeList.GetMetadataHandler())
+	if cfg.GRPCPort != 0 {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCPort))
+		if err != nil {
+			return fmt.Errorf("[Control]: gRPC listen failed: %w", err)
+		}
+		server := grpc.NewServer()
+		controlpb.RegisterControlServer(server, nd.NewControlServer(clusters))
+
+		log.Printf("[Control]: Starting gRPC control server on TCP port %d.", cfg.GRPCPort)
+		go func() {
+			if err := server.Serve(lis); err != nil {
+				log.Fatalf("[Control]: gRPC Serve failed: %v", err)
+			}
+		}()
+	}
 
-	log.Printf("[Control]: Starting HTTP command server on TCP port 8000.")
-	if err := http.ListenAndServe(":8000", nil); err != nil {
+	log.Printf("[Control]: Starting HTTP command server on TCP port %d.", cfg.APIPort)
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.APIPort), nil); err != nil {
 		return fmt.Errorf("[Control]: ListenAndServe failed: %w", err)
 	}
 
@@ -154,9 +245,29 @@ func getIPFromAddr(addr net.Addr) net.IP {
 
 func initializeNodeList(cfg Config, address string) (*nd.NodeList, error) {
 	nodeList := nd.NodeList{
-		Protocol:  cfg.Protocol,
-		SecretKey: "test_key", // Assume this is a placeholder value.
-		IsPrint:   cfg.Debug,
+		Protocol:    cfg.Protocol,
+		SecretKey:   "test_key", // Assume this is a placeholder value.
+		IsPrint:     cfg.Debug,
+		Piggyback:   cfg.Piggyback,
+		Infection:   cfg.Infection,
+		Adaptive:    cfg.Adaptive,
+		KernelNodes: cfg.KernelNodes,
+		Allowlist:   cfg.Allowlist,
+		Logger:      logger.NewLogger(&logger.LoggerConfig{Development: true}), // Used by New() and the BPF setup
+	}
+
+	// Operator CIDRs of the XDP allowlist
+	var allowPrefixes []netip.Prefix
+	for _, cidr := range cfg.AllowCIDRs {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return &nd.NodeList{}, fmt.Errorf("[Init.]: Invalid allowed CIDR: %w", err)
+		}
+		allowPrefixes = append(allowPrefixes, prefix)
+	}
+
+	if err := setSelector(&nodeList, cfg.Selector); err != nil {
+		return &nd.NodeList{}, fmt.Errorf("[Init.]: %w", err)
 	}
 
 	if cfg.Debug {
@@ -169,13 +280,32 @@ func initializeNodeList(cfg Config, address string) (*nd.NodeList, error) {
 		os.Stdout = file // Consider the implications of redirecting os.Stdout globally.
 	}
 
-	if cfg.Protocol == "XDP" {
-		if err := loadAndAssignBPFProgram(&nodeList, cfg.LinkName, cfg.Debug, 1); err != nil {
-			return &nd.NodeList{}, err
-		}
-	} else if cfg.Protocol == "TC" {
-		if err := loadAndAssignBPFProgram(&nodeList, cfg.LinkName, cfg.Debug, 0); err != nil {
-			return &nd.NodeList{}, err
+	if cfg.Port <= 0 || cfg.Port > 65535 {
+		return &nd.NodeList{}, fmt.Errorf("[Init.]: Invalid gossip port: %d", cfg.Port)
+	}
+
+	if err := cfg.Xsk.Validate(); err != nil {
+		return &nd.NodeList{}, fmt.Errorf("[Init.]: Invalid AF_XDP socket configuration: %w", err)
+	}
+
+	opts := &bpf.Options{
+		Port:       uint16(cfg.Port),
+		Allowlist:  cfg.Allowlist,
+		RateLimit:  cfg.RateLimit,
+		RateBurst:  cfg.RateBurst,
+		PinPath:    cfg.PinPath,
+		TCPriority: cfg.TCPriority,
+		XDPChain:   cfg.XDPChain,
+		Tunnels:    cfg.Tunnels,
+	}
+
+	nodeList.Protocol = selectProtocol(&nodeList, cfg, opts)
+
+	if nodeList.Protocol == "XDP" {
+		for _, prefix := range allowPrefixes {
+			if err := bpf.AllowPrefix(nodeList.Program, prefix); err != nil {
+				return &nd.NodeList{}, fmt.Errorf("[Init.]: Failed to allow CIDR %s: %w", prefix, err)
+			}
 		}
 	}
 
@@ -186,18 +316,109 @@ func initializeNodeList(cfg Config, address string) (*nd.NodeList, error) {
 	return &nodeList, nil
 }
 
-func loadAndAssignBPFProgram(nodeList *nd.NodeList, linkName string, debug bool, mode int) error {
-	obj, err := bpf.LoadObjects()
+// setSelector sets the peer selector of a node list
+func setSelector(nodeList *nd.NodeList, selector string) error {
+	switch selector {
+	case "random":
+		nodeList.Selector = &nd.RandomSelector{}
+	case "roundrobin":
+		nodeList.Selector = &nd.RoundRobinSelector{}
+	case "zone":
+		nodeList.Selector = nodeList.NewZoneSelector(1)
+	default:
+		return fmt.Errorf("Unknown peer selector: %s", selector)
+	}
+	return nil
+}
+
+// clusterFactory creates the node lists of the clusters added through the HTTP API. They share the BPF objects, the xdp
+// socket and the settings of the default cluster, only the default cluster is mirrored into the kernel node list
+func clusterFactory(cfg Config, defaultNodeList *nd.NodeList) func(nd.ClusterConfig) (*nd.NodeList, error) {
+	return func(cc nd.ClusterConfig) (*nd.NodeList, error) {
+		nodeList := nd.NodeList{
+			Protocol:   defaultNodeList.Protocol,
+			SecretKey:  cc.SecretKey,
+			IsPrint:    cfg.Debug,
+			Piggyback:  cfg.Piggyback,
+			Infection:  cfg.Infection,
+			Adaptive:   cfg.Adaptive,
+			Allowlist:  cfg.Allowlist,
+			Program:    defaultNodeList.Program,
+			Xsk:        defaultNodeList.Xsk,
+			XskConfig:  defaultNodeList.XskConfig,
+			XdpQueues:  defaultNodeList.XdpQueues,
+			GatewayMAC: defaultNodeList.GatewayMAC,
+			Logger:     defaultNodeList.Logger,
+		}
+		if err := setSelector(&nodeList, cfg.Selector); err != nil {
+			return nil, err
+		}
+
+		localNode := defaultNodeList.LocalNode
+		localNode.Port = cc.Port
+		nodeList.New(localNode)
+
+		if len(cfg.Labels) != 0 {
+			nodeList.SetPrivate(cfg.Labels, nil) // Advertise node labels.
+		}
+		return &nodeList, nil
+	}
+}
+
+// selectProtocol sets up the requested protocol (the best supported one with "auto") and falls back from XDP to TC to UDP
+// when the kernel or the driver does not support it
+func selectProtocol(nodeList *nd.NodeList, cfg Config, opts *bpf.Options) string {
+	protocol := cfg.Protocol
+	if protocol == "auto" {
+		features, err := helper.ProbeFeatures(cfg.LinkName, cfg.ProbeLink)
+		if err != nil {
+			log.Printf("[Init.]: Failed to probe kernel features, using UDP: %v", err)
+			return "UDP"
+		}
+		protocol = features.BestProtocol()
+		log.Printf("[Init.]: Probed features: %s, using %s.", features, protocol)
+	}
+
+	for {
+		var mode int
+		switch protocol {
+		case "XDP":
+			mode = 1
+		case "TC":
+			mode = 0
+		default:
+			return protocol
+		}
+
+		err := loadAndAssignBPFProgram(nodeList, cfg.LinkName, cfg.Debug, mode, opts, cfg.Xsk)
+		if err == nil {
+			return protocol
+		}
+
+		fallback := "UDP"
+		if protocol == "XDP" {
+			fallback = "TC"
+		}
+		log.Printf("[Init.]: %s not supported, falling back to %s: %v", protocol, fallback, err)
+		protocol = fallback
+	}
+}
+
+func loadAndAssignBPFProgram(nodeList *nd.NodeList, linkName string, debug bool, mode int, opts *bpf.Options, xskConfig transport.XskConfig) error {
+	obj, err := bpf.LoadObjects(opts)
 	if err != nil {
 		return fmt.Errorf("[Init.]: Failed to load BPF objects: %w", err)
 	}
 
-	nodeList.Program = obj
-	l, xsk := helper.ProgramHandler(linkName, obj, debug, mode)
-	if l != nil {
-		defer l.Close()
+	// The programs stay attached after this function returns, with a pin path they also outlive the daemon
+	_, xsk, err := helper.ProgramHandler(linkName, obj, debug, mode, xskConfig)
+	if err != nil {
+		obj.Close()
+		return err
 	}
+	nodeList.Program = obj
 	nodeList.Xsk = xsk
+	nodeList.XskConfig = xskConfig
 	return nil
 }
 
@@ -215,21 +436,20 @@ func configureNodeList(nodeList *nd.NodeList, cfg Config, address string) error
 	nodeList.GatewayMAC = gatewayMAC.String()
 
 	nodeList.New(common.Node{
-		Addr:        address,
-		Port:        8000, // Consider making this configurable as well.
-		Mac:         macAddress,
-		Name:        cfg.NodeName,
-		LinkName:    cfg.LinkName,
-		PrivateData: "test-data", // Placeholder, consider making this configurable or dynamically generated.
+		Addr:     address,
+		Port:     cfg.Port,
+		Mac:      macAddress,
+		Name:     cfg.NodeName,
+		LinkName: cfg.LinkName,
 	})
 
 	return nil
 }
 
-func startDummyClient() error {
-	// Code for starting UDP listener on port 8000
+func startDummyClient(port int) error {
+	// Code for starting UDP listener on the gossip port
 	addr := net.UDPAddr{
-		Port: 8000,
+		Port: port,
 		IP:   net.ParseIP("0.0.0.0"),
 	}
 	conn, err := net.ListenUDP("udp", &addr)
@@ -238,7 +458,7 @@ func startDummyClient() error {
 	}
 	defer conn.Close()
 
-	log.Println("[Control]: Client is listening on UDP port 8000")
+	log.Printf("[Control]: Client is listening on UDP port %d", port)
 
 	// Buffer for reading incoming packets
 	buffer := make([]byte, 1024)
@@ -253,7 +473,8 @@ func startDummyClient() error {
 		// Print the received message
 		message := string(buffer[:n])
 
-		if message[8] == '1' {
+		// Only print broadcast packets (type in the binary header)
+		if n > common.HeaderSize && buffer[2] == 1 {
 			log.Printf("Received %d bytes from %v: %s\n", n, remoteAddr, message)
 		}
 
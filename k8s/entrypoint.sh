@@ -1,2 +1,2 @@
 #!/bin/sh
-/usr/local/bin/xdp-gossip server --name "${POD_NAME}" --link eth0 --proto "${PROTO}" --debug
\ No newline at end of file
+/usr/local/bin/xdp-gossip server --name "${POD_NAME}" --link eth0 --proto "${PROTO}" --port "${PORT:-8000}" --debug
\ No newline at end of file
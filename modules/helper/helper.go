@@ -1,25 +1,36 @@
 package helper
 
 import (
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/asavie/xdp"
 	bpf "github.com/kerwenwwer/eGossip/pkg/bpf"
 	common "github.com/kerwenwwer/eGossip/pkg/common"
+	"github.com/kerwenwwer/eGossip/pkg/transport"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
-// New initializes the local node list
-func ProgramHandler(LinkName string, obj *bpf.BpfObjects, debug bool, mode int) (*xdp.Program, *xdp.Socket) {
+// Retries of the AF_XDP socket bind while the queue is still busy
+const (
+	socketRetries    = 20
+	socketRetryDelay = 50 * time.Millisecond
+)
+
+// ProgramHandler attaches the TC program to a link and, in mode 1, the XDP program with an AF_XDP socket on queue 0
+func ProgramHandler(LinkName string, obj *bpf.BpfObjects, debug bool, mode int, xskConfig transport.XskConfig) (*xdp.Program, *xdp.Socket, error) {
 	// Get netlink by name
 	link, err := netlink.LinkByName(LinkName)
 	if err != nil {
-		log.Fatalf("[BPF Handler]: Failed to get link by name %v", err)
+		return nil, nil, fmt.Errorf("[BPF Handler]: Failed to get link by name: %w", err)
 	}
 
 	// Attach Tc program
 	if err := bpf.AttachTC(obj, link); err != nil {
-		log.Fatalf("[BPF Handler]: Failed to attach TC: %v", err)
+		return nil, nil, fmt.Errorf("[BPF Handler]: Failed to attach TC: %w", err)
 	}
 
 	if debug {
@@ -28,38 +39,48 @@ func ProgramHandler(LinkName string, obj *bpf.BpfObjects, debug bool, mode int)
 
 	// If mode is 0, return program only (no need to create AF_XDP socket)
 	if mode == 0 {
-		return nil, nil
+		// An XDP program pinned by a previous daemon in XDP mode would redirect gossip packets to no socket
+		if err := bpf.DetachXDP(obj, link.Attrs().Index); err != nil {
+			return nil, nil, fmt.Errorf("[BPF Handler]: Failed to detach XDP: %w", err)
+		}
+		return nil, nil, nil
 	}
 
 	//Attach XDP program
 	program, err := bpf.AttachXDP(obj, link.Attrs().Index)
 	if err != nil {
-		log.Fatalf("[BPF Handler]: Failed to attach XDP: %v", err)
+		return nil, nil, fmt.Errorf("[BPF Handler]: Failed to attach XDP: %w", err)
 	}
 
-	// Create AF_XDP socket
-	xsk, err := xdp.NewSocket(link.Attrs().Index, 0, &xdp.SocketOptions{
-		NumFrames:              256,
-		FrameSize:              4096,
-		FillRingNumDescs:       64,
-		CompletionRingNumDescs: 64,
-		RxRingNumDescs:         64,
-		TxRingNumDescs:         64,
-	})
+	// Create AF_XDP socket. The socket of a probe or of a previous daemon is released asynchronously by the kernel,
+	// the queue stays busy for a short while
+	var xsk *xdp.Socket
+	for attempt := 0; ; attempt++ {
+		xsk, err = transport.NewXsk(link.Attrs().Index, 0, xskConfig)
+		// The xdp package does not wrap the errno
+		if err == nil || attempt == socketRetries || !strings.Contains(err.Error(), unix.EBUSY.Error()) {
+			break
+		}
+		time.Sleep(socketRetryDelay)
+	}
 	if err != nil {
-		log.Fatal("[BPF Handler]: error: failed to create an XDP socket: ", err)
+		// Without a socket the XDP program would redirect gossip packets to nowhere
+		bpf.DetachXDP(obj, link.Attrs().Index)
+		return nil, nil, fmt.Errorf("[BPF Handler]: Failed to create an XDP socket: %w", err)
 	}
 
+	// The socket stays registered for the lifetime of the daemon, closing it removes it from xsks_map
 	if err := program.Register(0, xsk.FD()); err != nil {
-		log.Fatal("[BPF Handler]: error: failed to register socket in BPF map: ", err)
+		xsk.Close()
+		bpf.DetachXDP(obj, link.Attrs().Index)
+		return nil, nil, fmt.Errorf("[BPF Handler]: Failed to register socket in BPF map: %w", err)
 	}
-	defer program.Unregister(0)
 
 	if debug {
 		log.Printf("[BPF Handler]: AF_XDP program registered.")
 	}
 
-	return program, xsk
+	return program, xsk, nil
 }
 
 type MyPacket common.Packet
@@ -0,0 +1,218 @@
+package helper
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/btf"
+	"github.com/cilium/ebpf/features"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Features are the kernel and driver capabilities of a link, probed at startup to pick the protocol
+type Features struct {
+	BTF        bool // Kernel BTF (/sys/kernel/btf/vmlinux)
+	TCX        bool // TCX links (kernel 6.6+)
+	Clsact     bool // clsact qdisc for tc programs (used without TCX)
+	XDPNative  bool // XDP in the driver of the link (running already, or probed on the link)
+	XDPGeneric bool // XDP on the skb (any link, slower)
+	AFXDP      bool // AF_XDP sockets
+	ZeroCopy   bool // Zero-copy AF_XDP on queue 0 of the link (probed on the link only)
+}
+
+// String lists the supported features
+func (f Features) String() string {
+	var names []string
+	for _, feature := range []struct {
+		name string
+		ok   bool
+	}{
+		{"btf", f.BTF}, {"tcx", f.TCX}, {"clsact", f.Clsact}, {"xdp-native", f.XDPNative},
+		{"xdp-generic", f.XDPGeneric}, {"af_xdp", f.AFXDP}, {"zero-copy", f.ZeroCopy},
+	} {
+		if feature.ok {
+			names = append(names, feature.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// BestProtocol returns the fastest protocol supported: XDP, then TC, then UDP
+func (f Features) BestProtocol() string {
+	switch {
+	case (f.XDPNative || f.XDPGeneric) && f.AFXDP && (f.TCX || f.Clsact):
+		return "XDP"
+	case f.TCX || f.Clsact:
+		return "TC"
+	default:
+		return "UDP"
+	}
+}
+
+// ProbeFeatures probes the capabilities of a link. The hooks are probed on a scratch veth pair, the link itself is only
+// read: native XDP is reported if it already runs an XDP program in driver mode (e.g. a previous daemon). With onLink,
+// probe programs are also attached to the link in driver mode and a zero-copy AF_XDP socket is bound to its queue 0,
+// which resets the queues of many NICs and drops traffic meanwhile
+func ProbeFeatures(LinkName string, onLink bool) (Features, error) {
+	var f Features
+
+	l, err := netlink.LinkByName(LinkName)
+	if err != nil {
+		return f, fmt.Errorf("[Probe]: Failed to get link by name: %w", err)
+	}
+
+	_, err = btf.LoadKernelSpec()
+	f.BTF = err == nil
+
+	scratch, err := newScratchLink()
+	if err != nil {
+		return f, fmt.Errorf("[Probe]: Failed to create the scratch link: %w", err)
+	}
+	defer netlink.LinkDel(scratch)
+	ifindex := scratch.Attrs().Index
+
+	// Programs of both hooks must be loadable at all (CAP_BPF)
+	if features.HaveProgramType(ebpf.SchedCLS) == nil {
+		f.TCX = probeAttach(ebpf.SchedCLS, func(prog *ebpf.Program) (link.Link, error) {
+			return link.AttachTCX(link.TCXOptions{Interface: ifindex, Program: prog, Attach: ebpf.AttachTCXEgress})
+		})
+		f.Clsact = hasClsact(l) || probeClsact(scratch)
+	}
+
+	if features.HaveProgramType(ebpf.XDP) == nil {
+		f.XDPGeneric = probeAttach(ebpf.XDP, func(prog *ebpf.Program) (link.Link, error) {
+			return link.AttachXDP(link.XDPOptions{Program: prog, Interface: ifindex, Flags: link.XDPGenericMode})
+		})
+		if x := l.Attrs().Xdp; x != nil && x.Attached {
+			// A program is already attached, probe attachments would fail with EBUSY
+			f.XDPNative = x.AttachMode == nl.XDP_ATTACHED_DRV
+		} else if onLink {
+			f.XDPNative = probeAttach(ebpf.XDP, func(prog *ebpf.Program) (link.Link, error) {
+				return link.AttachXDP(link.XDPOptions{Program: prog, Interface: l.Attrs().Index, Flags: link.XDPDriverMode})
+			})
+		}
+	}
+
+	f.AFXDP = probeAFXDP(ifindex, unix.XDP_COPY)
+	if onLink {
+		f.ZeroCopy = probeAFXDP(l.Attrs().Index, unix.XDP_ZEROCOPY)
+	}
+
+	return f, nil
+}
+
+// newScratchLink creates a veth pair to probe the hooks on, deleting the returned link deletes both ends
+func newScratchLink() (netlink.Link, error) {
+	name := fmt.Sprintf("egprobe%d", os.Getpid()%100000)
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}
+	if err := netlink.LinkAdd(veth); err != nil {
+		return nil, err
+	}
+
+	l, err := netlink.LinkByName(name)
+	if err == nil {
+		err = netlink.LinkSetUp(l)
+	}
+	if err != nil {
+		netlink.LinkDel(veth)
+		return nil, err
+	}
+	return l, nil
+}
+
+// probeAttach loads a program returning the pass verdict of its type and reports whether attach succeeds
+func probeAttach(typ ebpf.ProgramType, attach func(*ebpf.Program) (link.Link, error)) bool {
+	verdict := asm.Instructions{asm.Mov.Imm(asm.R0, -1), asm.Return()} // TC_ACT_UNSPEC
+	if typ == ebpf.XDP {
+		verdict = asm.Instructions{asm.Mov.Imm(asm.R0, 2), asm.Return()} // XDP_PASS
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{Type: typ, Instructions: verdict, License: "GPL"})
+	if err != nil {
+		return false
+	}
+	defer prog.Close()
+
+	l, err := attach(prog)
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+// hasClsact reports whether the link already has a clsact qdisc
+func hasClsact(l netlink.Link) bool {
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		return false
+	}
+	for _, q := range qdiscs {
+		if q.Type() == "clsact" {
+			return true
+		}
+	}
+	return false
+}
+
+// probeClsact reports whether the (scratch) link accepts a clsact qdisc, the qdisc is removed right away
+func probeClsact(l netlink.Link) bool {
+	qdisc := &netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: l.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+		QdiscType: "clsact",
+	}
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return false
+	}
+	netlink.QdiscDel(qdisc)
+	return true
+}
+
+// probeAFXDP reports whether an AF_XDP socket can be bound to queue 0 of the link with flags (XDP_COPY or XDP_ZEROCOPY).
+// The socket is set up by hand: the rings of an xdp.Socket stay mapped after Close and keep the queue bound
+func probeAFXDP(ifindex int, flags uint16) bool {
+	const frames, frameSize, ringSize = 16, 4096, 8
+
+	bind := func() error {
+		fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(fd)
+
+		umem, err := unix.Mmap(-1, 0, frames*frameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+		if err != nil {
+			return err
+		}
+		defer unix.Munmap(umem)
+
+		reg := unix.XDPUmemReg{Addr: uint64(uintptr(unsafe.Pointer(&umem[0]))), Len: uint64(len(umem)), Size: frameSize}
+		if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_UMEM_REG,
+			uintptr(unsafe.Pointer(&reg)), unsafe.Sizeof(reg), 0); errno != 0 {
+			return errno
+		}
+		for _, ring := range []int{unix.XDP_UMEM_FILL_RING, unix.XDP_UMEM_COMPLETION_RING, unix.XDP_RX_RING} {
+			if err := unix.SetsockoptInt(fd, unix.SOL_XDP, ring, ringSize); err != nil {
+				return err
+			}
+		}
+
+		return unix.Bind(fd, &unix.SockaddrXDP{Flags: flags, Ifindex: uint32(ifindex), QueueID: 0})
+	}
+
+	return bind() == nil
+}
@@ -0,0 +1,306 @@
+package nodeList
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	bpf "github.com/kerwenwwer/eGossip/pkg/bpf"
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+const (
+	// DefaultCluster is the name of the cluster started with the daemon, also served by the top-level routes
+	DefaultCluster = "default"
+
+	maxClusters  = 64   // Clusters of a daemon, bounded by the gossip ports of the XDP program (ports_map)
+	clusterKeys  = 1000 // targets_map keys reserved for each cluster, cluster i uses i*clusterKeys+100 to i*clusterKeys+999
+	clustersPath = "/clusters"
+)
+
+// ClusterConfig is the configuration of a cluster created through the HTTP API
+type ClusterConfig struct {
+	Name      string // Cluster name, used in the /clusters/{name}/ routes
+	Port      int    // Gossip port, all nodes of the cluster use the same port
+	SecretKey string // Cluster key
+
+	// KernelNodes is rejected: nodelist_map is shared by the clusters of a daemon, only the default cluster is mirrored into it
+	KernelNodes bool
+}
+
+// ClusterInfo describes a cluster of the daemon
+type ClusterInfo struct {
+	Name  string // Cluster name
+	Port  int    // Gossip port
+	Nodes int    // Number of nodes in the local node list
+}
+
+// Clusters are the named gossip clusters run by a daemon. Each one has its own node list (membership, metadata, key and
+// port), they share the BPF objects and the xdp socket of the daemon
+type Clusters struct {
+	mu       sync.RWMutex
+	clusters map[string]*cluster
+
+	// NewNodeList creates and initializes (New) the node list of a cluster created through the HTTP API
+	NewNodeList func(config ClusterConfig) (*NodeList, error)
+}
+
+type cluster struct {
+	nodeList *NodeList
+	handler  http.Handler // Routes of the node list
+	slot     int          // Index of the targets_map key range of the cluster
+}
+
+// NewClusters returns the clusters of a daemon, defaultNodeList is the joined node list of the default cluster
+func NewClusters(defaultNodeList *NodeList, newNodeList func(config ClusterConfig) (*NodeList, error)) *Clusters {
+	return &Clusters{
+		clusters: map[string]*cluster{
+			DefaultCluster: {nodeList: defaultNodeList, handler: defaultNodeList.Handler()},
+		},
+		NewNodeList: newNodeList,
+	}
+}
+
+// Get returns the node list of a cluster
+func (c *Clusters) Get(name string) (*NodeList, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cl, ok := c.clusters[name]
+	if !ok {
+		return nil, false
+	}
+	return cl.nodeList, true
+}
+
+// List describes the clusters of the daemon, sorted by name
+func (c *Clusters) List() []ClusterInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	infos := make([]ClusterInfo, 0, len(c.clusters))
+	for name, cl := range c.clusters {
+		infos = append(infos, clusterInfo(name, cl.nodeList))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func clusterInfo(name string, nodeList *NodeList) ClusterInfo {
+	return ClusterInfo{Name: name, Port: nodeList.LocalNode.Port, Nodes: len(nodeList.Get())}
+}
+
+// Create creates a cluster and joins it
+func (c *Clusters) Create(config ClusterConfig) (*NodeList, error) {
+	if err := validClusterName(config.Name); err != nil {
+		return nil, err
+	}
+	if config.Port <= 0 || config.Port > 65535 {
+		return nil, fmt.Errorf("invalid gossip port: %d", config.Port)
+	}
+	if config.SecretKey == "" {
+		return nil, fmt.Errorf("missing cluster key")
+	}
+	if config.KernelNodes {
+		return nil, fmt.Errorf("the kernel node list is only available to the default cluster")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.clusters[config.Name]; ok {
+		return nil, fmt.Errorf("cluster %s already exists", config.Name)
+	}
+	used := make(map[int]bool, len(c.clusters))
+	for name, cl := range c.clusters {
+		if cl.nodeList.LocalNode.Port == config.Port {
+			return nil, fmt.Errorf("port %d is used by cluster %s", config.Port, name)
+		}
+		used[cl.slot] = true
+	}
+	slot := 1
+	for used[slot] {
+		slot++
+	}
+	if slot >= maxClusters {
+		return nil, fmt.Errorf("too many clusters: %d", len(c.clusters))
+	}
+
+	nodeList, err := c.NewNodeList(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Each cluster broadcasts through its own targets_map keys
+	base := uint16(slot * clusterKeys)
+	nodeList.Counter = common.NewAtomicCounterRange(base+100, base+999)
+
+	if nodeList.Protocol == "XDP" && nodeList.Program != nil {
+		if err := bpf.AddPort(nodeList.Program, uint16(config.Port)); err != nil {
+			nodeList.Close()
+			return nil, err
+		}
+	}
+
+	if err := nodeList.Join(); err != nil {
+		nodeList.Close()
+		if nodeList.Protocol == "XDP" && nodeList.Program != nil {
+			bpf.RemovePort(nodeList.Program, uint16(config.Port))
+		}
+		return nil, err
+	}
+	c.clusters[config.Name] = &cluster{nodeList: nodeList, handler: nodeList.Handler(), slot: slot}
+	nodeList.Logger.Sugar().Infoln("[Control]: Cluster", config.Name, "created on port", config.Port)
+	return nodeList, nil
+}
+
+// Remove leaves a cluster and releases its port, the default cluster cannot be removed
+func (c *Clusters) Remove(name string) error {
+	if name == DefaultCluster {
+		return fmt.Errorf("the default cluster cannot be removed")
+	}
+
+	c.mu.Lock()
+	cl, ok := c.clusters[name]
+	delete(c.clusters, name)
+	c.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("cluster %s not found", name)
+	}
+
+	nodeList := cl.nodeList
+	nodeList.Close()
+	if nodeList.Protocol == "XDP" && nodeList.Program != nil {
+		if err := bpf.RemovePort(nodeList.Program, uint16(nodeList.LocalNode.Port)); err != nil {
+			return err
+		}
+	}
+	nodeList.Logger.Sugar().Infoln("[Control]: Cluster", name, "removed")
+	return nil
+}
+
+// validClusterName checks that a cluster name can be used in a URL path
+func validClusterName(name string) error {
+	if name == "" || len(name) > 63 {
+		return fmt.Errorf("invalid cluster name: %q (1 to 63 characters)", name)
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return fmt.Errorf("invalid cluster name: %q (letters, digits, '-', '_' and '.')", name)
+		}
+	}
+	return nil
+}
+
+// Handler serves the cluster routes:
+//
+//	GET    /clusters                 list the clusters
+//	POST   /clusters                 create a cluster (ClusterConfig)
+//	GET    /clusters/{name}          describe a cluster
+//	DELETE /clusters/{name}          remove a cluster
+//	*      /clusters/{name}/{route}  node list route of a cluster (e.g. /clusters/{name}/list)
+//
+// POST /clusters/{name}/v1/lifecycle/leave removes the cluster like DELETE /clusters/{name}
+//
+// The clusters created through the API do not mirror their node list into the kernel (--kernel-nodes), nodelist_map
+// is shared by the clusters of the daemon and holds the nodes of the default cluster only
+func (c *Clusters) Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, clustersPath), "/")
+		if rest == "" {
+			c.serveClusters(w, r)
+			return
+		}
+
+		name, route, _ := strings.Cut(rest, "/")
+		c.mu.RLock()
+		cl, ok := c.clusters[name]
+		c.mu.RUnlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("Cluster %s not found", name), http.StatusNotFound)
+			return
+		}
+
+		if route == "" {
+			c.serveCluster(w, r, name, cl)
+			return
+		}
+		// Leaving a cluster other than the default one removes it, so that its port is released
+		if route == "v1/lifecycle/leave" && r.Method == http.MethodPost && name != DefaultCluster {
+			if err := c.Remove(name); err != nil {
+				writeError(w, http.StatusConflict, "conflict", err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, Lifecycle{State: StateLeft})
+			return
+		}
+		http.StripPrefix(clustersPath+"/"+name, cl.handler).ServeHTTP(w, r)
+	}
+}
+
+// serveClusters lists or creates clusters
+func (c *Clusters) serveClusters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		// Set the Content-Type header to indicate a JSON response
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(c.List()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodPost:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Can't read request body", http.StatusBadRequest)
+			return
+		}
+		var config ClusterConfig
+		if err := json.Unmarshal(body, &config); err != nil {
+			http.Error(w, "Can't parse JSON", http.StatusBadRequest)
+			return
+		}
+
+		nodeList, err := c.Create(config)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(clusterInfo(config.Name, nodeList)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	default:
+		http.Error(w, errMsgInvalidRequestMethod, http.StatusMethodNotAllowed)
+	}
+}
+
+// serveCluster describes or removes a cluster
+func (c *Clusters) serveCluster(w http.ResponseWriter, r *http.Request, name string, cl *cluster) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(clusterInfo(name, cl.nodeList)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+
+	case http.MethodDelete:
+		if err := c.Remove(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write([]byte("Cluster removed successfully.\n"))
+		if err != nil {
+			log.Println(errMsgErrorWritingResponse)
+		}
+
+	default:
+		http.Error(w, errMsgInvalidRequestMethod, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,235 @@
+package nodeList
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+	logger "github.com/kerwenwwer/eGossip/pkg/logger"
+)
+
+// freePort returns a UDP port of 127.0.0.1 that is not in use
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// newTestClusters returns clusters whose default node list is not joined, the clusters created through the API gossip
+// over UDP on 127.0.0.1 and are closed at the end of the test
+func newTestClusters(t *testing.T) *Clusters {
+	t.Helper()
+	c := NewClusters(newTestNodeList(t, &NodeList{}, 1), func(config ClusterConfig) (*NodeList, error) {
+		nodeList := &NodeList{Protocol: "UDP", SecretKey: config.SecretKey, Logger: logger.NewNopLogger()}
+		nodeList.New(common.Node{Addr: "127.0.0.1", Port: config.Port})
+		return nodeList, nil
+	})
+	t.Cleanup(func() {
+		for _, info := range c.List() {
+			if info.Name != DefaultCluster {
+				c.Remove(info.Name)
+			}
+		}
+	})
+	return c
+}
+
+// serve sends a request to handler and returns the response
+func serve(handler http.Handler, method string, target string, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestClustersHandler(t *testing.T) {
+	c := newTestClusters(t)
+	handler := c.Handler()
+	port := freePort(t)
+
+	w := serve(handler, http.MethodPost, "/clusters", fmt.Sprintf(`{"Name":"c1","Port":%d,"SecretKey":"key"}`, port))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	var info ClusterInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	if want := (ClusterInfo{Name: "c1", Port: port, Nodes: 1}); info != want {
+		t.Errorf("created cluster = %+v, want %+v", info, want)
+	}
+
+	var infos []ClusterInfo
+	w = serve(handler, http.MethodGet, "/clusters", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "c1" || infos[1].Name != DefaultCluster {
+		t.Errorf("clusters = %+v, want c1 and default", infos)
+	}
+
+	if w = serve(handler, http.MethodGet, "/clusters/c1", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Name":"c1"`) {
+		t.Errorf("get: status %d (%s), want c1", w.Code, w.Body)
+	}
+
+	// The node list routes of the cluster
+	if w = serve(handler, http.MethodGet, "/clusters/c1/list", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), fmt.Sprintf(`"Port":%d`, port)) {
+		t.Errorf("list: status %d (%s), want the local node of c1", w.Code, w.Body)
+	}
+	if w = serve(handler, http.MethodGet, "/clusters/c1/v1/members", ""); w.Code != http.StatusOK {
+		t.Errorf("v1 members: status %d (%s), want %d", w.Code, w.Body, http.StatusOK)
+	}
+
+	nodeList, _ := c.Get("c1")
+	if w = serve(handler, http.MethodDelete, "/clusters/c1", ""); w.Code != http.StatusOK {
+		t.Errorf("delete: status %d (%s), want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if !nodeList.Closed() {
+		t.Error("removed cluster not closed")
+	}
+	if w = serve(handler, http.MethodGet, "/clusters/c1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("get after delete: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// The port is released
+	w = serve(handler, http.MethodPost, "/clusters", fmt.Sprintf(`{"Name":"c2","Port":%d,"SecretKey":"key"}`, port))
+	if w.Code != http.StatusCreated {
+		t.Errorf("create on the released port: status %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+}
+
+func TestClustersHandlerErrors(t *testing.T) {
+	c := newTestClusters(t)
+	handler := c.Handler()
+	port := freePort(t)
+	if _, err := c.Create(ClusterConfig{Name: "c1", Port: port, SecretKey: "key"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		want   string
+	}{
+		{"bad json", http.MethodPost, "/clusters", `{"Name":`, http.StatusBadRequest, "Can't parse JSON"},
+		{"empty name", http.MethodPost, "/clusters", `{"Port":9000,"SecretKey":"key"}`, http.StatusBadRequest, "invalid cluster name"},
+		{"name with slash", http.MethodPost, "/clusters", `{"Name":"a/b","Port":9000,"SecretKey":"key"}`, http.StatusBadRequest, "invalid cluster name"},
+		{"long name", http.MethodPost, "/clusters", `{"Name":"` + strings.Repeat("a", 64) + `","Port":9000,"SecretKey":"key"}`, http.StatusBadRequest, "invalid cluster name"},
+		{"invalid port", http.MethodPost, "/clusters", `{"Name":"c2","Port":70000,"SecretKey":"key"}`, http.StatusBadRequest, "invalid gossip port"},
+		{"missing key", http.MethodPost, "/clusters", `{"Name":"c2","Port":9000}`, http.StatusBadRequest, "missing cluster key"},
+		{"kernel nodes", http.MethodPost, "/clusters", `{"Name":"c2","Port":9000,"SecretKey":"key","KernelNodes":true}`, http.StatusBadRequest, "only available to the default cluster"},
+		{"duplicate name", http.MethodPost, "/clusters", fmt.Sprintf(`{"Name":"c1","Port":%d,"SecretKey":"key"}`, port+1), http.StatusBadRequest, "already exists"},
+		{"port of a cluster", http.MethodPost, "/clusters", fmt.Sprintf(`{"Name":"c2","Port":%d,"SecretKey":"key"}`, port), http.StatusBadRequest, "is used by cluster c1"},
+		{"port of the default cluster", http.MethodPost, "/clusters", `{"Name":"c2","Port":8000,"SecretKey":"key"}`, http.StatusBadRequest, "is used by cluster default"},
+		{"delete default", http.MethodDelete, "/clusters/default", "", http.StatusBadRequest, "cannot be removed"},
+		{"unknown cluster", http.MethodGet, "/clusters/c9", "", http.StatusNotFound, "not found"},
+		{"unknown cluster route", http.MethodGet, "/clusters/c9/list", "", http.StatusNotFound, "not found"},
+		{"method", http.MethodPut, "/clusters", "", http.StatusMethodNotAllowed, errMsgInvalidRequestMethod},
+		{"cluster method", http.MethodPost, "/clusters/c1", "", http.StatusMethodNotAllowed, errMsgInvalidRequestMethod},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(handler, tt.method, tt.target, tt.body)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.want) {
+				t.Errorf("status %d (%s), want %d (%s)", w.Code, strings.TrimSpace(w.Body.String()), tt.status, tt.want)
+			}
+		})
+	}
+	if n := len(c.List()); n != 2 {
+		t.Errorf("%d clusters after the failed requests, want 2", n)
+	}
+}
+
+func TestClustersLeave(t *testing.T) {
+	c := newTestClusters(t)
+	handler := c.Handler()
+	port := freePort(t)
+	nodeList, err := c.Create(ClusterConfig{Name: "c1", Port: port, SecretKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leaving a cluster removes it and releases its port
+	w := serve(handler, http.MethodPost, "/clusters/c1/v1/lifecycle/leave", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"State":"`+StateLeft+`"`) {
+		t.Errorf("leave: status %d (%s), want %d and state %s", w.Code, w.Body, http.StatusOK, StateLeft)
+	}
+	if !nodeList.Closed() {
+		t.Error("left cluster not closed")
+	}
+	if _, ok := c.Get("c1"); ok {
+		t.Error("left cluster still listed")
+	}
+	if _, err := c.Create(ClusterConfig{Name: "c2", Port: port, SecretKey: "key"}); err != nil {
+		t.Errorf("create on the port of the left cluster: %v", err)
+	}
+
+	// The other lifecycle routes keep the cluster
+	if w = serve(handler, http.MethodPost, "/clusters/c2/v1/lifecycle/stop", ""); w.Code != http.StatusOK {
+		t.Errorf("stop: status %d (%s), want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if _, ok := c.Get("c2"); !ok {
+		t.Error("stopped cluster removed")
+	}
+}
+
+func TestClustersPortInUse(t *testing.T) {
+	c := newTestClusters(t)
+	handler := c.Handler()
+
+	// A port bound by another socket fails the creation, the cluster is not kept
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	w := serve(handler, http.MethodPost, "/clusters", fmt.Sprintf(`{"Name":"c1","Port":%d,"SecretKey":"key"}`, port))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "can't listen on port") {
+		t.Errorf("create on a port in use: status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), http.StatusBadRequest)
+	}
+	if _, ok := c.Get("c1"); ok {
+		t.Error("cluster kept after a failed creation")
+	}
+
+	// Once the port is released, the same cluster can be created
+	conn.Close()
+	if w = serve(handler, http.MethodPost, "/clusters", fmt.Sprintf(`{"Name":"c1","Port":%d,"SecretKey":"key"}`, port)); w.Code != http.StatusCreated {
+		t.Errorf("create on the released port: status %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+}
+
+func TestClustersLimit(t *testing.T) {
+	c := newTestClusters(t)
+
+	// Fill the targets_map key ranges without joining, slot 0 is the default cluster
+	for slot := 1; slot < maxClusters; slot++ {
+		nodeList := newTestNodeList(t, &NodeList{}, 1)
+		nodeList.LocalNode.Port = 10000 + slot
+		c.clusters[fmt.Sprintf("c%d", slot)] = &cluster{nodeList: nodeList, slot: slot}
+	}
+	port := freePort(t)
+	if _, err := c.Create(ClusterConfig{Name: "extra", Port: port, SecretKey: "key"}); err == nil || !strings.Contains(err.Error(), "too many clusters") {
+		t.Fatalf("error = %v, want too many clusters", err)
+	}
+
+	// A removed cluster frees its slot and key range
+	delete(c.clusters, "c5")
+	nodeList, err := c.Create(ClusterConfig{Name: "extra", Port: port, SecretKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := nodeList.Counter.Next(); key < 5*clusterKeys+100 || key > 5*clusterKeys+999 {
+		t.Errorf("targets_map key = %d, want the range of slot 5", key)
+	}
+}
@@ -0,0 +1,219 @@
+package nodeList
+
+import (
+	"context"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+	"github.com/kerwenwwer/eGossip/pkg/controlpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+ * gRPC server for XDP Gossip control plane, alongside the HTTP handlers.
+ */
+
+// ControlServer serves the gRPC control API (controlpb.Control) of the clusters of a daemon
+type ControlServer struct {
+	controlpb.UnimplementedControlServer
+	Clusters *Clusters
+}
+
+// NewControlServer returns the gRPC control server of the clusters
+func NewControlServer(clusters *Clusters) *ControlServer {
+	return &ControlServer{Clusters: clusters}
+}
+
+// nodeList returns the node list of a cluster, an empty name is the default cluster
+func (s *ControlServer) nodeList(cluster string) (*NodeList, error) {
+	if cluster == "" {
+		cluster = DefaultCluster
+	}
+	nl, ok := s.Clusters.Get(cluster)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "cluster %s not found", cluster)
+	}
+	return nl, nil
+}
+
+// ListMembers lists the nodes of the local node list
+func (s *ControlServer) ListMembers(ctx context.Context, req *controlpb.ListMembersRequest) (*controlpb.ListMembersResponse, error) {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &controlpb.ListMembersResponse{}
+	for _, node := range nl.Get() {
+		resp.Nodes = append(resp.Nodes, nodeToProto(node))
+	}
+	return resp, nil
+}
+
+// WatchMembers streams the nodes of the local node list, then every membership change
+func (s *ControlServer) WatchMembers(req *controlpb.WatchMembersRequest, stream controlpb.Control_WatchMembersServer) error {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return err
+	}
+
+	err = nl.WatchMembers(stream.Context(), func(events []MemberEvent) error {
+		for _, e := range events {
+			event := &controlpb.MemberEvent{Type: controlpb.MemberEvent_Type(e.Type), Node: nodeToProto(e.Node)}
+			if err := stream.Send(event); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return watchError(err)
+}
+
+// PublishMetadata publishes new cluster metadata
+func (s *ControlServer) PublishMetadata(ctx context.Context, req *controlpb.PublishMetadataRequest) (*controlpb.PublishMetadataResponse, error) {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return nil, err
+	}
+
+	nl.Publish(req.GetData())
+	return &controlpb.PublishMetadataResponse{Version: nl.metadata.Load().(common.Metadata).Update}, nil
+}
+
+// GetMetadata reads the local copy of the cluster metadata
+func (s *ControlServer) GetMetadata(ctx context.Context, req *controlpb.GetMetadataRequest) (*controlpb.Metadata, error) {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return nil, err
+	}
+
+	return metadataToProto(nl.metadata.Load().(common.Metadata)), nil
+}
+
+// WatchMetadata streams the cluster metadata, then every newer version
+func (s *ControlServer) WatchMetadata(req *controlpb.WatchMetadataRequest, stream controlpb.Control_WatchMetadataServer) error {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return err
+	}
+
+	err = nl.WatchMetadata(stream.Context(), func(md common.Metadata) error {
+		return stream.Send(metadataToProto(md))
+	})
+	return watchError(err)
+}
+
+// Join adds a node to the local node list
+func (s *ControlServer) Join(ctx context.Context, req *controlpb.JoinRequest) (*controlpb.JoinResponse, error) {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return nil, err
+	}
+	node := req.GetNode()
+	if node.GetAddr() == "" || node.GetPort() <= 0 || node.GetPort() > 65535 {
+		return nil, status.Error(codes.InvalidArgument, "node address and port are required")
+	}
+
+	joined := common.Node{
+		ID:       node.GetId(),
+		Addr:     node.GetAddr(),
+		Port:     int(node.GetPort()),
+		Mac:      node.GetMac(),
+		Name:     node.GetName(),
+		LinkName: node.GetLinkName(),
+	}
+	nl.Set(joined)
+
+	// Set identifies a node without ID by its address, and rejects a node claiming the ID of another live node
+	id := joined.ID
+	if id == "" {
+		id = nodeKey(joined)
+	}
+	if stored, ok := nl.Member(id); !ok || nodeKey(stored) != nodeKey(joined) {
+		return nil, status.Errorf(codes.AlreadyExists, "node ID %s is used by another node", id)
+	}
+	return &controlpb.JoinResponse{}, nil
+}
+
+// Leave stops the heartbeats of the local node
+func (s *ControlServer) Leave(ctx context.Context, req *controlpb.LeaveRequest) (*controlpb.LeaveResponse, error) {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return nil, err
+	}
+
+	nl.Stop()
+	return &controlpb.LeaveResponse{}, nil
+}
+
+// GetStats reads the gossip statistics of the local node
+func (s *ControlServer) GetStats(ctx context.Context, req *controlpb.GetStatsRequest) (*controlpb.Stats, error) {
+	nl, err := s.nodeList(req.GetCluster())
+	if err != nil {
+		return nil, err
+	}
+
+	stats := nl.Stats()
+	resp := &controlpb.Stats{
+		Infection:       stats.Infection,
+		Sent:            stats.Sent,
+		SentBytes:       stats.SentBytes,
+		AvgPacketSize:   stats.AvgPacketSize,
+		Received:        stats.Received,
+		Redundant:       stats.Redundant,
+		RedundancyRatio: stats.RedundancyRatio,
+		QueuedUpdates:   int32(stats.QueuedUpdates),
+	}
+	if xs := stats.XDP; xs != nil {
+		resp.Xdp = &controlpb.XdpStats{
+			Redirected: xs.Redirected,
+			Duplicate:  xs.Duplicate,
+			Stale:      xs.Stale,
+			Denied:     xs.Denied,
+			Limited:    xs.Limited,
+		}
+	}
+	if xs := stats.XSK; xs != nil {
+		resp.Xsk = &controlpb.XskStats{
+			ZeroCopy:       xs.ZeroCopy,
+			FillRing:       int32(xs.FillRing),
+			FillRingSize:   int32(xs.FillRingSize),
+			RxRing:         int32(xs.RxRing),
+			RxRingSize:     int32(xs.RxRingSize),
+			RxDropped:      xs.RxDropped,
+			RxInvalidDescs: xs.RxInvalidDescs,
+			RxRingFull:     xs.RxRingFull,
+			FillRingEmpty:  xs.FillRingEmpty,
+		}
+	}
+	return resp, nil
+}
+
+// watchError converts the end of a watch into a gRPC status, a watch ends without error when its cluster is removed
+func watchError(err error) error {
+	switch err {
+	case nil, context.Canceled:
+		return nil
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	return status.Error(codes.Unavailable, err.Error())
+}
+
+func nodeToProto(node common.Node) *controlpb.Node {
+	return &controlpb.Node{
+		Id:       node.ID,
+		Addr:     node.Addr,
+		Port:     int32(node.Port),
+		Mac:      node.Mac,
+		Name:     node.Name,
+		LinkName: node.LinkName,
+	}
+}
+
+func metadataToProto(md common.Metadata) *controlpb.Metadata {
+	return &controlpb.Metadata{Data: md.Data, Version: md.Update}
+}
@@ -0,0 +1,191 @@
+package nodeList
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+	"github.com/kerwenwwer/eGossip/pkg/controlpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestControlClient serves the control API of clusters over an in-memory connection
+func newTestControlClient(t *testing.T, clusters *Clusters) controlpb.ControlClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	controlpb.RegisterControlServer(server, NewControlServer(clusters))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return controlpb.NewControlClient(conn)
+}
+
+func TestControlJoinLeave(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	client := newTestControlClient(t, NewClusters(nodeList, nil))
+	ctx := context.Background()
+
+	node := &controlpb.Node{Id: "n1", Addr: "127.0.0.2", Port: 8000, Name: "n1"}
+	if _, err := client.Join(ctx, &controlpb.JoinRequest{Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.ListMembers(ctx, &controlpb.ListMembersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.GetNodes()) != 2 {
+		t.Errorf("members = %v, want the local node and n1", resp.GetNodes())
+	}
+	if got, ok := nodeList.Member("n1"); !ok || got.Addr != "127.0.0.2" || got.Port != 8000 || got.Name != "n1" {
+		t.Errorf("member n1 = %+v, %v, want the joined node", got, ok)
+	}
+
+	// Leave stops the heartbeats, the node list can be started again
+	if _, err := client.Leave(ctx, &controlpb.LeaveRequest{Cluster: DefaultCluster}); err != nil {
+		t.Fatal(err)
+	}
+	if nodeList.Running() || nodeList.Closed() {
+		t.Errorf("running %v, closed %v after Leave, want stopped", nodeList.Running(), nodeList.Closed())
+	}
+}
+
+func TestControlErrors(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.2", Port: 8000})
+	client := newTestControlClient(t, NewClusters(nodeList, nil))
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		call func() error
+		want codes.Code
+	}{
+		{"join without address", func() error {
+			_, err := client.Join(ctx, &controlpb.JoinRequest{Node: &controlpb.Node{Port: 8000}})
+			return err
+		}, codes.InvalidArgument},
+		{"join without node", func() error {
+			_, err := client.Join(ctx, &controlpb.JoinRequest{})
+			return err
+		}, codes.InvalidArgument},
+		{"join invalid port", func() error {
+			_, err := client.Join(ctx, &controlpb.JoinRequest{Node: &controlpb.Node{Addr: "127.0.0.2", Port: 70000}})
+			return err
+		}, codes.InvalidArgument},
+		{"join with the id of a live node", func() error {
+			_, err := client.Join(ctx, &controlpb.JoinRequest{Node: &controlpb.Node{Id: "n1", Addr: "127.0.0.3", Port: 8000}})
+			return err
+		}, codes.AlreadyExists},
+		{"join with the local id", func() error {
+			_, err := client.Join(ctx, &controlpb.JoinRequest{Node: &controlpb.Node{Id: "local", Addr: "127.0.0.3", Port: 8000}})
+			return err
+		}, codes.AlreadyExists},
+		{"leave unknown cluster", func() error {
+			_, err := client.Leave(ctx, &controlpb.LeaveRequest{Cluster: "c9"})
+			return err
+		}, codes.NotFound},
+		{"watch unknown cluster", func() error {
+			stream, err := client.WatchMembers(ctx, &controlpb.WatchMembersRequest{Cluster: "c9"})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := status.Code(tt.call()); got != tt.want {
+				t.Errorf("code = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got, _ := nodeList.Member("n1"); got.Addr != "127.0.0.2" {
+		t.Errorf("n1 moved to %s by a conflicting join", got.Addr)
+	}
+}
+
+func TestControlWatchMembers(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	client := newTestControlClient(t, NewClusters(nodeList, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchMembers(ctx, &controlpb.WatchMembersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := func(typ controlpb.MemberEvent_Type, id string) {
+		t.Helper()
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.GetType() != typ || event.GetNode().GetId() != id {
+			t.Fatalf("event = %v %s, want %v %s", event.GetType(), event.GetNode().GetId(), typ, id)
+		}
+	}
+
+	// The initial list, then every change
+	expect(controlpb.MemberEvent_TYPE_JOINED, "local")
+	node := &controlpb.Node{Id: "n1", Addr: "127.0.0.2", Port: 8000}
+	if _, err := client.Join(ctx, &controlpb.JoinRequest{Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	expect(controlpb.MemberEvent_TYPE_JOINED, "n1")
+	node.Name = "renamed"
+	if _, err := client.Join(ctx, &controlpb.JoinRequest{Node: node}); err != nil {
+		t.Fatal(err)
+	}
+	expect(controlpb.MemberEvent_TYPE_UPDATED, "n1")
+	nodeList.Remove("n1")
+	expect(controlpb.MemberEvent_TYPE_LEFT, "n1")
+
+	// The watch ends when the node list is closed
+	nodeList.Close()
+	if _, err := stream.Recv(); err == nil {
+		t.Error("watch still open after Close")
+	}
+}
+
+func TestControlWatchMetadata(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	client := newTestControlClient(t, NewClusters(nodeList, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := client.WatchMetadata(ctx, &controlpb.WatchMetadataRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md, err := stream.Recv(); err != nil || md.GetVersion() != 0 {
+		t.Fatalf("initial metadata = %v, %v, want version 0", md, err)
+	}
+
+	resp, err := client.PublishMetadata(ctx, &controlpb.PublishMetadataRequest{Data: []byte("config")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(md.GetData()) != "config" || md.GetVersion() != resp.GetVersion() || md.GetVersion() == 0 {
+		t.Errorf("metadata = %q version %d, want %q version %d", md.GetData(), md.GetVersion(), "config", resp.GetVersion())
+	}
+}
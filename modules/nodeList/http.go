@@ -16,6 +16,23 @@ const errMsgErrorWritingResponse = "Error writing response"
  * HTTP server for XDP Gossip control plane.
  */
 
+// Handler returns the routes of the node list
+func (nl *NodeList) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/set", nl.SetNodeHandler())
+	mux.HandleFunc("/list", nl.ListNodeHandler())
+	mux.HandleFunc("/conflicts", nl.ListConflictHandler())
+	mux.HandleFunc("/stop", nl.StopNodeHandler())
+	mux.HandleFunc("/publish", nl.PublishHandler())
+	mux.HandleFunc("/metadata", nl.GetMetadataHandler())
+	mux.HandleFunc("/private", nl.GetPrivateHandler())
+	mux.HandleFunc("/private/set", nl.SetPrivateHandler())
+	mux.HandleFunc("/stats", nl.StatsHandler())
+	mux.HandleFunc("/config", nl.TuningHandler())
+	mux.HandleFunc(v1Prefix+"/", nl.V1Handler())
+	return mux
+}
+
 // GET API
 
 // Dump node list.
@@ -41,6 +58,28 @@ func (nl *NodeList) ListNodeHandler() http.HandlerFunc {
 	}
 }
 
+// Dump node ID conflicts.
+func (nl *NodeList) ListConflictHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, errMsgInvalidRequestMethod, http.StatusMethodNotAllowed)
+			return
+		}
+
+		conflicts := nl.Conflicts()
+
+		// Set the Content-Type header to indicate a JSON response
+		w.Header().Set("Content-Type", "application/json")
+
+		// Encode the conflicts as JSON and write the response
+		err := json.NewEncoder(w).Encode(conflicts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
 // Stop a node.
 func (nl *NodeList) StopNodeHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -83,6 +122,72 @@ func (nl *NodeList) GetMetadataHandler() http.HandlerFunc {
 	}
 }
 
+// Get private metadata of all nodes.
+func (nl *NodeList) GetPrivateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, errMsgInvalidRequestMethod, http.StatusMethodNotAllowed)
+			return
+		}
+
+		private := nl.ReadPrivate()
+
+		// Set the Content-Type header to indicate a JSON response
+		w.Header().Set("Content-Type", "application/json")
+
+		// Encode the private metadata as JSON and write the response
+		err := json.NewEncoder(w).Encode(private)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Get gossip statistics.
+func (nl *NodeList) StatsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, errMsgInvalidRequestMethod, http.StatusMethodNotAllowed)
+			return
+		}
+
+		stats := nl.Stats()
+
+		// Set the Content-Type header to indicate a JSON response
+		w.Header().Set("Content-Type", "application/json")
+
+		// Encode the statistics as JSON and write the response
+		err := json.NewEncoder(w).Encode(stats)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Get effective gossip configuration.
+func (nl *NodeList) TuningHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, errMsgInvalidRequestMethod, http.StatusMethodNotAllowed)
+			return
+		}
+
+		tuning := nl.Tuning()
+
+		// Set the Content-Type header to indicate a JSON response
+		w.Header().Set("Content-Type", "application/json")
+
+		// Encode the configuration as JSON and write the response
+		err := json.NewEncoder(w).Encode(tuning)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
 // POST API
 
 // Publish data to all nodes.
@@ -148,3 +253,37 @@ func (nl *NodeList) SetNodeHandler() http.HandlerFunc {
 		}
 	}
 }
+
+// Set private metadata of the local node.
+func (nl *NodeList) SetPrivateHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, errMsgInvalidRequestMethod, http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Can't read request body", http.StatusBadRequest)
+			return
+		}
+
+		var md common.NodeMetadata
+		err = json.Unmarshal(body, &md)
+		if err != nil {
+			http.Error(w, "Can't parse JSON", http.StatusBadRequest)
+			return
+		}
+
+		// Update the private metadata, it will be propagated with the next heartbeat
+		nl.SetPrivate(md.Labels, md.Data)
+
+		// Write response
+		w.WriteHeader(http.StatusOK)
+		_, err = w.Write([]byte("Private metadata updated successfully.\n"))
+		if err != nil {
+			log.Println(errMsgErrorWritingResponse)
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package nodeList
+
+import (
+	"math"
+	"time"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+// Infection tracking modes, all nodes of a cluster should use the same mode
+const (
+	InfectionMap   = "map"   // Infected map of "Addr:Port" carried in every packet, grows with the cluster size (default)
+	InfectionBloom = "bloom" // Bloom filter of infected nodes, fixed packet size with false positives
+	InfectionTTL   = "ttl"   // Hop count, no infected node list, duplicated broadcasts are not forwarded
+)
+
+// initInfection sets up the infection tracking of a broadcast packet originated by the local node
+func initInfection(nodeList *NodeList, p *common.Packet) {
+	p.Time = time.Now().UnixNano()
+
+	switch nodeList.Infection {
+	case InfectionBloom:
+		p.Bloom = common.NewBloomFilter(nodeList.BloomBits)
+	case InfectionTTL:
+		p.TTL = defaultTTL(nodeList.size(), nodeList.fanout())
+	default:
+		p.Infected = make(map[string]bool)
+	}
+
+	// Add the local node to the infected nodes
+	markInfected(nodeList, p, nodeList.LocalNode)
+}
+
+// isInfected reports whether the node has already been infected by the packet
+func isInfected(nodeList *NodeList, p *common.Packet, node common.Node) bool {
+	switch nodeList.Infection {
+	case InfectionBloom:
+		return p.Bloom.Test(nodeKey(node))
+	case InfectionTTL:
+		// Only the origin and the local node are known to be infected
+		return node.ID == p.Node.ID || node.ID == nodeList.LocalNode.ID
+	default:
+		return p.Infected[nodeKey(node)]
+	}
+}
+
+// markInfected marks the node as infected by the packet
+func markInfected(nodeList *NodeList, p *common.Packet, node common.Node) {
+	switch nodeList.Infection {
+	case InfectionBloom:
+		p.Bloom.Add(nodeKey(node))
+	case InfectionTTL:
+	default:
+		if p.Infected == nil {
+			p.Infected = make(map[string]bool)
+		}
+		p.Infected[nodeKey(node)] = true
+	}
+}
+
+// forwardInfection reports whether a received broadcast packet should be forwarded, and consumes one hop in TTL mode
+func forwardInfection(nodeList *NodeList, p *common.Packet, redundant bool) bool {
+	if nodeList.Infection != InfectionTTL {
+		return true
+	}
+	if redundant || p.TTL <= 1 {
+		return false
+	}
+	p.TTL--
+	return true
+}
+
+// defaultTTL returns the number of hops needed to reach n nodes with the given fanout, plus a safety margin
+func defaultTTL(n int, fanout int) uint8 {
+	if n <= 1 || fanout <= 1 {
+		return 1
+	}
+	ttl := int(math.Ceil(math.Log(float64(n))/math.Log(float64(fanout)))) + 2
+	if ttl > math.MaxUint8 {
+		ttl = math.MaxUint8
+	}
+	return uint8(ttl)
+}
@@ -0,0 +1,207 @@
+package nodeList
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+	logger "github.com/kerwenwwer/eGossip/pkg/logger"
+)
+
+// newTestNodeList initializes nodeList with a local node and n-1 remote nodes, without joining a cluster
+func newTestNodeList(t *testing.T, nodeList *NodeList, n int) *NodeList {
+	t.Helper()
+
+	nodeList.Logger = logger.NewNopLogger()
+	nodeList.New(common.Node{ID: "local", Addr: "127.0.0.1", Port: 8000})
+	for i := 1; i < n; i++ {
+		node := testNode(i)
+		nodeList.nodes.Store(node.ID, nodeEntry{node: node, update: time.Now().Unix()})
+	}
+	return nodeList
+}
+
+// testNode returns the i-th remote node of newTestNodeList
+func testNode(i int) common.Node {
+	return common.Node{ID: fmt.Sprintf("n%d", i), Addr: fmt.Sprintf("10.0.%d.%d", i/256, i%256), Port: 8000}
+}
+
+func TestDefaultTTL(t *testing.T) {
+	tests := []struct {
+		n, fanout int
+		want      uint8
+	}{
+		{0, 3, 1},
+		{1, 3, 1},
+		{10, 1, 1},
+		{8, 3, 4},    // ceil(log3(8)) = 2, plus 2
+		{10, 3, 5},   // ceil(log3(10)) = 3, plus 2
+		{500, 10, 5}, // ceil(log10(500)) = 3, plus 2
+		{1500, 2, 13},
+	}
+	for _, tt := range tests {
+		if got := defaultTTL(tt.n, tt.fanout); got != tt.want {
+			t.Errorf("defaultTTL(%d, %d) = %d, want %d", tt.n, tt.fanout, got, tt.want)
+		}
+	}
+}
+
+func TestForwardInfection(t *testing.T) {
+	tests := []struct {
+		name      string
+		infection string
+		ttl       uint8
+		redundant bool
+		want      bool
+		wantTTL   uint8
+	}{
+		{"ttl hop", InfectionTTL, 3, false, true, 2},
+		{"ttl last hop", InfectionTTL, 1, false, false, 1},
+		{"ttl expired", InfectionTTL, 0, false, false, 0},
+		{"ttl redundant", InfectionTTL, 3, true, false, 3},
+		{"map", InfectionMap, 0, false, true, 0},
+		{"map redundant", InfectionMap, 0, true, true, 0},
+		{"bloom", InfectionBloom, 0, false, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeList := &NodeList{Infection: tt.infection}
+			p := &common.Packet{TTL: tt.ttl}
+			if got := forwardInfection(nodeList, p, tt.redundant); got != tt.want {
+				t.Errorf("forward = %v, want %v", got, tt.want)
+			}
+			if p.TTL != tt.wantTTL {
+				t.Errorf("TTL = %d, want %d", p.TTL, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestInfection(t *testing.T) {
+	for _, infection := range []string{InfectionMap, InfectionBloom, InfectionTTL} {
+		t.Run(infection, func(t *testing.T) {
+			nodeList := newTestNodeList(t, &NodeList{Infection: infection}, 10)
+
+			p := &common.Packet{Node: nodeList.LocalNode}
+			initInfection(nodeList, p)
+			if p.Time == 0 {
+				t.Error("broadcast without origin timestamp")
+			}
+			if !isInfected(nodeList, p, nodeList.LocalNode) {
+				t.Error("local node not infected by its own broadcast")
+			}
+
+			other := testNode(1)
+			if isInfected(nodeList, p, other) {
+				t.Error("remote node infected before it is marked")
+			}
+			markInfected(nodeList, p, other)
+
+			switch infection {
+			case InfectionTTL:
+				// No infected node list, only the origin is known
+				if isInfected(nodeList, p, other) {
+					t.Error("remote node infected in TTL mode")
+				}
+				if want := defaultTTL(10, nodeList.fanout()); p.TTL != want {
+					t.Errorf("TTL = %d, want %d", p.TTL, want)
+				}
+			case InfectionBloom:
+				if !isInfected(nodeList, p, other) {
+					t.Error("marked node not infected")
+				}
+				if len(p.Bloom) != nodeList.BloomBits/8 || p.Infected != nil {
+					t.Errorf("bloom filter of %d bytes and infected map %v, want %d bytes and no map", len(p.Bloom), p.Infected, nodeList.BloomBits/8)
+				}
+			default:
+				if !isInfected(nodeList, p, other) {
+					t.Error("marked node not infected")
+				}
+				if len(p.Infected) != 2 || p.Bloom != nil {
+					t.Errorf("infected map %v and bloom filter %v, want 2 nodes and no filter", p.Infected, p.Bloom)
+				}
+			}
+		})
+	}
+}
+
+func TestKernelWindow(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	nodeList.kernel.nodes = testNodes(10)
+	skipped := map[string]bool{"n2": true, "n3": true, "n7": true}
+	skip := func(v common.Node) bool { return skipped[v.ID] }
+
+	// Runs of eligible nodes: n4-n6 (3), n8-n10,n1 (4, wrapping around)
+	tests := []struct {
+		n      int
+		want   int
+		starts []int
+	}{
+		{0, 0, nil},
+		{1, 1, []int{0, 3, 4, 5, 7, 8, 9}},
+		{3, 3, []int{3, 7, 8}},
+		{4, 4, []int{7}},
+		{8, 4, []int{7}},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			start, window := nodeList.kernelWindow(tt.n, skip)
+			if len(window) != tt.want || (tt.want > 0 && !slices.Contains(tt.starts, start)) {
+				t.Fatalf("kernelWindow(%d) = %d, %d nodes, want %d nodes at one of %v", tt.n, start, len(window), tt.want, tt.starts)
+			}
+			for j, v := range window {
+				if skip(v) || v.ID != testNode((start+j)%10+1).ID {
+					t.Fatalf("kernelWindow(%d) at %d: node %d is %s", tt.n, start, j, v.ID)
+				}
+			}
+		}
+	}
+
+	if _, window := nodeList.kernelWindow(3, func(common.Node) bool { return true }); window != nil {
+		t.Errorf("window = %v with every node skipped, want none", window)
+	}
+}
+
+func TestKernelBroadcastStops(t *testing.T) {
+	for _, infection := range []string{InfectionMap, InfectionBloom} {
+		t.Run(infection, func(t *testing.T) {
+			nodeList := newTestNodeList(t, &NodeList{Infection: infection, Amount: 3}, 1)
+			nodeList.kernel.nodes = testNodes(20)
+
+			p := &common.Packet{Node: nodeList.LocalNode}
+			initInfection(nodeList, p)
+			infected := func(v common.Node) bool { return isInfected(nodeList, p, v) }
+
+			// Every hop infects its window, nodes are never targeted twice and the broadcast ends
+			targeted := make(map[string]bool)
+			for hop := 0; ; hop++ {
+				if hop > 20 {
+					t.Fatal("broadcast still forwarded after 20 hops")
+				}
+				_, window := nodeList.kernelWindow(nodeList.fanout(), infected)
+				if len(window) == 0 {
+					break
+				}
+				for _, v := range window {
+					if targeted[v.ID] {
+						t.Fatalf("hop %d: %s targeted twice", hop, v.ID)
+					}
+					targeted[v.ID] = true
+					markInfected(nodeList, p, v)
+				}
+			}
+			// Bloom false positives may leave a node out, never more
+			if len(targeted) < 18 || (infection == InfectionMap && len(targeted) != 20) {
+				t.Errorf("%d nodes targeted, want all 20", len(targeted))
+			}
+
+			// kernelBroadcast sends nothing once every node is infected
+			kernelBroadcast(nodeList, *p)
+			if sent := nodeList.Stats().Sent; sent != 0 {
+				t.Errorf("sent = %d with every node infected, want 0", sent)
+			}
+		})
+	}
+}
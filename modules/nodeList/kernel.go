@@ -0,0 +1,254 @@
+package nodeList
+
+import (
+	"math/rand"
+	"net/netip"
+	"sync"
+
+	bpf "github.com/kerwenwwer/eGossip/pkg/bpf"
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+// kernelNodes mirrors the node list into the BPF maps: the remote nodes into nodelist_map, so that the TC program can pick broadcast targets from kernel state,
+// and the node addresses into the XDP allowlist
+type kernelNodes struct {
+	mu      sync.Mutex
+	slots   map[string]int // nodelist_map index of each node (key is Node ID)
+	nodes   []common.Node  // Node stored at each nodelist_map index
+	allowed map[string]int // Number of nodes using each allowed address
+}
+
+// mirrorNode stores a new or changed node in nodelist_map
+func (nodeList *NodeList) mirrorNode(node common.Node) {
+	if !nodeList.KernelNodes || nodeList.Program == nil || node.ID == nodeList.LocalNode.ID {
+		return
+	}
+
+	k := &nodeList.kernel
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.slots == nil {
+		k.slots = make(map[string]int)
+	}
+
+	idx, ok := k.slots[node.ID]
+	if !ok {
+		if len(k.nodes) >= bpf.MAX_NODES {
+			nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: node list full, node", node.ID, "is not mirrored")
+			return
+		}
+		idx = len(k.nodes)
+	}
+
+	if err := bpf.SetNodelistEntry(nodeList.Program, uint32(idx), node); err != nil {
+		nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: Failed to store node", node.ID, err)
+		return
+	}
+
+	if ok {
+		k.nodes[idx] = node
+		return
+	}
+
+	// Only count the new slot once it holds the node
+	k.slots[node.ID] = idx
+	k.nodes = append(k.nodes, node)
+	if err := bpf.SetNodelistLen(nodeList.Program, uint32(len(k.nodes))); err != nil {
+		nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: Failed to store node list length", err)
+	}
+}
+
+// unmirrorNode removes a node from nodelist_map, the last node is moved into its slot
+func (nodeList *NodeList) unmirrorNode(id string) {
+	if !nodeList.KernelNodes || nodeList.Program == nil {
+		return
+	}
+
+	k := &nodeList.kernel
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	idx, ok := k.slots[id]
+	if !ok {
+		return
+	}
+
+	last := len(k.nodes) - 1
+	if idx != last {
+		moved := k.nodes[last]
+		if err := bpf.SetNodelistEntry(nodeList.Program, uint32(idx), moved); err != nil {
+			nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: Failed to move node", moved.ID, err)
+		}
+		k.nodes[idx] = moved
+		k.slots[moved.ID] = idx
+	}
+
+	delete(k.slots, id)
+	k.nodes = k.nodes[:last]
+	if err := bpf.SetNodelistLen(nodeList.Program, uint32(len(k.nodes))); err != nil {
+		nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: Failed to store node list length", err)
+	}
+}
+
+// allowAddr adds the address of a node to the XDP allowlist
+func (nodeList *NodeList) allowAddr(addr string) {
+	if !nodeList.Allowlist || nodeList.Program == nil {
+		return
+	}
+
+	k := &nodeList.kernel
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.allowed == nil {
+		k.allowed = make(map[string]int)
+	}
+	k.allowed[addr]++
+	if k.allowed[addr] > 1 {
+		return
+	}
+
+	prefix, err := addrPrefix(addr)
+	if err == nil {
+		err = bpf.AllowPrefix(nodeList.Program, prefix)
+	}
+	if err != nil {
+		nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: Failed to allow address", addr, err)
+	}
+}
+
+// disallowAddr removes the address of a node from the XDP allowlist once no node uses it
+func (nodeList *NodeList) disallowAddr(addr string) {
+	if !nodeList.Allowlist || nodeList.Program == nil {
+		return
+	}
+
+	k := &nodeList.kernel
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.allowed[addr] == 0 {
+		return
+	}
+	k.allowed[addr]--
+	if k.allowed[addr] > 0 {
+		return
+	}
+	delete(k.allowed, addr)
+
+	prefix, err := addrPrefix(addr)
+	if err == nil {
+		err = bpf.DenyPrefix(nodeList.Program, prefix)
+	}
+	if err != nil {
+		nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: Failed to disallow address", addr, err)
+	}
+}
+
+// releaseAddrs removes the addresses of the node list from the XDP allowlist, other clusters may still allow them
+func (nodeList *NodeList) releaseAddrs() {
+	if !nodeList.Allowlist || nodeList.Program == nil {
+		return
+	}
+
+	k := &nodeList.kernel
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for addr := range k.allowed {
+		prefix, err := addrPrefix(addr)
+		if err == nil {
+			err = bpf.DenyPrefix(nodeList.Program, prefix)
+		}
+		if err != nil {
+			nodeList.Logger.Sugar().Warnln("[Kernel Nodes]: Failed to disallow address", addr, err)
+		}
+	}
+	k.allowed = nil
+}
+
+// addrPrefix converts a node address into a /32 prefix
+func addrPrefix(addr string) (netip.Prefix, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// kernelWindow picks a window of at most n nodes of nodelist_map without skipped nodes (e.g. already infected), and
+// returns the start index and the nodes. The TC program clones the packet to consecutive entries, so the window is a
+// run of consecutive eligible entries at a random start, shorter than n if no run is long enough
+func (nodeList *NodeList) kernelWindow(n int, skip func(common.Node) bool) (int, []common.Node) {
+	k := &nodeList.kernel
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	size := len(k.nodes)
+	if n > bpf.MAX_FANOUT {
+		n = bpf.MAX_FANOUT
+	}
+	if size == 0 || n <= 0 {
+		return 0, nil
+	}
+
+	// Length of the run of eligible entries starting at each index, wrapping around
+	runs := make([]int, size)
+	longest, run := 0, 0
+	for i := 2*size - 1; i >= 0; i-- {
+		if skip(k.nodes[i%size]) {
+			run = 0
+		} else if run < size {
+			run++
+		}
+		if i < size {
+			runs[i] = run
+			longest = max(longest, run)
+		}
+	}
+	if longest == 0 {
+		return 0, nil
+	}
+	n = min(n, longest)
+
+	var starts []int
+	for i, r := range runs {
+		if r >= n {
+			starts = append(starts, i)
+		}
+	}
+	start := starts[rand.Intn(len(starts))]
+	window := make([]common.Node, n)
+	for i := range window {
+		window[i] = k.nodes[(start+i)%size]
+	}
+	return start, window
+}
+
+// kernelBroadcast broadcasts a packet through the TC program, the targets are a window of uninfected nodes of the kernel
+// node list so no targets_map entry is pushed. Nothing is sent once every node is infected
+func kernelBroadcast(nodeList *NodeList, p common.Packet) {
+	start, targetNodes := nodeList.kernelWindow(nodeList.fanout(), func(v common.Node) bool {
+		return isInfected(nodeList, &p, v)
+	})
+	if len(targetNodes) == 0 {
+		return
+	}
+	for _, v := range targetNodes {
+		markInfected(nodeList, &p, v)
+	}
+
+	p.Type = 1
+	p.Flags |= common.FlagNodeList
+	p.Mapkey = uint16(start)
+	p.Count = uint16(len(targetNodes))
+
+	bs, err := common.EncodePacket(p)
+	if err != nil {
+		nodeList.Logger.Sugar().Panicln("[Infection Error]:", err)
+	}
+
+	write(nodeList, targetNodes[0].Addr, targetNodes[0].Port, bs)
+	nodeList.countSent(len(targetNodes), len(bs))
+}
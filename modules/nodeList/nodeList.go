@@ -1,6 +1,8 @@
 package nodeList
 
 import (
+	"fmt"
+	"net"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -11,11 +13,12 @@ import (
 	bpf "github.com/kerwenwwer/eGossip/pkg/bpf"
 	common "github.com/kerwenwwer/eGossip/pkg/common"
 	logger "github.com/kerwenwwer/eGossip/pkg/logger"
+	transport "github.com/kerwenwwer/eGossip/pkg/transport"
 )
 
 // NodeList is a list of nodes
 type NodeList struct {
-	nodes   sync.Map // Collection of nodes (key is Node structure, value is the most recent second-level timestamp of node update)
+	nodes   sync.Map // Collection of nodes (key is Node ID, value is nodeEntry with the node attributes and the most recent second-level timestamp of node update)
 	Amount  int      // Number of nodes to send synchronization information to at one time
 	Cycle   int64    // Synchronization cycle (how many seconds to send list synchronization information to other nodes)
 	Buffer  int      // UDP/TCP receive buffer size (determines how many requests the UDP/TCP listening service can process asynchronously)
@@ -31,18 +34,61 @@ type NodeList struct {
 
 	status atomic.Value // Status of local node list update (true: running normally, false: stop publishing heartbeat)
 
+	done      chan struct{} // Closed by Close, stops the listener and the consumer
+	listening chan struct{} // Closed once the listener no longer holds the port
+	closeOnce sync.Once
+
 	IsPrint bool // Whether to print list synchronization information to the console
 
+	Piggyback      bool           // Whether to piggyback membership/metadata updates on heartbeat and swap packets instead of broadcasting each change
+	RetransmitMult int            // Retransmit multiplier λ, each piggybacked update is transmitted λ·log(n) times
+	queue          broadcastQueue // Dissemination queue of piggybacked updates
+
+	Infection string // Infection tracking mode of broadcast packets: map (default), bloom or ttl
+	BloomBits int    // Size of the bloom filter in bloom infection mode (in bits)
+
+	Adaptive      bool         // Whether to compute fanout, cycle and timeout from the cluster size and observed RTT (Amount and Cycle become the upper bound and the base value)
+	FanoutConst   int          // Constant c of the adaptive fanout ceil(ln(n))+c
+	SuspicionMult float64      // Multiplier of the adaptive timeout SuspicionMult·log10(n)·cycle
+	rtt           atomic.Int64 // Smoothed round trip time of swap requests (in nanoseconds)
+	clusterSize   clusterSize  // Largest node list size announced by the cluster
+
+	Selector Selector // Target selection of broadcast and swap requests (default: random)
+
+	KernelNodes bool        // Whether to mirror the node list into nodelist_map and let the TC program pick broadcast targets from it (XDP protocol)
+	Allowlist   bool        // Whether to add the node addresses to the XDP allowlist (the BPF objects must be loaded with the allowlist option)
+	kernel      kernelNodes // Kernel node list mirror
+
+	seen  sync.Map    // Latest broadcast received from each origin (key is Node ID, value is the origin timestamp)
+	stats gossipStats // Broadcast statistics
+
 	metadata atomic.Value // Metadata, the metadata content of each node in the cluster is consistent, equivalent to the public data of the cluster (can store some common configuration information), can update the metadata content of each node through broadcasting
 
-	Program *bpf.BpfObjects       // bpf program
-	Xsk     *xdp.Socket           // xdp socket
-	Counter *common.AtomicCounter // bpf program key counter
+	privateData sync.Map // Private metadata of each node (key is Node ID, value is common.NodeMetadata), propagated through heartbeats
+
+	memberChanges   changes // Wakes up the membership watchers
+	metadataChanges changes // Wakes up the metadata watchers
+
+	conflicts sync.Map // Node ID conflicts (key is Node ID, value is the "Addr:Port" of the rejected node claiming the same ID)
+	addrs     sync.Map // Node ID holding each address (key is "Addr:Port"), finds the entry left by a node restarted under a new ID
+
+	Program   *bpf.BpfObjects       // bpf program
+	Xsk       *xdp.Socket           // xdp socket
+	XdpQueues *transport.XdpQueues  // Message queues of the clusters sharing the xdp socket, by port
+	XskConfig transport.XskConfig   // UMEM and ring sizes of the xdp socket
+	Counter   *common.AtomicCounter // bpf program key counter
 
 	GatewayMAC string // gateway mac address
 	Logger     *logger.Logger
 }
 
+// nodeEntry is the value of the node collection
+type nodeEntry struct {
+	node      common.Node // Node attributes (address, port, MAC, ...), updated by the latest heartbeat
+	update    int64       // Most recent second-level timestamp of node update
+	heartbeat int64       // Origin timestamp (in nanoseconds) of the latest heartbeat of the node, 0 if only added manually or by an update
+}
+
 const errMsgControlErrorPrefix = "[Control Error]:"
 
 // New initializes the local node list
@@ -53,6 +99,14 @@ func (nodeList *NodeList) New(localNode common.Node) {
 		localNode.Addr = "0.0.0.0"
 	}
 
+	// ID default value: node name, or a generated UUID if the name is empty
+	if localNode.ID == "" {
+		localNode.ID = localNode.Name
+	}
+	if localNode.ID == "" {
+		localNode.ID = common.NewNodeID()
+	}
+
 	// ListenAddr default value: 0.0.0.0
 	if nodeList.ListenAddr == "" {
 		nodeList.ListenAddr = localNode.Addr
@@ -78,6 +132,36 @@ func (nodeList *NodeList) New(localNode common.Node) {
 		nodeList.Size = 16384
 	}
 
+	// Selector default value: uniformly random selection
+	if nodeList.Selector == nil {
+		nodeList.Selector = &RandomSelector{}
+	}
+
+	// Infection default value: map
+	if nodeList.Infection == "" {
+		nodeList.Infection = InfectionMap
+	}
+
+	// BloomBits default value: 1024
+	if nodeList.BloomBits == 0 {
+		nodeList.BloomBits = 1024
+	}
+
+	// RetransmitMult default value: 4
+	if nodeList.RetransmitMult == 0 {
+		nodeList.RetransmitMult = 4
+	}
+
+	// FanoutConst default value: 2
+	if nodeList.FanoutConst == 0 {
+		nodeList.FanoutConst = 2
+	}
+
+	// SuspicionMult default value: 5
+	if nodeList.SuspicionMult == 0 {
+		nodeList.SuspicionMult = 5
+	}
+
 	// Timeout default value: if the current Timeout is less than or equal to Cycle, then automatically enlarge the value of Timeout
 	if nodeList.Timeout <= nodeList.Cycle {
 		nodeList.Timeout = nodeList.Cycle*5 + 2
@@ -89,29 +173,65 @@ func (nodeList *NodeList) New(localNode common.Node) {
 	}
 
 	// Initialize the basic data of the local node list
-	nodeList.nodes.Store(localNode, time.Now().Unix()) // Add local node information into the node collection
-	nodeList.LocalNode = localNode                     // Initialize local node information
-	nodeList.status.Store(true)                        // Initialize node service status
+	// Add local node information into the node collection
+	nodeList.nodes.Store(localNode.ID, nodeEntry{node: localNode, update: time.Now().Unix()})
+	nodeList.addrs.Store(nodeKey(localNode), localNode.ID)
+	nodeList.LocalNode = localNode // Initialize local node information
+	nodeList.status.Store(true)    // Initialize node service status
 
 	// Set metadata information
 	md := common.Metadata{
 		Data:   []byte(""), // Metadata content
 		Update: 0,          // Metadata update timestamp
 	}
-	nodeList.metadata.Store(md) // Initialize metadata information
+	nodeList.storeMetadata(md) // Initialize metadata information
+
+	// Initialize local private metadata information
+	nodeList.privateData.Store(localNode.ID, common.NodeMetadata{})
 
-	// Store atomic counter for bpf map key
-	nodeList.Counter = common.NewAtomicCounter()
+	// Counter default value: bpf map keys 100 to 999
+	if nodeList.Counter == nil {
+		nodeList.Counter = common.NewAtomicCounter()
+	}
+
+	// XdpQueues default value: the xdp socket is only used by this node list
+	if nodeList.XdpQueues == nil {
+		nodeList.XdpQueues = transport.NewXdpQueues()
+	}
+
+	nodeList.done = make(chan struct{})
 }
 
-// Join joins the cluster
-func (nodeList *NodeList) Join() {
+// Join joins the cluster, it fails when the gossip port can't be bound
+func (nodeList *NodeList) Join() error {
 
 	// If the local node list of this node has not been initialized
 	if len(nodeList.LocalNode.Addr) == 0 {
 		nodeList.Logger.Sugar().Panicln(errMsgControlErrorPrefix, "New() a nodeList before Join().")
 		// Directly return
-		return
+		return nil
+	}
+
+	// The port is bound before anything starts, a port in use is reported to the caller
+	var conn *net.UDPConn
+	if nodeList.Protocol == "UDP" || nodeList.Protocol == "TC" {
+		var err error
+		if conn, err = transport.UdpBind(nodeList.ListenAddr, nodeList.LocalNode.Port); err != nil {
+			return fmt.Errorf("can't listen on port %d: %w", nodeList.LocalNode.Port, err)
+		}
+	}
+
+	// Entries left in the key range by a previous daemon (pinned maps) are never reclaimed otherwise
+	if nodeList.Protocol == "XDP" && nodeList.Program != nil {
+		first, last := nodeList.Counter.Range()
+		if err := bpf.TcClearMap(nodeList.Program, first, last); err != nil {
+			nodeList.Logger.Sugar().Warnln(errMsgControlErrorPrefix, "Can't clear the targets map keys:", err)
+		}
+	}
+
+	// Announce the local node through the dissemination queue
+	if nodeList.Piggyback {
+		nodeList.enqueueNode(nodeList.LocalNode)
 	}
 
 	// Periodically broadcast local node information
@@ -121,12 +241,14 @@ func (nodeList *NodeList) Join() {
 	var mq = make(chan []byte, nodeList.Buffer)
 
 	// Listen for information from other nodes and put it into the mq queue
-	go listener(nodeList, mq)
+	nodeList.listening = make(chan struct{})
+	go listener(nodeList, conn, mq)
 
 	// Consume the information in the mq queue
 	go consume(nodeList, mq)
 
 	nodeList.Logger.Sugar().Infoln("[Control]: Join signal for ", nodeList.LocalNode)
+	return nil
 }
 
 // Stop stops the broadcasting of heartbeat
@@ -158,14 +280,56 @@ func (nodeList *NodeList) Start() {
 		// Return directly
 		return
 	}
+	// A closed node list cannot be restarted
+	select {
+	case <-nodeList.done:
+		return
+	default:
+	}
+
 	nodeList.Logger.Sugar().Infoln("[Control]: Start signal for ", nodeList.LocalNode)
 	nodeList.status.Store(true)
 	// Periodically broadcast local node information
 	go task(nodeList)
 }
 
+// Close stops the local node list for good and releases its port, e.g. when its cluster is removed from the daemon
+func (nodeList *NodeList) Close() {
+
+	// If the local node list of this node has not been initialized
+	if len(nodeList.LocalNode.Addr) == 0 {
+		nodeList.Logger.Sugar().Panicln(errMsgControlErrorPrefix, "New() a nodeList before Close().")
+		// Return directly
+		return
+	}
+
+	nodeList.closeOnce.Do(func() {
+		nodeList.Logger.Sugar().Infoln("[Control]: Close signal for ", nodeList.LocalNode)
+		nodeList.status.Store(false)
+		close(nodeList.done)
+
+		port := uint16(nodeList.LocalNode.Port)
+		nodeList.XdpQueues.Unregister(port)
+		if nodeList.listening != nil {
+			// The port can be reused once Close returns
+			<-nodeList.listening
+		}
+		nodeList.releaseAddrs()
+		if nodeList.Program != nil {
+			if err := bpf.DeleteMetadataVersion(nodeList.Program, port); err != nil {
+				nodeList.Logger.Sugar().Warnln("[Metadata]: Failed to remove the kernel metadata cache:", err)
+			}
+		}
+	})
+}
+
 // Set adds other nodes to the local node list
 func (nodeList *NodeList) Set(node common.Node) {
+	nodeList.setNode(node, 0)
+}
+
+// setNode adds or refreshes a node, heartbeat is the origin timestamp of the heartbeat it comes from (0 for other sources)
+func (nodeList *NodeList) setNode(node common.Node, heartbeat int64) {
 
 	// If the local node list of this node has not been initialized
 	if len(nodeList.LocalNode.Addr) == 0 {
@@ -184,8 +348,119 @@ func (nodeList *NodeList) Set(node common.Node) {
 		node.Addr = "0.0.0.0"
 	}
 
+	// Nodes without ID (e.g. added manually) are identified by their address
+	if node.ID == "" {
+		node.ID = nodeKey(node)
+	} else {
+		// Replace the entry added manually for this address
+		if v, ok := nodeList.nodes.LoadAndDelete(nodeKey(node)); ok {
+			nodeList.unmirrorNode(nodeKey(node))
+			nodeList.disallowAddr(v.(nodeEntry).node.Addr)
+			nodeList.memberChanges.notify()
+		}
+	}
+
+	now := time.Now().Unix()
+
+	v, ok := nodeList.nodes.Load(node.ID)
+
+	// If another node with a different address already holds this ID, reject the update
+	if ok {
+		old := v.(nodeEntry).node
+		if nodeKey(old) != nodeKey(node) && nodeList.isConflict(node, v.(nodeEntry)) {
+			if _, loaded := nodeList.conflicts.LoadOrStore(node.ID, nodeKey(node)); !loaded {
+				nodeList.Logger.Sugar().Warnln("[Conflict]: node ID", node.ID, "claimed by", nodeKey(node), "is already used by", nodeKey(old))
+			}
+			return
+		}
+	}
+
+	// Another ID holds this address: the node restarted under a new ID, or this is its old ID
+	if holder, held := nodeList.addrs.Load(nodeKey(node)); held && holder.(string) != node.ID {
+		if !nodeList.replaceHolder(holder.(string), node, heartbeat) {
+			return
+		}
+	}
+
 	// Store node information
-	nodeList.nodes.Store(node, time.Now().Unix())
+	entry := nodeEntry{node: node, update: now, heartbeat: heartbeat}
+	if ok {
+		entry.heartbeat = max(heartbeat, v.(nodeEntry).heartbeat)
+	}
+	nodeList.nodes.Store(node.ID, entry)
+	nodeList.addrs.Store(nodeKey(node), node.ID)
+	nodeList.conflicts.CompareAndDelete(node.ID, nodeKey(node)) // The claim was accepted (address moved)
+	if !ok || v.(nodeEntry).node != node {
+		nodeList.mirrorNode(node)
+		nodeList.memberChanges.notify()
+	}
+	if !ok {
+		nodeList.allowAddr(node.Addr)
+	} else if old := v.(nodeEntry).node; old.Addr != node.Addr {
+		nodeList.allowAddr(node.Addr)
+		nodeList.disallowAddr(old.Addr)
+	}
+	if ok && nodeKey(v.(nodeEntry).node) != nodeKey(node) {
+		nodeList.addrs.CompareAndDelete(nodeKey(v.(nodeEntry).node), node.ID)
+	}
+
+	// Disseminate the new (or moved) node
+	if nodeList.Piggyback && node.ID != nodeList.LocalNode.ID && (!ok || nodeKey(v.(nodeEntry).node) != nodeKey(node)) {
+		nodeList.enqueueNode(node)
+	}
+}
+
+// replaceHolder decides between node and the node holding its address under another ID (id). A newer heartbeat from the
+// address means the node restarted under a new ID, the old entry is removed instead of lingering until it expires. The
+// update is rejected (false) if it is the old ID: an older heartbeat still in flight, or an update of a node that still
+// knows the old ID, while the address sends newer heartbeats. The local address always keeps the local ID
+func (nodeList *NodeList) replaceHolder(id string, node common.Node, heartbeat int64) bool {
+	v, ok := nodeList.nodes.Load(id)
+	if !ok || nodeKey(v.(nodeEntry).node) != nodeKey(node) {
+		return true // The holder is gone or moved
+	}
+	if id == nodeList.LocalNode.ID {
+		return false
+	}
+
+	holder := v.(nodeEntry)
+	switch {
+	case heartbeat == 0:
+		// Without heartbeat, only an entry not confirmed by heartbeats either is kept beside it
+		return holder.heartbeat == 0
+	case holder.heartbeat > heartbeat:
+		return false
+	}
+	nodeList.forget(id, holder)
+	nodeList.Logger.Sugar().Infoln("[Control]: node", nodeKey(node), "restarted, ID", id, "replaced by", node.ID)
+	return true
+}
+
+// isConflict reports whether a node with a different address claiming the ID of entry is a conflict instead of an address change.
+// The local node ID is never given away; for remote nodes, the address is only considered moved if the old address has not sent a heartbeat within the last two cycles.
+func (nodeList *NodeList) isConflict(node common.Node, entry nodeEntry) bool {
+	if node.ID == nodeList.LocalNode.ID {
+		return true
+	}
+	return entry.update+2*nodeList.cycle() >= time.Now().Unix()
+}
+
+// Conflicts retrieves the node ID conflicts detected by the local node list (key is Node ID, value is the "Addr:Port" of the rejected node)
+func (nodeList *NodeList) Conflicts() map[string]string {
+
+	// If the local node list of this node has not been initialized
+	if len(nodeList.LocalNode.Addr) == 0 {
+		nodeList.Logger.Sugar().Panicln(errMsgControlErrorPrefix, "New() a nodeList before Conflicts().")
+		// Directly return
+		return nil
+	}
+
+	conflicts := make(map[string]string)
+	nodeList.conflicts.Range(func(k, v interface{}) bool {
+		conflicts[k.(string)] = v.(string)
+		return true
+	})
+	return conflicts
 }
 
 // Get retrieves the local node list
@@ -199,20 +474,81 @@ func (nodeList *NodeList) Get() []common.Node {
 	}
 
 	var nodes []common.Node
+	timeout := nodeList.timeout()
 	// Traverse all key-value pairs in sync.Map
 	nodeList.nodes.Range(func(k, v interface{}) bool {
 		//If this node has not been updated for a while, delete it
-		if v.(int64)+nodeList.Timeout < time.Now().Unix() {
-			nodeList.nodes.Delete(k)
-			nodeList.Logger.Sugar().Warnln("[[Timeout]:", k, "has been deleted]")
+		if v.(nodeEntry).update+timeout < time.Now().Unix() {
+			nodeList.forget(k.(string), v.(nodeEntry))
+			nodeList.Logger.Sugar().Warnln("[[Timeout]:", v.(nodeEntry).node, "has been deleted]")
 		} else {
-			nodes = append(nodes, k.(common.Node))
+			nodes = append(nodes, v.(nodeEntry).node)
 		}
 		return true
 	})
 	return nodes
 }
 
+// Member retrieves a node of the local node list by ID
+func (nodeList *NodeList) Member(id string) (common.Node, bool) {
+	v, ok := nodeList.nodes.Load(id)
+	if !ok {
+		return common.Node{}, false
+	}
+	return v.(nodeEntry).node, true
+}
+
+// Remove deletes a remote node from the local node list, it is added again by its next heartbeat if it is still alive
+func (nodeList *NodeList) Remove(id string) bool {
+
+	// If the local node list of this node has not been initialized
+	if len(nodeList.LocalNode.Addr) == 0 {
+		nodeList.Logger.Sugar().Panicln(errMsgControlErrorPrefix, "New() a nodeList before Remove().")
+		// Return directly
+		return false
+	}
+
+	if id == nodeList.LocalNode.ID {
+		return false
+	}
+	v, ok := nodeList.nodes.Load(id)
+	if !ok {
+		return false
+	}
+	nodeList.forget(id, v.(nodeEntry))
+	nodeList.Logger.Sugar().Infoln("[Control]: Remove signal for ", v.(nodeEntry).node)
+	return true
+}
+
+// forget deletes a node and everything known about it
+func (nodeList *NodeList) forget(id string, entry nodeEntry) {
+	nodeList.nodes.Delete(id)
+	nodeList.privateData.Delete(id)
+	nodeList.conflicts.Delete(id)
+	nodeList.addrs.CompareAndDelete(nodeKey(entry.node), id)
+	nodeList.seen.Delete(id)
+	nodeList.seen.Delete(id + ":update")
+	nodeList.unmirrorNode(id)
+	nodeList.disallowAddr(entry.node.Addr)
+	nodeList.memberChanges.notify()
+}
+
+// Running reports whether the local node sends heartbeats
+func (nodeList *NodeList) Running() bool {
+	running, _ := nodeList.status.Load().(bool)
+	return running
+}
+
+// Closed reports whether the local node left the cluster for good (Close)
+func (nodeList *NodeList) Closed() bool {
+	select {
+	case <-nodeList.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // Publish publishes new metadata information in the cluster
 func (nodeList *NodeList) Publish(newMetadata []byte) {
 
@@ -224,10 +560,6 @@ func (nodeList *NodeList) Publish(newMetadata []byte) {
 
 	nodeList.Logger.Sugar().Infoln("[Control]: Metadata Publish in", nodeList.LocalNode, "/ [Metadata]:", newMetadata)
 
-	// Add the local node to the infected node list
-	var infected = make(map[string]bool)
-	infected[nodeList.LocalNode.Addr+":"+strconv.Itoa(nodeList.LocalNode.Port)] = true
-
 	// Update local node info
 	nodeList.Set(nodeList.LocalNode)
 
@@ -239,12 +571,17 @@ func (nodeList *NodeList) Publish(newMetadata []byte) {
 	}
 
 	// // Update local node metadata info
-	nodeList.metadata.Store(md)
+	nodeList.storeMetadata(md)
+
+	// Piggyback the new metadata on the following heartbeats instead of broadcasting it
+	if nodeList.Piggyback {
+		nodeList.queue.enqueue("metadata", common.Update{Type: common.UpdateMetadata, Metadata: md})
+		return
+	}
 
 	// // Set packet
 	p := common.Packet{
-		Node:     nodeList.LocalNode,
-		Infected: infected,
+		Node: nodeList.LocalNode,
 
 		// Set the packet as metadata update packet
 		Metadata: md,
@@ -253,6 +590,9 @@ func (nodeList *NodeList) Publish(newMetadata []byte) {
 		SecretKey: nodeList.SecretKey,
 	}
 
+	// Add the local node to the infected nodes
+	initInfection(nodeList, &p)
+
 	// Broadcast packet in the cluster
 	broadcast(nodeList, p)
 
@@ -270,3 +610,107 @@ func (nodeList *NodeList) Read() []byte {
 
 	return nodeList.metadata.Load().(common.Metadata).Data
 }
+
+// storeMetadata stores the local metadata, and its version in the kernel metadata cache of the XDP program
+func (nodeList *NodeList) storeMetadata(md common.Metadata) {
+	nodeList.metadata.Store(md)
+	nodeList.metadataChanges.notify()
+
+	if nodeList.Program != nil {
+		if err := bpf.SetMetadataVersion(nodeList.Program, uint16(nodeList.LocalNode.Port), md.Update); err != nil {
+			nodeList.Logger.Sugar().Warnln("[Metadata]: Failed to update the kernel metadata cache:", err)
+		}
+	}
+}
+
+// SetPrivate updates the private metadata of the local node, the new version is propagated through heartbeats
+func (nodeList *NodeList) SetPrivate(labels map[string]string, data []byte) {
+
+	// If the local node list of this node has not been initialized
+	if len(nodeList.LocalNode.Addr) == 0 {
+		nodeList.Logger.Sugar().Panicln(errMsgControlErrorPrefix, "New() a nodeList before SetPrivate().")
+		// Return directly
+		return
+	}
+
+	md := common.NodeMetadata{
+		Labels: labels,
+		Data:   data,
+		Update: time.Now().UnixNano(), // Private metadata version
+	}
+	nodeList.privateData.Store(nodeList.LocalNode.ID, md)
+	if nodeList.Piggyback {
+		nodeList.enqueueNode(nodeList.LocalNode)
+	}
+
+	nodeList.Logger.Sugar().Infoln("[Control]: Private metadata update in", nodeList.LocalNode, "/ [Labels]:", labels)
+}
+
+// ReadPrivate retrieves the private metadata of all nodes in the local node list (key is Node ID)
+func (nodeList *NodeList) ReadPrivate() map[string]common.NodeMetadata {
+
+	// If the local node list of this node has not been initialized
+	if len(nodeList.LocalNode.Addr) == 0 {
+		nodeList.Logger.Sugar().Panicln(errMsgControlErrorPrefix, "New() a nodeList before ReadPrivate().")
+		// Directly return
+		return nil
+	}
+
+	private := make(map[string]common.NodeMetadata)
+	nodeList.privateData.Range(func(k, v interface{}) bool {
+		private[k.(string)] = v.(common.NodeMetadata)
+		return true
+	})
+	return private
+}
+
+// localPrivate returns the private metadata of the local node
+func (nodeList *NodeList) localPrivate() common.NodeMetadata {
+	md, ok := nodeList.privateData.Load(nodeList.LocalNode.ID)
+	if !ok {
+		return common.NodeMetadata{}
+	}
+	return md.(common.NodeMetadata)
+}
+
+// setPrivate stores the private metadata of a remote node if its version is newer than the local copy
+func (nodeList *NodeList) setPrivate(node common.Node, md common.NodeMetadata) {
+	if node.ID == "" || node.ID == nodeList.LocalNode.ID {
+		return
+	}
+	// Ignore the private metadata of a node rejected because of an ID conflict
+	if v, ok := nodeList.nodes.Load(node.ID); !ok || nodeKey(v.(nodeEntry).node) != nodeKey(node) {
+		return
+	}
+	if old, ok := nodeList.privateData.Load(node.ID); ok && old.(common.NodeMetadata).Update >= md.Update {
+		return
+	}
+	nodeList.privateData.Store(node.ID, md)
+	if nodeList.Piggyback {
+		nodeList.enqueueNode(node)
+	}
+}
+
+// enqueueNode adds a node update (node attributes and private metadata) to the dissemination queue
+func (nodeList *NodeList) enqueueNode(node common.Node) {
+	var private common.NodeMetadata
+	if md, ok := nodeList.privateData.Load(node.ID); ok {
+		private = md.(common.NodeMetadata)
+	}
+	nodeList.queue.enqueue("node:"+node.ID, common.Update{Type: common.UpdateNode, Node: node, Private: private})
+}
+
+// piggyback returns the queued updates to attach to an outgoing packet
+func (nodeList *NodeList) piggyback() []common.Update {
+	if !nodeList.Piggyback {
+		return nil
+	}
+
+	// Bound the piggybacked updates to a quarter of the packet capacity
+	return nodeList.queue.get(nodeList.Size/4, retransmitLimit(nodeList.RetransmitMult, nodeList.size()))
+}
+
+// nodeKey returns the "Addr:Port" string of a node
+func nodeKey(node common.Node) string {
+	return node.Addr + ":" + strconv.Itoa(node.Port)
+}
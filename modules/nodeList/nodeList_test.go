@@ -0,0 +1,167 @@
+package nodeList
+
+import (
+	"testing"
+	"time"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+func TestSetID(t *testing.T) {
+	tests := []struct {
+		name   string
+		node   common.Node
+		wantID string
+	}{
+		{"configured ID", common.Node{ID: "n1", Addr: "127.0.0.2", Port: 8000}, "n1"},
+		{"no ID", common.Node{Addr: "127.0.0.2", Port: 8000}, "127.0.0.2:8000"},
+		{"no address", common.Node{Port: 8000}, "0.0.0.0:8000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeList := newTestNodeList(t, &NodeList{}, 1)
+			nodeList.Set(tt.node)
+			if _, ok := nodeList.Member(tt.wantID); !ok || len(nodeList.Get()) != 2 {
+				t.Errorf("members = %+v, want the local node and %s", nodeList.Get(), tt.wantID)
+			}
+		})
+	}
+
+	t.Run("attributes change", func(t *testing.T) {
+		nodeList := newTestNodeList(t, &NodeList{}, 1)
+		nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.2", Port: 8000, Name: "a"})
+		nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.2", Port: 8000, Name: "b"})
+		if got, _ := nodeList.Member("n1"); got.Name != "b" || len(nodeList.Get()) != 2 {
+			t.Errorf("members = %+v, want n1 updated in place", nodeList.Get())
+		}
+	})
+
+	t.Run("manual entry replaced", func(t *testing.T) {
+		nodeList := newTestNodeList(t, &NodeList{}, 1)
+		nodeList.Set(common.Node{Addr: "127.0.0.2", Port: 8000})
+		nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.2", Port: 8000})
+		if _, ok := nodeList.Member("127.0.0.2:8000"); ok || len(nodeList.Get()) != 2 {
+			t.Errorf("members = %+v, want the manual entry replaced by n1", nodeList.Get())
+		}
+	})
+}
+
+func TestSetConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		age      int64 // Seconds since the holder of the ID was last updated
+		accepted bool
+	}{
+		{"live holder", "n1", 0, false},
+		{"holder within two cycles", "n1", 2*6 - 1, false},
+		{"stale holder, address moved", "n1", 2*6 + 1, true},
+		{"local ID", "local", 0, false},
+		{"local ID, stale", "local", 2*6 + 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeList := newTestNodeList(t, &NodeList{}, 1)
+			if tt.id != "local" {
+				nodeList.Set(common.Node{ID: tt.id, Addr: "127.0.0.2", Port: 8000})
+			}
+			v, _ := nodeList.nodes.Load(tt.id)
+			holder := v.(nodeEntry)
+			holder.update -= tt.age
+			nodeList.nodes.Store(tt.id, holder)
+
+			nodeList.Set(common.Node{ID: tt.id, Addr: "127.0.0.3", Port: 8000})
+			got, _ := nodeList.Member(tt.id)
+			if accepted := got.Addr == "127.0.0.3"; accepted != tt.accepted {
+				t.Errorf("%s at %s, accepted %v, want %v", tt.id, got.Addr, accepted, tt.accepted)
+			}
+			conflicts := nodeList.Conflicts()
+			if tt.accepted && len(conflicts) != 0 {
+				t.Errorf("conflicts = %v, want none", conflicts)
+			}
+			if !tt.accepted && conflicts[tt.id] != "127.0.0.3:8000" {
+				t.Errorf("conflicts = %v, want %s claimed by 127.0.0.3:8000", conflicts, tt.id)
+			}
+		})
+	}
+}
+
+func TestConflictExpiry(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.2", Port: 8000})
+	nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.3", Port: 8000})
+	if len(nodeList.Conflicts()) != 1 {
+		t.Fatalf("conflicts = %v, want n1", nodeList.Conflicts())
+	}
+
+	// The conflict is forgotten with the node holding the ID, once it expires
+	v, _ := nodeList.nodes.Load("n1")
+	holder := v.(nodeEntry)
+	holder.update -= nodeList.timeout() + 1
+	nodeList.nodes.Store("n1", holder)
+	if nodes := nodeList.Get(); len(nodes) != 1 {
+		t.Errorf("members = %+v, want n1 expired", nodes)
+	}
+	if conflicts := nodeList.Conflicts(); len(conflicts) != 0 {
+		t.Errorf("conflicts = %v after n1 expired, want none", conflicts)
+	}
+
+	// The claimant takes the ID with its next heartbeat
+	nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.3", Port: 8000})
+	if got, _ := nodeList.Member("n1"); got.Addr != "127.0.0.3" {
+		t.Errorf("n1 at %s, want 127.0.0.3", got.Addr)
+	}
+}
+
+func TestSetRestart(t *testing.T) {
+	now := time.Now().UnixNano()
+	oldID := common.Node{ID: "old", Addr: "127.0.0.2", Port: 8000}
+	newID := common.Node{ID: "new", Addr: "127.0.0.2", Port: 8000}
+
+	tests := []struct {
+		name       string
+		set        func(nodeList *NodeList)
+		wantIDs    []string
+		wantAbsent []string
+	}{
+		{"newer heartbeat replaces the old ID", func(nodeList *NodeList) {
+			nodeList.setNode(oldID, now-int64(time.Minute))
+			nodeList.setNode(newID, now)
+		}, []string{"new"}, []string{"old"}},
+		{"older heartbeat of the old ID", func(nodeList *NodeList) {
+			nodeList.setNode(newID, now)
+			nodeList.setNode(oldID, now-int64(time.Minute))
+		}, []string{"new"}, []string{"old"}},
+		{"update with the old ID", func(nodeList *NodeList) {
+			nodeList.setNode(newID, now)
+			nodeList.Set(oldID)
+		}, []string{"new"}, []string{"old"}},
+		{"heartbeat replaces an update", func(nodeList *NodeList) {
+			nodeList.Set(oldID)
+			nodeList.setNode(newID, now)
+		}, []string{"new"}, []string{"old"}},
+		{"local address", func(nodeList *NodeList) {
+			nodeList.setNode(common.Node{ID: "other", Addr: "127.0.0.1", Port: 8000}, now)
+		}, []string{"local"}, []string{"other"}},
+		{"other addresses", func(nodeList *NodeList) {
+			nodeList.setNode(oldID, now-int64(time.Minute))
+			nodeList.setNode(common.Node{ID: "new", Addr: "127.0.0.2", Port: 8001}, now)
+		}, []string{"old", "new"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeList := newTestNodeList(t, &NodeList{}, 1)
+			tt.set(nodeList)
+			for _, id := range tt.wantIDs {
+				if _, ok := nodeList.Member(id); !ok {
+					t.Errorf("%s missing, members = %+v", id, nodeList.Get())
+				}
+			}
+			for _, id := range tt.wantAbsent {
+				if _, ok := nodeList.Member(id); ok {
+					t.Errorf("%s still in the node list, members = %+v", id, nodeList.Get())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package nodeList
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+// queuedUpdate is an update waiting in the dissemination queue
+type queuedUpdate struct {
+	key       string        // Updates with the same key supersede each other (e.g. "node:<ID>", "metadata")
+	update    common.Update // Update content
+	size      int           // Encoded size of the update (in bytes)
+	transmits int           // Number of times the update has been piggybacked
+	seq       int64         // Enqueue order, newer updates are sent first among equal transmits
+}
+
+// broadcastQueue is a dissemination queue, updates are piggybacked on outgoing packets and
+// retransmitted a bounded number of times, prioritized by the fewest transmissions
+type broadcastQueue struct {
+	mu    sync.Mutex
+	items []*queuedUpdate
+	seq   int64
+}
+
+// enqueue adds an update to the queue, replacing a queued update with the same key
+func (q *broadcastQueue) enqueue(key string, u common.Update) {
+	bs, err := json.Marshal(u)
+	if err != nil {
+		return
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.seq++
+	item := &queuedUpdate{key: key, update: u, size: len(bs), seq: q.seq}
+	for i, v := range q.items {
+		if v.key == key {
+			q.items[i] = item
+			return
+		}
+	}
+	q.items = append(q.items, item)
+}
+
+// get returns the updates to piggyback on one packet, at most limit bytes (but at least one update),
+// and drops the updates that have been transmitted retransmitLimit times
+func (q *broadcastQueue) get(limit int, retransmitLimit int) []common.Update {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil
+	}
+
+	// Fewest transmissions first, newest first among equal transmissions
+	sort.Slice(q.items, func(i, j int) bool {
+		if q.items[i].transmits != q.items[j].transmits {
+			return q.items[i].transmits < q.items[j].transmits
+		}
+		return q.items[i].seq > q.items[j].seq
+	})
+
+	var updates []common.Update
+	used := 0
+	kept := q.items[:0]
+	for _, v := range q.items {
+		if len(updates) == 0 || used+v.size <= limit {
+			updates = append(updates, v.update)
+			used += v.size
+			v.transmits++
+		}
+		if v.transmits < retransmitLimit {
+			kept = append(kept, v)
+		}
+	}
+	q.items = kept
+
+	return updates
+}
+
+// len returns the number of queued updates
+func (q *broadcastQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// retransmitLimit returns λ·log(n), the number of times an update is retransmitted in a cluster of n nodes
+func retransmitLimit(mult int, n int) int {
+	return mult * int(math.Ceil(math.Log10(float64(n+1))))
+}
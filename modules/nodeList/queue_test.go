@@ -0,0 +1,138 @@
+package nodeList
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+func nodeUpdate(id string) common.Update {
+	return common.Update{Type: common.UpdateNode, Node: common.Node{ID: id, Addr: "10.0.0.1", Port: 8000}}
+}
+
+// updateIDs returns the node IDs of updates
+func updateIDs(updates []common.Update) []string {
+	var ids []string
+	for _, u := range updates {
+		ids = append(ids, u.Node.ID)
+	}
+	return ids
+}
+
+func TestRetransmitLimit(t *testing.T) {
+	tests := []struct {
+		mult, n, want int
+	}{
+		{4, 0, 0},
+		{4, 1, 4},     // ceil(log10(2)) = 1
+		{4, 9, 4},     // ceil(log10(10)) = 1
+		{4, 10, 8},    // ceil(log10(11)) = 2
+		{4, 99, 8},    // ceil(log10(100)) = 2
+		{4, 100, 12},  // ceil(log10(101)) = 3
+		{3, 1000, 12}, // ceil(log10(1001)) = 4
+		{1, 5, 1},
+	}
+	for _, tt := range tests {
+		if got := retransmitLimit(tt.mult, tt.n); got != tt.want {
+			t.Errorf("retransmitLimit(%d, %d) = %d, want %d", tt.mult, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestBroadcastQueueOrder(t *testing.T) {
+	var q broadcastQueue
+	for _, id := range []string{"a", "b", "c"} {
+		q.enqueue("node:"+id, nodeUpdate(id))
+	}
+
+	// A limit of 1 byte returns a single update: fewest transmissions first, newest first among equal transmissions
+	want := [][]string{{"c"}, {"b"}, {"a"}, {"c"}, {"b"}}
+	for i, w := range want {
+		if got := updateIDs(q.get(1, 10)); !slices.Equal(got, w) {
+			t.Errorf("get %d = %v, want %v", i, got, w)
+		}
+	}
+
+	// A new update goes before the transmitted ones
+	q.enqueue("node:d", nodeUpdate("d"))
+	if got := updateIDs(q.get(1, 10)); !slices.Equal(got, []string{"d"}) {
+		t.Errorf("get after enqueue = %v, want [d]", got)
+	}
+}
+
+func TestBroadcastQueueSizeLimit(t *testing.T) {
+	bs, err := json.Marshal(nodeUpdate("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := len(bs)
+
+	tests := []struct {
+		name  string
+		limit int
+		want  []string
+	}{
+		{"all", 3 * size, []string{"c", "b", "a"}},
+		{"two", 3*size - 1, []string{"c", "b"}},
+		{"at least one", 0, []string{"c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q broadcastQueue
+			for _, id := range []string{"a", "b", "c"} {
+				q.enqueue("node:"+id, nodeUpdate(id))
+			}
+			if got := updateIDs(q.get(tt.limit, 10)); !slices.Equal(got, tt.want) {
+				t.Errorf("get(%d) = %v, want %v", tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroadcastQueueEviction(t *testing.T) {
+	var q broadcastQueue
+	q.enqueue("node:a", nodeUpdate("a"))
+	q.enqueue("node:b", nodeUpdate("b"))
+
+	// Updates are dropped once transmitted retransmitLimit times
+	for i := 0; i < 2; i++ {
+		if got := updateIDs(q.get(1<<20, 2)); !slices.Equal(got, []string{"b", "a"}) {
+			t.Fatalf("get %d = %v, want [b a]", i, got)
+		}
+	}
+	if n := q.len(); n != 0 {
+		t.Errorf("len = %d after retransmitLimit transmissions, want 0", n)
+	}
+	if got := q.get(1<<20, 2); got != nil {
+		t.Errorf("get on an empty queue = %v, want nil", got)
+	}
+
+	// An update left out by the size limit is not transmitted, it stays queued
+	q.enqueue("node:a", nodeUpdate("a"))
+	q.enqueue("node:b", nodeUpdate("b"))
+	q.get(1, 1)
+	if got := updateIDs(q.get(1, 1)); !slices.Equal(got, []string{"a"}) || q.len() != 0 {
+		t.Errorf("get = %v (len %d), want [a] and an empty queue", got, q.len())
+	}
+}
+
+func TestBroadcastQueueReplace(t *testing.T) {
+	var q broadcastQueue
+	q.enqueue("node:a", nodeUpdate("a"))
+	q.enqueue("node:b", nodeUpdate("b"))
+	q.get(1<<20, 10)
+
+	// A newer update of the same key replaces the queued one and is transmitted from scratch
+	newer := nodeUpdate("a")
+	newer.Node.Addr = "10.0.0.2"
+	q.enqueue("node:a", newer)
+	if n := q.len(); n != 2 {
+		t.Errorf("len = %d, want 2", n)
+	}
+	got := q.get(1, 10)
+	if len(got) != 1 || got[0].Node.Addr != "10.0.0.2" {
+		t.Errorf("get = %+v, want the newer update of a", got)
+	}
+}
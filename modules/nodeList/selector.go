@@ -0,0 +1,135 @@
+package nodeList
+
+import (
+	"math/rand"
+	"sync"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+// Selector picks the target nodes of a broadcast or a swap request
+type Selector interface {
+	// Select returns up to n nodes among the candidates
+	Select(candidates []common.Node, n int) []common.Node
+}
+
+// RandomSelector picks uniformly random nodes (a fresh shuffle for every selection)
+type RandomSelector struct{}
+
+func (s *RandomSelector) Select(candidates []common.Node, n int) []common.Node {
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	selected := make([]common.Node, n)
+	for i, v := range rand.Perm(len(candidates))[:n] {
+		selected[i] = candidates[v]
+	}
+	return selected
+}
+
+// RoundRobinSelector walks a random permutation of the nodes without replacement,
+// every node is selected once before any node is selected again, then the permutation is reshuffled
+type RoundRobinSelector struct {
+	mu    sync.Mutex
+	order []string // Permutation of node IDs
+	pos   int      // Position of the next node in the permutation
+}
+
+func (s *RoundRobinSelector) Select(candidates []common.Node, n int) []common.Node {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	byID := make(map[string]common.Node, len(candidates))
+	for _, v := range candidates {
+		byID[v.ID] = v
+	}
+
+	var selected []common.Node
+	// Walk at most one full permutation plus the reshuffled one
+	for steps := 0; len(selected) < n && steps < len(s.order)+len(candidates); steps++ {
+		if s.pos >= len(s.order) {
+			s.reshuffle(candidates)
+		}
+		id := s.order[s.pos]
+		s.pos++
+		if v, ok := byID[id]; ok {
+			selected = append(selected, v)
+			delete(byID, id)
+		}
+	}
+	return selected
+}
+
+// reshuffle starts a new random permutation of the candidates
+func (s *RoundRobinSelector) reshuffle(candidates []common.Node) {
+	s.order = s.order[:0]
+	for _, v := range candidates {
+		s.order = append(s.order, v.ID)
+	}
+	rand.Shuffle(len(s.order), func(i, j int) {
+		s.order[i], s.order[j] = s.order[j], s.order[i]
+	})
+	s.pos = 0
+}
+
+// ZoneSelector prefers nodes in the same zone as the local node, while always picking
+// at least Remote nodes from other zones (if any) so that zones stay connected
+type ZoneSelector struct {
+	Zone   func() string            // Returns the zone of the local node
+	ZoneOf func(common.Node) string // Returns the zone of a node
+	Remote int                      // Minimum number of nodes selected from other zones
+	Next   Selector                 // Selector used within each zone (default: random)
+}
+
+func (s *ZoneSelector) Select(candidates []common.Node, n int) []common.Node {
+	next := s.Next
+	if next == nil {
+		next = &RandomSelector{}
+	}
+
+	zone := s.Zone()
+	var local, remote []common.Node
+	for _, v := range candidates {
+		if s.ZoneOf(v) == zone {
+			local = append(local, v)
+		} else {
+			remote = append(remote, v)
+		}
+	}
+
+	// Reserve room for the remote nodes, fill the rest with local nodes first
+	reserved := s.Remote
+	if reserved > len(remote) {
+		reserved = len(remote)
+	}
+	if reserved > n {
+		reserved = n
+	}
+	selected := next.Select(local, n-reserved)
+	return append(selected, next.Select(remote, n-len(selected))...)
+}
+
+// ZoneLabel is the private metadata label holding the zone of a node
+const ZoneLabel = "zone"
+
+// NewZoneSelector creates a zone-aware selector using the "zone" private metadata label of the nodes
+func (nodeList *NodeList) NewZoneSelector(remote int) *ZoneSelector {
+	return &ZoneSelector{
+		Zone: func() string {
+			return nodeList.zoneOf(nodeList.LocalNode)
+		},
+		ZoneOf: nodeList.zoneOf,
+		Remote: remote,
+	}
+}
+
+// zoneOf returns the zone of a node from its private metadata labels
+func (nodeList *NodeList) zoneOf(node common.Node) string {
+	if md, ok := nodeList.privateData.Load(node.ID); ok {
+		return md.(common.NodeMetadata).Labels[ZoneLabel]
+	}
+	return ""
+}
@@ -0,0 +1,170 @@
+package nodeList
+
+import (
+	"testing"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+// testNodes returns the remote nodes 1 to n of newTestNodeList
+func testNodes(n int) []common.Node {
+	var nodes []common.Node
+	for i := 1; i <= n; i++ {
+		nodes = append(nodes, testNode(i))
+	}
+	return nodes
+}
+
+// distinctIDs returns the number of distinct node IDs in nodes
+func distinctIDs(nodes []common.Node) int {
+	ids := make(map[string]bool)
+	for _, v := range nodes {
+		ids[v.ID] = true
+	}
+	return len(ids)
+}
+
+func TestRandomSelector(t *testing.T) {
+	nodes := testNodes(10)
+	tests := []struct {
+		name string
+		n    int
+		want int
+	}{
+		{"none", 0, 0},
+		{"some", 3, 3},
+		{"all", 10, 10},
+		{"more than candidates", 20, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (&RandomSelector{}).Select(nodes, tt.n)
+			if len(got) != tt.want || distinctIDs(got) != tt.want {
+				t.Errorf("selected %d nodes (%d distinct), want %d distinct", len(got), distinctIDs(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundRobinSelector(t *testing.T) {
+	t.Run("every node once per round", func(t *testing.T) {
+		nodes := testNodes(10)
+		s := &RoundRobinSelector{}
+		for round := 0; round < 3; round++ {
+			var selected []common.Node
+			for i := 0; i < 5; i++ {
+				selected = append(selected, s.Select(nodes, 2)...)
+			}
+			if len(selected) != 10 || distinctIDs(selected) != 10 {
+				t.Errorf("round %d: selected %d nodes (%d distinct), want 10 distinct", round, len(selected), distinctIDs(selected))
+			}
+		}
+	})
+
+	t.Run("no duplicates across reshuffle", func(t *testing.T) {
+		nodes := testNodes(5)
+		s := &RoundRobinSelector{}
+		for i := 0; i < 10; i++ {
+			if got := s.Select(nodes, 3); len(got) != 3 || distinctIDs(got) != 3 {
+				t.Errorf("select %d: %d nodes (%d distinct), want 3 distinct", i, len(got), distinctIDs(got))
+			}
+		}
+	})
+
+	t.Run("more than candidates", func(t *testing.T) {
+		got := (&RoundRobinSelector{}).Select(testNodes(4), 10)
+		if len(got) != 4 || distinctIDs(got) != 4 {
+			t.Errorf("selected %d nodes (%d distinct), want 4 distinct", len(got), distinctIDs(got))
+		}
+	})
+
+	t.Run("candidates change", func(t *testing.T) {
+		s := &RoundRobinSelector{}
+		s.Select(testNodes(4), 1)
+
+		// Nodes gone since the permutation was made are skipped, new nodes join the next permutation
+		nodes := append(testNodes(2), testNode(10))
+		var selected []common.Node
+		for i := 0; i < 3; i++ {
+			got := s.Select(nodes, 1)
+			if len(got) != 1 {
+				t.Fatalf("select %d: %d nodes, want 1", i, len(got))
+			}
+			selected = append(selected, got...)
+		}
+		for _, v := range selected {
+			if v.ID == "n3" || v.ID == "n4" {
+				t.Errorf("selected removed node %s", v.ID)
+			}
+		}
+	})
+}
+
+func TestZoneSelector(t *testing.T) {
+	// Node i is in zone "a" for i <= local, in zone "b" otherwise
+	zoned := func(local, remote int) []common.Node {
+		nodes := testNodes(local + remote)
+		for i := range nodes {
+			nodes[i].Name = "b"
+			if i < local {
+				nodes[i].Name = "a"
+			}
+		}
+		return nodes
+	}
+
+	tests := []struct {
+		name            string
+		local, remote   int
+		reserved, n     int
+		wantLocal, want int
+	}{
+		{"local first", 5, 5, 1, 3, 2, 3},
+		{"no reservation", 5, 5, 0, 3, 3, 3},
+		{"local exhausted", 2, 5, 1, 5, 2, 5},
+		{"reservation over n", 5, 5, 4, 3, 0, 3},
+		{"reservation over remote nodes", 5, 1, 3, 4, 3, 4},
+		{"no remote nodes", 5, 0, 2, 3, 3, 3},
+		{"no local nodes", 0, 5, 1, 3, 0, 3},
+		{"more than candidates", 2, 2, 1, 10, 2, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &ZoneSelector{
+				Zone:   func() string { return "a" },
+				ZoneOf: func(node common.Node) string { return node.Name },
+				Remote: tt.reserved,
+			}
+			got := s.Select(zoned(tt.local, tt.remote), tt.n)
+			local := 0
+			for _, v := range got {
+				if v.Name == "a" {
+					local++
+				}
+			}
+			if len(got) != tt.want || distinctIDs(got) != tt.want || local != tt.wantLocal {
+				t.Errorf("selected %d nodes (%d distinct, %d local), want %d distinct with %d local", len(got), distinctIDs(got), local, tt.want, tt.wantLocal)
+			}
+		})
+	}
+}
+
+func TestNodeListZoneSelector(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 5)
+	nodeList.SetPrivate(map[string]string{ZoneLabel: "a"}, nil)
+	for i, zone := range []string{"a", "a", "b", "b"} {
+		nodeList.privateData.Store(testNode(i+1).ID, common.NodeMetadata{Labels: map[string]string{ZoneLabel: zone}})
+	}
+
+	s := nodeList.NewZoneSelector(1)
+	got := s.Select(testNodes(4), 3)
+	local := 0
+	for _, v := range got {
+		if nodeList.zoneOf(v) == "a" {
+			local++
+		}
+	}
+	if len(got) != 3 || local != 2 {
+		t.Errorf("selected %d nodes with %d in the local zone, want 3 with 2", len(got), local)
+	}
+}
@@ -0,0 +1,88 @@
+package nodeList
+
+import (
+	"sync/atomic"
+
+	bpf "github.com/kerwenwwer/eGossip/pkg/bpf"
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+	"github.com/kerwenwwer/eGossip/pkg/transport"
+)
+
+// gossipStats counts broadcast packets, used to measure the redundancy vs. the packet size of an infection tracking mode
+type gossipStats struct {
+	sent      atomic.Int64 // Broadcast packets sent (one per target)
+	sentBytes atomic.Int64 // Bytes of broadcast packets sent
+	received  atomic.Int64 // Broadcast packets received
+	redundant atomic.Int64 // Broadcast packets received more than once
+}
+
+// Stats is a snapshot of the gossip statistics of the local node
+type Stats struct {
+	Infection       string  // Infection tracking mode
+	Sent            int64   // Broadcast packets sent (one per target)
+	SentBytes       int64   // Bytes of broadcast packets sent
+	AvgPacketSize   int64   // Average size of a broadcast packet (in bytes)
+	Received        int64   // Broadcast packets received
+	Redundant       int64   // Broadcast packets received more than once
+	RedundancyRatio float64 // Redundant / Received
+	QueuedUpdates   int     // Updates waiting in the dissemination queue
+
+	XDP *bpf.XdpStats       `json:",omitempty"` // Counters of the XDP program (XDP protocol)
+	XSK *transport.XskStats `json:",omitempty"` // Ring fill levels and counters of the AF_XDP socket (XDP protocol)
+}
+
+// Stats retrieves the gossip statistics of the local node
+func (nodeList *NodeList) Stats() Stats {
+	s := Stats{
+		Infection:     nodeList.Infection,
+		Sent:          nodeList.stats.sent.Load(),
+		SentBytes:     nodeList.stats.sentBytes.Load(),
+		Received:      nodeList.stats.received.Load(),
+		Redundant:     nodeList.stats.redundant.Load(),
+		QueuedUpdates: nodeList.queue.len(),
+	}
+	if s.Sent != 0 {
+		s.AvgPacketSize = s.SentBytes / s.Sent
+	}
+	if s.Received != 0 {
+		s.RedundancyRatio = float64(s.Redundant) / float64(s.Received)
+	}
+	if nodeList.Protocol == "XDP" && nodeList.Program != nil {
+		if xs, err := bpf.ReadXdpStats(nodeList.Program); err != nil {
+			nodeList.Logger.Sugar().Warnln("[Stats]: Failed to read the XDP counters:", err)
+		} else {
+			s.XDP = &xs
+		}
+	}
+	if nodeList.Protocol == "XDP" && nodeList.Xsk != nil {
+		if xs, err := transport.ReadXskStats(nodeList.Xsk, nodeList.XskConfig, nodeList.XdpQueues); err != nil {
+			nodeList.Logger.Sugar().Warnln("[Stats]: Failed to read the AF_XDP socket counters:", err)
+		} else {
+			s.XSK = &xs
+		}
+	}
+	return s
+}
+
+// countSent records a broadcast packet sent to n targets
+func (nodeList *NodeList) countSent(n int, size int) {
+	nodeList.stats.sent.Add(int64(n))
+	nodeList.stats.sentBytes.Add(int64(n * size))
+}
+
+// countReceived records a received broadcast packet and reports whether it has already been received before
+func (nodeList *NodeList) countReceived(p common.Packet) bool {
+	nodeList.stats.received.Add(1)
+
+	// A broadcast is identified by its origin node and origin timestamp, metadata updates are tracked separately from heartbeats
+	key := p.Node.ID
+	if p.IsUpdate {
+		key += ":update"
+	}
+	if v, ok := nodeList.seen.Load(key); ok && v.(int64) >= p.Time {
+		nodeList.stats.redundant.Add(1)
+		return true
+	}
+	nodeList.seen.Store(key, p.Time)
+	return false
+}
@@ -1,7 +1,9 @@
 package nodeList
 
 import (
-	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"strconv"
 	"time"
 
@@ -18,20 +20,23 @@ func task(nodeList *NodeList) {
 			break
 		}
 
-		// Add the local node to the list of infected nodes
-		var infected = make(map[string]bool)
-		infected[nodeList.LocalNode.Addr+":"+strconv.Itoa(nodeList.LocalNode.Port)] = true
-
 		// Update local node information
 		nodeList.Set(nodeList.LocalNode)
 
 		// Set up the heartbeat data packet
 		p := common.Packet{
 			Node:      nodeList.LocalNode,
-			Infected:  infected,
 			SecretKey: nodeList.SecretKey,
+			Private:   nodeList.localPrivate(),
+			Updates:   nodeList.piggyback(),
+		}
+		if nodeList.Adaptive {
+			p.Members = nodeList.size() // The local view, not the scaled size, so that a shrinking cluster scales down
 		}
 
+		// Add the local node to the list of infected nodes
+		initInfection(nodeList, &p)
+
 		// Broadcast the heartbeat data packet
 		broadcast(nodeList, p)
 
@@ -40,26 +45,25 @@ func task(nodeList *NodeList) {
 		swapRequest(nodeList)
 
 		// Interval time
-		time.Sleep(time.Duration(nodeList.Cycle) * time.Second)
+		time.Sleep(time.Duration(nodeList.cycle()) * time.Second)
 	}
 }
 
 // Listen to synchronization information from other nodes
-func listener(nodeList *NodeList, mq chan []byte) {
+func listener(nodeList *NodeList, conn *net.UDPConn, mq chan []byte) {
 	// Listen coroutine
-	listen(nodeList, mq)
+	listen(nodeList, conn, mq)
 }
 
 // Consume messages
 func consume(nodeList *NodeList, mq chan []byte) {
 	for {
 		// Retrieve message from the listen queue
-		bs := <-mq
-
-		// Process XDP message (if applicable)
-		if nodeList.Protocol == "XDP" {
-			bs[60] = byte('0')
-			bs = bs[42:] // Only need payload
+		var bs []byte
+		select {
+		case bs = <-mq:
+		case <-nodeList.done:
+			return
 		}
 
 		// Unmarshal message and handle errors
@@ -74,6 +78,14 @@ func consume(nodeList *NodeList, mq chan []byte) {
 			continue
 		}
 
+		// Scale from the largest membership view of the cluster
+		if nodeList.Adaptive {
+			nodeList.observeSize(p.Members)
+		}
+
+		// Apply piggybacked updates
+		processUpdates(nodeList, p.Updates)
+
 		// Process metadata update packets
 		if processMetadataPacket(nodeList, p) {
 			continue
@@ -85,12 +97,12 @@ func consume(nodeList *NodeList, mq chan []byte) {
 }
 
 func unmarshalPacket(bs []byte, p *common.Packet) error {
-	return json.Unmarshal(bs, p)
+	return common.DecodePacket(bs, p)
 }
 
 func handleError(nodeList *NodeList, err error, bs []byte) {
-	// Combine error logging (logic moved here)
-	nodeList.Logger.Sugar().Panicln("[Consumer Data Parsing Error]:", err, string(bs))
+	// A malformed packet from the network is dropped, it must not stop the consumer
+	nodeList.Logger.Sugar().Warnln("[Consumer Data Parsing Error]:", err)
 }
 
 func validatePacket(nodeList *NodeList, p common.Packet) bool {
@@ -100,10 +112,22 @@ func validatePacket(nodeList *NodeList, p common.Packet) bool {
 
 func processMetadataPacket(nodeList *NodeList, p common.Packet) bool {
 	if p.Type >= 2 {
+		// In adaptive mode, every swap request is answered to measure the RTT, the response echoes the request timestamp
+		if nodeList.Adaptive {
+			if p.Type == 2 {
+				defer swapResponse(nodeList, p.Node, p.Time)
+			} else if p.Time != 0 {
+				nodeList.observeRTT(time.Duration(time.Now().UnixNano() - p.Time))
+			}
+		}
+
 		// If the version of the metadata in the packet is newer than the local metadata
 		if p.Metadata.Update > nodeList.metadata.Load().(common.Metadata).Update {
 			// Update local node's stored metadata
-			nodeList.metadata.Store(p.Metadata)
+			nodeList.storeMetadata(p.Metadata)
+			if nodeList.Piggyback {
+				nodeList.queue.enqueue("metadata", common.Update{Type: common.UpdateMetadata, Metadata: p.Metadata})
+			}
 			// Skip, do not broadcast, do not respond to initiator
 
 			nodeList.Logger.Sugar().Infoln("[Metadata]: Recv new node metadata, node info:", nodeList.LocalNode.Addr+":"+strconv.Itoa(nodeList.LocalNode.Port))
@@ -112,9 +136,9 @@ func processMetadataPacket(nodeList *NodeList, p common.Packet) bool {
 		// If the packet's metadata version is older, this means the initiator's metadata version needs to be updated
 		if p.Metadata.Update < nodeList.metadata.Load().(common.Metadata).Update {
 			// If it is a swap request from the initiator
-			if p.Type == 2 {
+			if p.Type == 2 && !nodeList.Adaptive {
 				// Respond to the initiator, send the latest metadata to the initiator, complete the swap process
-				swapResponse(nodeList, p.Node)
+				swapResponse(nodeList, p.Node, p.Time)
 			}
 		}
 		// Skip, do not broadcast
@@ -123,15 +147,48 @@ func processMetadataPacket(nodeList *NodeList, p common.Packet) bool {
 	return false
 }
 
+// Apply the updates piggybacked on a packet, new updates are queued again for dissemination
+func processUpdates(nodeList *NodeList, updates []common.Update) {
+	for _, u := range updates {
+		switch u.Type {
+		case common.UpdateNode:
+			if u.Node.ID == nodeList.LocalNode.ID {
+				continue
+			}
+			// Only add unknown or moved nodes, piggybacked updates do not refresh the node liveness
+			if v, ok := nodeList.nodes.Load(u.Node.ID); !ok || nodeKey(v.(nodeEntry).node) != nodeKey(u.Node) {
+				nodeList.Set(u.Node)
+			}
+			nodeList.setPrivate(u.Node, u.Private)
+		case common.UpdateMetadata:
+			if u.Metadata.Update > nodeList.metadata.Load().(common.Metadata).Update {
+				nodeList.storeMetadata(u.Metadata)
+				if nodeList.Piggyback {
+					nodeList.queue.enqueue("metadata", u)
+				}
+				nodeList.Logger.Sugar().Infoln("[Metadata]: Recv new node metadata, node info:", nodeList.LocalNode.Addr+":"+strconv.Itoa(nodeList.LocalNode.Port))
+			}
+		}
+	}
+}
+
 func processRegularPacket(nodeList *NodeList, p common.Packet) {
 	// Update local list and broadcast (logic moved here)
 	node := p.Node
 	//nodeList.println("[Recv]:", node.Addr+":"+strconv.Itoa(node.Port))
-	nodeList.Set(node)
+	nodeList.setNode(node, p.Time)
+	nodeList.setPrivate(node, p.Private)
 	if p.IsUpdate {
-		nodeList.metadata.Store(p.Metadata)
+		nodeList.storeMetadata(p.Metadata)
 		nodeList.Logger.Sugar().Infoln("[Metadata]: Recv new node metadata, node info:", nodeList.LocalNode.Addr+":"+strconv.Itoa(nodeList.LocalNode.Port))
 	}
+
+	// Forward the broadcast unless the infection tracking stops it here
+	redundant := nodeList.countReceived(p)
+	if !forwardInfection(nodeList, &p, redundant) {
+		return
+	}
+	p.Flags &^= common.FlagNodeList // The targets are picked again by this node
 	broadcast(nodeList, p)
 }
 
@@ -147,110 +204,97 @@ func broadcast(nodeList *NodeList, p common.Packet) {
 	// Get all unexpired nodes
 	nodes := nodeList.Get()
 
-	var targetNodes []common.Node
+	var candidates []common.Node
 
-	// Select some uninfected nodes
-	i := 0
+	// Collect the uninfected nodes
 	for _, v := range nodes {
-
-		// If the maximum number of pushes (Amount) has been reached
-		if i >= nodeList.Amount {
-			// Stop the broadcast
-			break
-		}
-
 		// If the node has already been "infected"
-		if p.Infected[v.Addr+":"+strconv.Itoa(v.Port)] {
+		if isInfected(nodeList, &p, v) {
 			// Skip this node
 			continue
 		}
+		candidates = append(candidates, v)
+	}
 
-		p.Infected[v.Addr+":"+strconv.Itoa(v.Port)] = true // Mark the node as infected
-		// Set the target node for sending
-		targetNode := common.Node{
-			Addr: v.Addr, // Set the target address
-			Port: v.Port, // Set the target port
-		}
-
-		// Add the node to the broadcast list
-		targetNodes = append(targetNodes, targetNode)
-		i++
+	// Select at most fanout of them
+	targetNodes := nodeList.Selector.Select(candidates, nodeList.fanout())
+	for _, v := range targetNodes {
+		markInfected(nodeList, &p, v) // Mark the node as infected
 	}
 
 	//nodeList.println("[Broadcast]:", len(targetNodes))
 
 	// Broadcast the "infection" data to these uninfected nodes
 	for _, v := range targetNodes {
-		bs, err := json.Marshal(p)
+		bs, err := common.EncodePacket(p)
 		if err != nil {
 			nodeList.Logger.Sugar().Panicln("[Infection Error]:", err)
 		}
 
 		// Send the packet
 		write(nodeList, v.Addr, v.Port, bs)
+		nodeList.countSent(1, len(bs))
 	}
 }
 
 func fastBroadcast(nodeList *NodeList, p common.Packet) {
+	// The TC program picks the targets from the kernel node list
+	if nodeList.KernelNodes {
+		kernelBroadcast(nodeList, p)
+		return
+	}
+
 	nodes := nodeList.Get()
-	var targetNodes []common.Node
+	var candidates []common.Node
 
-	i := 0
 	for _, v := range nodes {
-		if i >= nodeList.Amount {
-			break
-		}
-
 		if v.Addr == nodeList.LocalNode.Addr && v.Port == nodeList.LocalNode.Port {
 			continue
 		}
 
-		if p.Infected[v.Addr+":"+strconv.Itoa(v.Port)] {
+		if isInfected(nodeList, &p, v) {
 			continue
 		}
-
-		p.Infected[v.Addr+":"+strconv.Itoa(v.Port)] = true
-		targetNode := common.Node{Addr: v.Addr, Port: v.Port, Mac: v.Mac}
-		targetNodes = append(targetNodes, targetNode)
-		i++
+		candidates = append(candidates, v)
 	}
 
-	// Function to split targetNodes into smaller slices if more than 25 nodes
-	splitNodes := func(nodes []common.Node, size int) [][]common.Node {
-		var chunks [][]common.Node
-		for size < len(nodes) {
-			nodes, chunks = nodes[size:], append(chunks, nodes[0:size:size])
-		}
-		chunks = append(chunks, nodes)
-		return chunks
+	targetNodes := nodeList.Selector.Select(candidates, nodeList.fanout())
+	for _, v := range targetNodes {
+		markInfected(nodeList, &p, v)
 	}
 
-	// Handling targetNodes exceeding 25 nodes
-	if len(targetNodes) > 25 {
-		nodeGroups := splitNodes(targetNodes, 25)
-
-		for _, group := range nodeGroups {
-			sendGroup(nodeList, group, p)
-		}
-	} else if len(targetNodes) != 0 {
+	if len(targetNodes) != 0 {
 		sendGroup(nodeList, targetNodes, p)
 	}
 }
 
+// Time after which the targets_map entry of a broadcast is reclaimed, the packet may wait for neighbour resolution before reaching the TC hook
+const targetsReclaimDelay = 2 * time.Second
+
+// Number of map keys tried when the next key is still used by a broadcast in flight
+const targetsKeyAttempts = 8
+
 // sendGroup handles sending a packet to a group of nodes
 func sendGroup(nodeList *NodeList, nodes []common.Node, p common.Packet) {
-	mapId := nodeList.Counter.Next()
-	if mapId == 0 {
-		nodeList.Logger.Sugar().Panicln("[Map ID error]: mapId is 0")
-	}
-	p.Mapkey = mapId
 	p.Type = 1
 
-	if err := bpf.TcPushtoMap(nodeList.Program, mapId, nodes); err != nil {
-		nodeList.Logger.Sugar().Panicln("[TC error]:", "Failed to push to map", err)
+	mapIds, err := pushTargets(nodeList, nodes)
+	if err != nil {
+		// Fall back to sending a copy to each node from userspace
+		nodeList.Logger.Sugar().Warnln("[TC error]:", "Failed to push to map, fallback to UDP", err)
+		bs, err := common.EncodePacket(p)
+		if err != nil {
+			nodeList.Logger.Sugar().Panicln("[Infection Error]:", err)
+		}
+		for _, v := range nodes {
+			write(nodeList, v.Addr, v.Port, bs)
+		}
+		nodeList.countSent(len(nodes), len(bs))
+		return
 	}
+	p.Mapkey = mapIds[0]
 
-	bs, err := json.Marshal(p)
+	bs, err := common.EncodePacket(p)
 	if err != nil {
 		nodeList.Logger.Sugar().Panicln("[Infection Error]:", err)
 	}
@@ -258,6 +302,66 @@ func sendGroup(nodeList *NodeList, nodes []common.Node, p common.Packet) {
 	addr := nodes[0].Addr
 	port := nodes[0].Port
 	write(nodeList, addr, int(port), bs) // Send the packet to each node in the group
+	nodeList.countSent(len(nodes), len(bs))
+
+	// Reclaim the map entries once the clones have been sent
+	time.AfterFunc(targetsReclaimDelay, func() {
+		reclaimTargets(nodeList, mapIds)
+	})
+}
+
+// pushTargets stores the targets of a broadcast in chained targets_map entries (MAX_TARGETS targets per entry)
+// and returns the map keys, the first key is the head of the chain
+func pushTargets(nodeList *NodeList, nodes []common.Node) ([]uint16, error) {
+	chain := (len(nodes) + bpf.MAX_TARGETS - 1) / bpf.MAX_TARGETS
+	if chain > bpf.MAX_CHAIN {
+		return nil, fmt.Errorf("too many targets: %d", len(nodes))
+	}
+
+	// Store the chain from its tail, so that the head only becomes visible once the chain is complete
+	mapIds := make([]uint16, chain)
+	var next uint16
+	for i := chain - 1; i >= 0; i-- {
+		end := (i + 1) * bpf.MAX_TARGETS
+		if end > len(nodes) {
+			end = len(nodes)
+		}
+		mapId, err := pushTargetsEntry(nodeList, nodes[i*bpf.MAX_TARGETS:end], next)
+		if err != nil {
+			reclaimTargets(nodeList, mapIds[i+1:])
+			return nil, err
+		}
+		mapIds[i] = mapId
+		next = mapId
+	}
+	return mapIds, nil
+}
+
+// pushTargetsEntry stores a single targets_map entry and returns its key,
+// keys still used by a broadcast in flight (after the counter wrapped around) are skipped
+func pushTargetsEntry(nodeList *NodeList, nodes []common.Node, next uint16) (uint16, error) {
+	var err error
+	for i := 0; i < targetsKeyAttempts; i++ {
+		mapId := nodeList.Counter.Next()
+		err = bpf.TcPushtoMap(nodeList.Program, mapId, next, nodes)
+		if err == nil {
+			return mapId, nil
+		}
+		if !errors.Is(err, bpf.ErrTargetsKeyInUse) {
+			return 0, err
+		}
+		nodeList.Logger.Sugar().Warnln("[TC error]:", "Map key collision", err)
+	}
+	return 0, err
+}
+
+// reclaimTargets deletes the targets_map entries of a finished broadcast
+func reclaimTargets(nodeList *NodeList, mapIds []uint16) {
+	for _, mapId := range mapIds {
+		if err := bpf.TcDeleteFromMap(nodeList.Program, mapId); err != nil {
+			nodeList.Logger.Sugar().Warnln("[TC error]:", "Failed to reclaim map key", mapId, err)
+		}
+	}
 }
 
 // Initiate a data exchange request between two nodes
@@ -271,35 +375,45 @@ func swapRequest(nodeList *NodeList) {
 		Infected:  make(map[string]bool),
 		Metadata:  nodeList.metadata.Load().(common.Metadata),
 		SecretKey: nodeList.SecretKey,
+		Updates:   nodeList.piggyback(),
+		Time:      time.Now().UnixNano(),
+	}
+	// Every request is answered in adaptive mode, it must not be dropped as stale
+	if nodeList.Adaptive {
+		p.Flags = common.FlagRTT
 	}
 
 	// Fetch all unexpired nodes
 	nodes := nodeList.Get()
 
 	// Convert the packet to JSON
-	bs, err := json.Marshal(p)
+	bs, err := common.EncodePacket(p)
 	if err != nil {
 		nodeList.Logger.Sugar().Panicln("[Swap Request Parsing Error]:", err)
 	}
 
-	// Randomly select a node from the node list and initiate a data exchange request
-	for i := 0; i < len(nodes); i++ {
-		// If the node is the local node, skip it
-		if nodes[i].Addr == nodeList.LocalNode.Addr && nodes[i].Port == nodeList.LocalNode.Port {
+	// Skip the local node
+	var candidates []common.Node
+	for _, v := range nodes {
+		if v.Addr == nodeList.LocalNode.Addr && v.Port == nodeList.LocalNode.Port {
 			continue
 		}
+		candidates = append(candidates, v)
+	}
+
+	// Randomly select a node from the node list and initiate a data exchange request
+	for _, v := range nodeList.Selector.Select(candidates, 1) {
 		// Send the request
-		write(nodeList, nodes[i].Addr, nodes[i].Port, bs)
+		write(nodeList, v.Addr, v.Port, bs)
 
 		if nodeList.IsPrint {
-			nodeList.Logger.Sugar().Infoln("[Swap Request]:", nodeList.LocalNode.Addr+":"+strconv.Itoa(nodeList.LocalNode.Port), "->", nodes[i].Addr+":"+strconv.Itoa(nodes[i].Port))
+			nodeList.Logger.Sugar().Infoln("[Swap Request]:", nodeList.LocalNode.Addr+":"+strconv.Itoa(nodeList.LocalNode.Port), "->", v.Addr+":"+strconv.Itoa(v.Port))
 		}
-		break
 	}
 }
 
-// Receive a swap request and respond to the sender, completing the swap
-func swapResponse(nodeList *NodeList, node common.Node) {
+// Receive a swap request and respond to the sender, completing the swap (the request timestamp is echoed back)
+func swapResponse(nodeList *NodeList, node common.Node, requestTime int64) {
 	// Set as a swap packet
 	p := common.Packet{
 		Type:      3,
@@ -307,9 +421,14 @@ func swapResponse(nodeList *NodeList, node common.Node) {
 		Infected:  make(map[string]bool),
 		Metadata:  nodeList.metadata.Load().(common.Metadata),
 		SecretKey: nodeList.SecretKey,
+		Updates:   nodeList.piggyback(),
+		Time:      requestTime,
+	}
+	if nodeList.Adaptive {
+		p.Flags = common.FlagRTT
 	}
 
-	bs, err := json.Marshal(p)
+	bs, err := common.EncodePacket(p)
 	if err != nil {
 		nodeList.Logger.Sugar().Panicln("[Error]:", err)
 	}
@@ -327,12 +446,18 @@ func write(nodeList *NodeList, addr string, port int, data []byte) {
 	transport.UdpWrite(nodeList.Logger, addr, port, data)
 }
 
-// listen
-func listen(nodeList *NodeList, mq chan []byte) {
+// listen receives the packets to the local node, on conn (bound by Join) with the UDP and TC protocols
+func listen(nodeList *NodeList, conn *net.UDPConn, mq chan []byte) {
 	if nodeList.Protocol == "UDP" || nodeList.Protocol == "TC" {
-		transport.UdpListen(nodeList.Logger, nodeList.ListenAddr, nodeList.LocalNode.Port, nodeList.Size, mq)
+		if err := transport.UdpListen(nodeList.Logger, conn, nodeList.Size, mq, nodeList.done); err != nil {
+			nodeList.Logger.Sugar().Errorln("[Error]: Stopped listening on port", nodeList.LocalNode.Port, err)
+		}
+		close(nodeList.listening)
 	} else if nodeList.Protocol == "XDP" {
-		transport.XdpListen(nodeList.Xsk, mq)
+		// The clusters of the daemon share the xdp socket, payloads are routed by port
+		nodeList.XdpQueues.Register(uint16(nodeList.LocalNode.Port), mq, nodeList.done)
+		close(nodeList.listening)
+		nodeList.XdpQueues.Listen(nodeList.Logger, nodeList.Xsk)
 	} else {
 		nodeList.Logger.Sugar().Panicln("Protocol not supported, only UDP, TC and XDP.")
 	}
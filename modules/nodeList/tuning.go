@@ -0,0 +1,130 @@
+package nodeList
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Tuning is the effective gossip configuration of the local node list
+type Tuning struct {
+	Adaptive bool          // Whether the values are computed from the cluster size and observed RTT
+	Nodes    int           // Number of nodes in the local node list
+	Scale    int           // Number of nodes the cycle and timeout are scaled from, the largest node list announced in the cluster
+	Fanout   int           // Number of nodes to send synchronization information to at one time
+	Cycle    int64         // Synchronization cycle (in seconds)
+	Timeout  int64         // Expiry deletion limit for a single node (in seconds)
+	RTT      time.Duration // Smoothed round trip time of swap requests
+}
+
+// Tuning retrieves the effective gossip configuration of the local node list
+func (nodeList *NodeList) Tuning() Tuning {
+	return Tuning{
+		Adaptive: nodeList.Adaptive,
+		Nodes:    nodeList.size(),
+		Scale:    nodeList.scaleSize(),
+		Fanout:   nodeList.fanout(),
+		Cycle:    nodeList.cycle(),
+		Timeout:  nodeList.timeout(),
+		RTT:      time.Duration(nodeList.rtt.Load()),
+	}
+}
+
+// fanout returns the number of broadcast targets, ceil(ln(n))+FanoutConst (at most Amount) in adaptive mode
+func (nodeList *NodeList) fanout() int {
+	if !nodeList.Adaptive {
+		return nodeList.Amount
+	}
+	fanout := int(math.Ceil(math.Log(float64(nodeList.size())))) + nodeList.FanoutConst
+	if fanout > nodeList.Amount {
+		fanout = nodeList.Amount
+	}
+	return fanout
+}
+
+// cycle returns the synchronization cycle, scaled by log10(n) in adaptive mode
+func (nodeList *NodeList) cycle() int64 {
+	if !nodeList.Adaptive {
+		return nodeList.Cycle
+	}
+	return nodeList.Cycle * int64(scale(nodeList.scaleSize()))
+}
+
+// timeout returns the node expiry limit, SuspicionMult·log10(n)·cycle plus twice the RTT in adaptive mode
+func (nodeList *NodeList) timeout() int64 {
+	if !nodeList.Adaptive {
+		return nodeList.Timeout
+	}
+	rtt := time.Duration(nodeList.rtt.Load())
+	timeout := nodeList.SuspicionMult*scale(nodeList.scaleSize())*float64(nodeList.cycle()) + 2 + math.Ceil(2*rtt.Seconds())
+	return int64(math.Ceil(timeout))
+}
+
+// observeRTT updates the smoothed round trip time with a new sample (same smoothing as the TCP SRTT)
+func (nodeList *NodeList) observeRTT(sample time.Duration) {
+	if sample <= 0 {
+		return
+	}
+	old := nodeList.rtt.Load()
+	if old == 0 {
+		nodeList.rtt.Store(int64(sample))
+		return
+	}
+	nodeList.rtt.Store(old - old/8 + int64(sample)/8)
+}
+
+// clusterSize is the largest node list size announced by the nodes of the cluster. Nodes with different views of the
+// membership would otherwise stretch their cycle differently, and a node with a small view could expire the peers
+// whose heartbeats are spaced by a larger one
+type clusterSize struct {
+	mu     sync.Mutex
+	n      int   // Largest announced size
+	expiry int64 // Second-level timestamp after which n is no longer announced
+}
+
+// observeSize records the node list size announced by a packet
+func (nodeList *NodeList) observeSize(n int) {
+	if n <= 0 {
+		return
+	}
+	// Valid as long as the node announcing it would be kept without heartbeat
+	s := scale(n)
+	ttl := int64(math.Ceil(nodeList.SuspicionMult*s*float64(nodeList.Cycle)*s)) + 2
+	now := time.Now().Unix()
+
+	c := &nodeList.clusterSize
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n >= c.n || now > c.expiry {
+		c.n = n
+		c.expiry = now + ttl
+	}
+}
+
+// scaleSize returns the number of nodes the cycle and timeout are scaled from, the local node list size or the largest
+// size announced by the cluster
+func (nodeList *NodeList) scaleSize() int {
+	n := nodeList.size()
+	c := &nodeList.clusterSize
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n > n && time.Now().Unix() <= c.expiry {
+		n = c.n
+	}
+	return n
+}
+
+// size returns the number of nodes in the local node list (including expired nodes not yet deleted)
+func (nodeList *NodeList) size() int {
+	n := 0
+	nodeList.nodes.Range(func(k, v interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// scale returns max(1, log10(n))
+func scale(n int) float64 {
+	return math.Max(1, math.Ceil(math.Log10(float64(n))))
+}
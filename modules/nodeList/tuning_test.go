@@ -0,0 +1,109 @@
+package nodeList
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTuning(t *testing.T) {
+	// Defaults: Cycle 6, Timeout 32, FanoutConst 2, SuspicionMult 5
+	tests := []struct {
+		name     string
+		adaptive bool
+		amount   int
+		nodes    int
+		rtt      time.Duration
+		want     Tuning
+	}{
+		{"static", false, 3, 150, 0, Tuning{Fanout: 3, Cycle: 6, Timeout: 32}},
+		{"static with rtt", false, 3, 5, time.Second, Tuning{Fanout: 3, Cycle: 6, Timeout: 32}},
+		// ceil(ln(1)) + 2, log10 scale of at least 1
+		{"single node", true, 30, 1, 0, Tuning{Fanout: 2, Cycle: 6, Timeout: 5*6 + 2}},
+		// ceil(ln(10)) + 2, ceil(log10(10)) = 1
+		{"ten nodes", true, 30, 10, 0, Tuning{Fanout: 5, Cycle: 6, Timeout: 5*6 + 2}},
+		// ceil(ln(11)) + 2, ceil(log10(11)) = 2
+		{"eleven nodes", true, 30, 11, 0, Tuning{Fanout: 5, Cycle: 12, Timeout: 5*2*12 + 2}},
+		// ceil(ln(150)) + 2, ceil(log10(150)) = 3
+		{"150 nodes", true, 30, 150, 0, Tuning{Fanout: 8, Cycle: 18, Timeout: 5*3*18 + 2}},
+		{"fanout capped", true, 4, 150, 0, Tuning{Fanout: 4, Cycle: 18, Timeout: 5*3*18 + 2}},
+		// Plus ceil(2·1.2s)
+		{"rtt", true, 30, 10, 1200 * time.Millisecond, Tuning{Fanout: 5, Cycle: 6, Timeout: 5*6 + 2 + 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nodeList := newTestNodeList(t, &NodeList{Adaptive: tt.adaptive, Amount: tt.amount}, tt.nodes)
+			nodeList.observeRTT(tt.rtt)
+
+			want := tt.want
+			want.Adaptive, want.Nodes, want.Scale, want.RTT = tt.adaptive, tt.nodes, tt.nodes, tt.rtt
+			if got := nodeList.Tuning(); got != want {
+				t.Errorf("Tuning() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestClusterSize(t *testing.T) {
+	// Two nodes disagree about the member count
+	small := newTestNodeList(t, &NodeList{Adaptive: true}, 5)
+	large := newTestNodeList(t, &NodeList{Adaptive: true}, 150)
+	if small.cycle() == large.cycle() {
+		t.Fatalf("cycle = %d for both views, want different cycles before the announcement", small.cycle())
+	}
+
+	// The heartbeats of the large view announce its size, both nodes then scale from it
+	large.observeSize(small.size())
+	small.observeSize(large.size())
+	for _, nodeList := range []*NodeList{small, large} {
+		if got := nodeList.Tuning(); got.Scale != 150 || got.Cycle != large.cycle() || got.Timeout != large.timeout() {
+			t.Errorf("Tuning() = %+v, want the scale, cycle and timeout of 150 nodes", got)
+		}
+	}
+	if small.timeout() < 2*large.cycle() {
+		t.Errorf("timeout %d of the small view under two cycles of the large view (%d)", small.timeout(), large.cycle())
+	}
+
+	// A smaller announcement does not lower the scale while the larger one is valid
+	small.observeSize(20)
+	if got := small.scaleSize(); got != 150 {
+		t.Errorf("scale = %d after a smaller announcement, want 150", got)
+	}
+
+	// Once no node announces the larger size any more, the scale follows the cluster down
+	small.clusterSize.expiry = time.Now().Unix() - 1
+	if got := small.scaleSize(); got != 5 {
+		t.Errorf("scale = %d after the announcement expired, want the local 5", got)
+	}
+	small.observeSize(20)
+	if got := small.scaleSize(); got != 20 {
+		t.Errorf("scale = %d, want the new announcement 20", got)
+	}
+
+	// Static mode ignores the announcements
+	static := newTestNodeList(t, &NodeList{}, 5)
+	static.observeSize(150)
+	if got := static.cycle(); got != 6 {
+		t.Errorf("static cycle = %d, want 6", got)
+	}
+}
+
+func TestObserveRTT(t *testing.T) {
+	var nodeList NodeList
+	steps := []struct {
+		sample time.Duration
+		want   time.Duration
+	}{
+		{0, 0},                 // Ignored
+		{-time.Millisecond, 0}, // Ignored
+		{80 * time.Millisecond, 80 * time.Millisecond},  // First sample
+		{160 * time.Millisecond, 90 * time.Millisecond}, // 80 - 80/8 + 160/8
+		{0, 90 * time.Millisecond},                      // Ignored
+		{10 * time.Millisecond, 80 * time.Millisecond},  // 90 - 90/8 + 10/8
+	}
+	for i, s := range steps {
+		nodeList.observeRTT(s.sample)
+		if got := time.Duration(nodeList.rtt.Load()); got != s.want {
+			t.Errorf("step %d: rtt = %v after a sample of %v, want %v", i, got, s.sample, s.want)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package nodeList
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+/*
+ * Versioned HTTP API (/v1) of the control plane, JSON responses and errors. The routes are described by openapi.yaml,
+ * served at /v1/openapi.yaml.
+ */
+
+const v1Prefix = "/v1"
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// Lifecycle states of the local node
+const (
+	StateRunning = "running" // Sends heartbeats
+	StateStopped = "stopped" // Heartbeats stopped, can be started again
+	StateLeft    = "left"    // Left the cluster for good, its port is released
+)
+
+// APIError is the body of the error responses of the /v1 API
+type APIError struct {
+	Error APIErrorDetail
+}
+
+// APIErrorDetail describes an error of the /v1 API
+type APIErrorDetail struct {
+	Status  int    // HTTP status code
+	Code    string // Stable error code, e.g. not_found
+	Message string // Human readable message
+}
+
+// MemberList is the body of GET /v1/members
+type MemberList struct {
+	Members []common.Node
+}
+
+// MetadataResource is the cluster metadata of the /v1 API
+type MetadataResource struct {
+	Data    []byte // Metadata content (base64 in JSON)
+	Version int64  // Metadata version (update timestamp in nanoseconds)
+}
+
+// Lifecycle is the body of the /v1/lifecycle responses
+type Lifecycle struct {
+	State string // running, stopped or left
+}
+
+// V1Handler serves the /v1 API of the node list:
+//
+//	GET    /v1/members          list the nodes
+//	POST   /v1/members          add a node (common.Node)
+//	GET    /v1/members/{id}     get a node
+//	DELETE /v1/members/{id}     remove a node
+//	GET    /v1/lifecycle        state of the local node
+//	POST   /v1/lifecycle/stop   stop the heartbeats
+//	POST   /v1/lifecycle/start  restart the heartbeats
+//	POST   /v1/lifecycle/leave  leave the cluster for good
+//	GET    /v1/metadata         read the cluster metadata
+//	PUT    /v1/metadata         publish new cluster metadata (MetadataResource)
+//	GET    /v1/openapi.yaml     OpenAPI description of the API
+func (nl *NodeList) V1Handler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, v1Prefix), "/")
+		resource, id, _ := strings.Cut(path, "/")
+
+		switch {
+		case resource == "members" && id == "":
+			nl.v1Members(w, r)
+		case resource == "members":
+			nl.v1Member(w, r, id)
+		case resource == "lifecycle":
+			nl.v1Lifecycle(w, r, id)
+		case resource == "metadata" && id == "":
+			nl.v1Metadata(w, r)
+		case resource == "openapi.yaml" && id == "":
+			if !allowMethods(w, r, http.MethodGet) {
+				return
+			}
+			w.Header().Set("Content-Type", "application/yaml")
+			if _, err := w.Write(openAPISpec); err != nil {
+				log.Println(errMsgErrorWritingResponse)
+			}
+		default:
+			writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("No route for %s", r.URL.Path))
+		}
+	}
+}
+
+// v1Members lists or adds nodes
+func (nl *NodeList) v1Members(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		nodes := nl.Get()
+		if nodes == nil {
+			nodes = []common.Node{}
+		}
+		writeJSON(w, http.StatusOK, MemberList{Members: nodes})
+		return
+	}
+
+	var node common.Node
+	if !readJSON(w, r, &node) {
+		return
+	}
+	if _, err := netip.ParseAddr(node.Addr); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_argument", fmt.Sprintf("Invalid node address: %q", node.Addr))
+		return
+	}
+	if node.Port <= 0 || node.Port > 65535 {
+		writeError(w, http.StatusBadRequest, "invalid_argument", fmt.Sprintf("Invalid node port: %d", node.Port))
+		return
+	}
+
+	if nodeKey(node) == nodeKey(nl.LocalNode) {
+		writeError(w, http.StatusBadRequest, "invalid_argument", fmt.Sprintf("%s is the address of the local node", nodeKey(node)))
+		return
+	}
+
+	nl.Set(node)
+
+	// Set identifies a node without ID by its address, and rejects a node claiming the ID of another live node
+	id := node.ID
+	if id == "" {
+		id = nodeKey(node)
+	}
+	stored, ok := nl.Member(id)
+	if !ok || nodeKey(stored) != nodeKey(node) {
+		writeError(w, http.StatusConflict, "conflict", fmt.Sprintf("Node ID %s is used by another node", id))
+		return
+	}
+	writeJSON(w, http.StatusCreated, stored)
+}
+
+// v1Member gets or removes a node
+func (nl *NodeList) v1Member(w http.ResponseWriter, r *http.Request, id string) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+
+	node, ok := nl.Member(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Node %s not found", id))
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, node)
+		return
+	}
+
+	if id == nl.LocalNode.ID {
+		writeError(w, http.StatusConflict, "conflict", "The local node cannot be removed, use /v1/lifecycle/leave")
+		return
+	}
+	nl.Remove(id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// v1Lifecycle reads or changes the state of the local node
+func (nl *NodeList) v1Lifecycle(w http.ResponseWriter, r *http.Request, action string) {
+	if action == "" {
+		if allowMethods(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, Lifecycle{State: nl.state()})
+		}
+		return
+	}
+
+	switch action {
+	case "stop", "start", "leave":
+	default:
+		writeError(w, http.StatusNotFound, "not_found", fmt.Sprintf("Unknown lifecycle action: %s", action))
+		return
+	}
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if nl.Closed() {
+		writeError(w, http.StatusConflict, "conflict", "The local node left the cluster")
+		return
+	}
+
+	switch action {
+	case "stop":
+		nl.Stop()
+	case "start":
+		nl.Start()
+	case "leave":
+		nl.Close()
+	}
+	writeJSON(w, http.StatusOK, Lifecycle{State: nl.state()})
+}
+
+// state returns the lifecycle state of the local node
+func (nl *NodeList) state() string {
+	switch {
+	case nl.Closed():
+		return StateLeft
+	case nl.Running():
+		return StateRunning
+	default:
+		return StateStopped
+	}
+}
+
+// v1Metadata reads or publishes the cluster metadata
+func (nl *NodeList) v1Metadata(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var md MetadataResource
+		if !readJSON(w, r, &md) {
+			return
+		}
+		nl.Publish(md.Data)
+	}
+
+	md := nl.metadata.Load().(common.Metadata)
+	writeJSON(w, http.StatusOK, MetadataResource{Data: md.Data, Version: md.Update})
+}
+
+// allowMethods writes a 405 error unless the request method is one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", fmt.Sprintf("Method %s not allowed", r.Method))
+	return false
+}
+
+// readJSON decodes the request body into v, a 400 error is written if it is not valid JSON
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_argument", "Can't read request body")
+		return false
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_argument", fmt.Sprintf("Can't parse JSON: %v", err))
+		return false
+	}
+	return true
+}
+
+// writeJSON writes v as a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println(errMsgErrorWritingResponse)
+	}
+}
+
+// writeError writes an APIError response
+func writeError(w http.ResponseWriter, status int, code string, message string) {
+	writeJSON(w, status, APIError{Error: APIErrorDetail{Status: status, Code: code, Message: message}})
+}
@@ -0,0 +1,164 @@
+package nodeList
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+func TestV1Members(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	handler := nodeList.Handler()
+
+	w := serve(handler, http.MethodPost, "/v1/members", `{"ID":"n1","Addr":"127.0.0.2","Port":8000}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add: status %d (%s), want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	var node common.Node
+	if err := json.Unmarshal(w.Body.Bytes(), &node); err != nil {
+		t.Fatal(err)
+	}
+	if node.ID != "n1" || node.Addr != "127.0.0.2" || node.Port != 8000 {
+		t.Errorf("added node = %+v, want n1 at 127.0.0.2:8000", node)
+	}
+
+	// A node without ID is identified by its address
+	w = serve(handler, http.MethodPost, "/v1/members", `{"Addr":"127.0.0.3","Port":8000}`)
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"ID":"127.0.0.3:8000"`) {
+		t.Errorf("add without ID: status %d (%s), want the ID 127.0.0.3:8000", w.Code, w.Body)
+	}
+
+	var list MemberList
+	w = serve(handler, http.MethodGet, "/v1/members", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Members) != 3 {
+		t.Errorf("members = %+v, want 3 nodes", list.Members)
+	}
+
+	if w = serve(handler, http.MethodGet, "/v1/members/n1", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"ID":"n1"`) {
+		t.Errorf("get: status %d (%s), want n1", w.Code, w.Body)
+	}
+	if w = serve(handler, http.MethodDelete, "/v1/members/n1", ""); w.Code != http.StatusNoContent {
+		t.Errorf("delete: status %d (%s), want %d", w.Code, w.Body, http.StatusNoContent)
+	}
+	if _, ok := nodeList.Member("n1"); ok {
+		t.Error("deleted node still in the node list")
+	}
+}
+
+func TestV1Errors(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	nodeList.Set(common.Node{ID: "n1", Addr: "127.0.0.2", Port: 8000})
+	handler := nodeList.Handler()
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		status int
+		code   string
+	}{
+		{"bad json", http.MethodPost, "/v1/members", `{"Addr":`, http.StatusBadRequest, "invalid_argument"},
+		{"invalid address", http.MethodPost, "/v1/members", `{"Addr":"node1","Port":8000}`, http.StatusBadRequest, "invalid_argument"},
+		{"invalid port", http.MethodPost, "/v1/members", `{"Addr":"127.0.0.3","Port":0}`, http.StatusBadRequest, "invalid_argument"},
+		{"id of a live node", http.MethodPost, "/v1/members", `{"ID":"n1","Addr":"127.0.0.3","Port":8000}`, http.StatusConflict, "conflict"},
+		{"id of the local node", http.MethodPost, "/v1/members", `{"ID":"local","Addr":"127.0.0.3","Port":8000}`, http.StatusConflict, "conflict"},
+		{"address of the local node", http.MethodPost, "/v1/members", `{"Addr":"127.0.0.1","Port":8000}`, http.StatusBadRequest, "invalid_argument"},
+		{"address of the local node with an id", http.MethodPost, "/v1/members", `{"ID":"n2","Addr":"127.0.0.1","Port":8000}`, http.StatusBadRequest, "invalid_argument"},
+		{"unknown member", http.MethodGet, "/v1/members/n9", "", http.StatusNotFound, "not_found"},
+		{"delete local node", http.MethodDelete, "/v1/members/local", "", http.StatusConflict, "conflict"},
+		{"members method", http.MethodPut, "/v1/members", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"metadata method", http.MethodPost, "/v1/metadata", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"metadata bad base64", http.MethodPut, "/v1/metadata", `{"Data":"not base64"}`, http.StatusBadRequest, "invalid_argument"},
+		{"unknown lifecycle action", http.MethodPost, "/v1/lifecycle/pause", "", http.StatusNotFound, "not_found"},
+		{"lifecycle method", http.MethodGet, "/v1/lifecycle/stop", "", http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"unknown route", http.MethodGet, "/v1/nodes", "", http.StatusNotFound, "not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serve(handler, tt.method, tt.target, tt.body)
+			var e APIError
+			if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+				t.Fatalf("error body %q: %v", w.Body, err)
+			}
+			if w.Code != tt.status || e.Error.Status != tt.status || e.Error.Code != tt.code {
+				t.Errorf("status %d, error %+v, want %d %s", w.Code, e.Error, tt.status, tt.code)
+			}
+		})
+	}
+
+	if got, _ := nodeList.Member("n1"); got.Addr != "127.0.0.2" {
+		t.Errorf("n1 moved to %s by a conflicting request", got.Addr)
+	}
+	if w := serve(handler, http.MethodPut, "/v1/members", ""); w.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("Allow = %q, want %q", w.Header().Get("Allow"), "GET, POST")
+	}
+}
+
+func TestV1Metadata(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	handler := nodeList.Handler()
+
+	var md MetadataResource
+	w := serve(handler, http.MethodGet, "/v1/metadata", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Version != 0 || len(md.Data) != 0 {
+		t.Errorf("initial metadata = %+v, want empty version 0", md)
+	}
+
+	// "Y29uZmln" is "config" in base64
+	w = serve(handler, http.MethodPut, "/v1/metadata", `{"Data":"Y29uZmln"}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &md); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusOK || string(md.Data) != "config" || md.Version == 0 {
+		t.Errorf("publish: status %d, metadata %+v, want config with a new version", w.Code, md)
+	}
+	if got := nodeList.metadata.Load().(common.Metadata); string(got.Data) != "config" || got.Update != md.Version {
+		t.Errorf("local metadata = %+v, want the published version", got)
+	}
+}
+
+func TestV1Lifecycle(t *testing.T) {
+	nodeList := newTestNodeList(t, &NodeList{}, 1)
+	handler := nodeList.Handler()
+
+	steps := []struct {
+		method string
+		target string
+		status int
+		state  string
+	}{
+		{http.MethodGet, "/v1/lifecycle", http.StatusOK, StateRunning},
+		{http.MethodPost, "/v1/lifecycle/stop", http.StatusOK, StateStopped},
+		{http.MethodPost, "/v1/lifecycle/start", http.StatusOK, StateRunning},
+		{http.MethodPost, "/v1/lifecycle/leave", http.StatusOK, StateLeft},
+		{http.MethodPost, "/v1/lifecycle/start", http.StatusConflict, ""},
+		{http.MethodGet, "/v1/lifecycle", http.StatusOK, StateLeft},
+	}
+	for _, s := range steps {
+		w := serve(handler, s.method, s.target, "")
+		var l Lifecycle
+		if err := json.Unmarshal(w.Body.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != s.status || l.State != s.state {
+			t.Errorf("%s %s: status %d, state %q, want %d %q", s.method, s.target, w.Code, l.State, s.status, s.state)
+		}
+	}
+}
+
+func TestV1OpenAPI(t *testing.T) {
+	w := serve(newTestNodeList(t, &NodeList{}, 1).Handler(), http.MethodGet, "/v1/openapi.yaml", "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/yaml" || !strings.HasPrefix(w.Body.String(), "openapi:") {
+		t.Errorf("status %d, content type %q, want the OpenAPI description", w.Code, w.Header().Get("Content-Type"))
+	}
+}
@@ -0,0 +1,118 @@
+package nodeList
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+)
+
+// changes wakes up the watchers of the node list, the channel returned by wait is closed on the next notify
+type changes struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// wait returns a channel closed by the next change
+func (c *changes) wait() <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch == nil {
+		c.ch = make(chan struct{})
+	}
+	return c.ch
+}
+
+// notify wakes up the current watchers
+func (c *changes) notify() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ch != nil {
+		close(c.ch)
+		c.ch = nil
+	}
+}
+
+// MemberEventType is the type of a membership change
+type MemberEventType int
+
+const (
+	MemberJoined  MemberEventType = iota + 1 // New node, or a node of the initial list
+	MemberUpdated                            // Node attributes changed (e.g. address)
+	MemberLeft                               // Node expired or removed
+)
+
+// MemberEvent is a membership change of the local node list
+type MemberEvent struct {
+	Type MemberEventType
+	Node common.Node
+}
+
+// WatchMembers calls fn with the nodes of the local node list as MemberJoined events, then with every membership change,
+// until ctx is done, the node list is closed or fn returns an error
+func (nodeList *NodeList) WatchMembers(ctx context.Context, fn func([]MemberEvent) error) error {
+	known := make(map[string]common.Node)
+	for {
+		// Taken before the snapshot, a change made meanwhile is not missed
+		changed := nodeList.memberChanges.wait()
+
+		current := make(map[string]common.Node)
+		var events []MemberEvent
+		for _, node := range nodeList.Get() {
+			current[node.ID] = node
+			if old, ok := known[node.ID]; !ok {
+				events = append(events, MemberEvent{Type: MemberJoined, Node: node})
+			} else if old != node {
+				events = append(events, MemberEvent{Type: MemberUpdated, Node: node})
+			}
+		}
+		for id, node := range known {
+			if _, ok := current[id]; !ok {
+				events = append(events, MemberEvent{Type: MemberLeft, Node: node})
+			}
+		}
+		known = current
+
+		if len(events) != 0 {
+			if err := fn(events); err != nil {
+				return err
+			}
+		}
+
+		// Expired nodes are only removed by Get, the list is checked at least once per cycle
+		select {
+		case <-changed:
+		case <-time.After(time.Duration(nodeList.cycle()) * time.Second):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-nodeList.done:
+			return nil
+		}
+	}
+}
+
+// WatchMetadata calls fn with the local metadata, then with every newer version, until ctx is done, the node list is
+// closed or fn returns an error. Private metadata (SetPrivate) is not watched, it is read with ReadPrivate
+func (nodeList *NodeList) WatchMetadata(ctx context.Context, fn func(common.Metadata) error) error {
+	version := int64(-1)
+	for {
+		changed := nodeList.metadataChanges.wait()
+
+		md := nodeList.metadata.Load().(common.Metadata)
+		if md.Update != version {
+			version = md.Update
+			if err := fn(md); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-nodeList.done:
+			return nil
+		}
+	}
+}
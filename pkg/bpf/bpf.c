@@ -20,21 +20,53 @@
 
 /* Control definition */
 #define MAX_TARGETS 64 // Max targets for broadcast
+#define MAX_CHAIN 4    // Max chained targets_map entries for broadcast
+#define MAX_NODES 1024 // Max nodes of the kernel node list
+#define MAX_FANOUT 256 // Max targets of a broadcast picked from the node list
 #define MAX_SIZE 200
 #define MTU 1500
 #define MAX_PAYLOAD 1000
-#define MAX_METADATA 256
-#define MAX_INT64_LEN 20
 #define MAX_SOCKS 64
-#define MAX_SEGMENT_SIZE 256
 
 typedef __u64 u64;
 typedef __u32 u32;
 typedef __u16 u16;
 
-/* PORT value by definition */
+/* Gossip port, rewritten at load time (additional ports are in ports_map) */
 static volatile unsigned const short PORT = 8000;
 
+/* Window in which a broadcast message ID already seen is dropped */
+static volatile const __u64 DEDUP_WINDOW_NS = 10ULL * 1000000000ULL;
+
+/* Whether only sources in allow_map may reach the AF_XDP socket */
+static volatile const __u8 ALLOWLIST = 0;
+
+/* Token bucket of each source: packets per second (0: no limit) and burst */
+static volatile const __u64 RATE_LIMIT = 0;
+static volatile const __u64 RATE_BURST = 0;
+
+/* Whether gossip packets encapsulated in VXLAN or Geneve reach the AF_XDP
+ * socket (overlay networks) */
+static volatile const __u8 TUNNELS = 0;
+
+#define NSEC_PER_SEC 1000000000ULL
+
+#define VLAN_MAX_DEPTH 2  // 802.1ad outer tag and 802.1Q inner tag
+#define IP_FRAG_OFF 0x1fff // Fragment offset of iphdr.frag_off (host order)
+#define VXLAN_PORT 4789
+#define GENEVE_PORT 6081
+#define VXLAN_FLAG_VNI 0x08 // VXLAN I flag, the VNI is valid
+
+/* Indexes of the XDP counters in stats_map */
+enum xdp_stat {
+  STAT_REDIRECTED, // Packets redirected to the AF_XDP socket
+  STAT_DUPLICATE,  // Broadcasts dropped as already seen
+  STAT_STALE,      // Swap packets dropped as stale
+  STAT_DENIED,     // Packets dropped from sources not in the allowlist
+  STAT_LIMITED,    // Packets dropped by the rate limit of their source
+  STAT_MAX,
+};
+
 /* Node info struct for store node information. */
 struct node_info {
   __u32 ip;
@@ -42,16 +74,65 @@ struct node_info {
   char mac[ETH_ALEN];
 };
 
-/* Broadcast target struct, including node info and current count. */
+/* Broadcast target struct, including node info, target count and the key of
+ * the next chained entry (0 if none). */
 struct targets {
   struct node_info target_list[MAX_TARGETS];
   __u16 max_count;
+  __u16 next;
+};
+
+/* Binary header in front of the JSON payload, in network byte order
+ * (must match pkg/common/header.go). */
+struct gossip_hdr {
+  __u16 magic;
+  __u8 type;
+  __u8 flags;
+  __u16 count;
+  __u16 mapkey;
+  __u64 version; // Metadata version (update timestamp) of the sender
+  __u64 msg_id;  // Broadcast message ID (0 if none), same for every copy
+};
+
+#define GOSSIP_MAGIC 0x6547 // "eG"
+#define FLAG_CLONED 0x1     // Copy already addressed, do not clone again
+#define FLAG_UPDATES 0x2    // Packet carries piggybacked updates
+#define FLAG_RTT 0x4        // Swap packet measures the RTT, always delivered
+#define FLAG_NODELIST 0x8   // Targets are count nodes of nodelist_map from mapkey
+
+#ifndef offsetof
+#define offsetof(type, member) __builtin_offsetof(type, member)
+#endif
+
+/* 802.1Q/802.1ad tag following the MAC addresses */
+struct vlan_hdr {
+  __be16 tci;
+  __be16 encap_proto;
+};
+
+/* VXLAN header (RFC 7348) */
+struct vxlan_hdr {
+  __u8 flags;
+  __u8 reserved[3];
+  __u8 vni[3];
+  __u8 reserved2;
+};
+
+/* Geneve header (RFC 8926), followed by opt_len 4-byte words of options */
+struct geneve_hdr {
+  __u8 ver_opt_len; // Version (2 bits) and options length (6 bits)
+  __u8 flags;
+  __be16 proto;
+  __u8 vni[3];
+  __u8 reserved;
 };
 
-/* Metadat struct for store latest metadata. */
-struct metadata {
-  char metadata[MAX_METADATA];
-  int64_t update_time;
+/* Offsets of the headers of a gossip packet from the start of the frame,
+ * VLAN tags and IP options make them variable */
+struct gossip_off {
+  __u32 ip;  // IPv4 header
+  __u32 udp; // UDP header
+  __u32 hdr; // Gossip header
 };
 
 /* Message struct for commucation between kerenlspace and userspace. */
@@ -68,21 +149,95 @@ struct {
   __uint(max_entries, 1024);
 } targets_map SEC(".maps"); // map for targets
 
-/* BPF_MAP_TYPE_HASH for nodelist (Not use for now.) */
+/* BPF_MAP_TYPE_ARRAY for the node list mirrored by userspace, the first
+ * nodelist_len entries are live nodes */
 struct {
-  __uint(type, BPF_MAP_TYPE_HASH);
-  __type(key, __u16);
-  __type(value, struct targets);
-  __uint(max_entries, 1024);
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __type(key, __u32);
+  __type(value, struct node_info);
+  __uint(max_entries, MAX_NODES);
 } nodelist_map SEC(".maps");
 
-/* BPF_MAP_TYPE_HASH for metadata store (Not use for now.) */
+/* BPF_MAP_TYPE_ARRAY for the number of live nodes in nodelist_map */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __type(key, __u32);
+  __type(value, __u32);
+  __uint(max_entries, 1);
+} nodelist_len SEC(".maps");
+
+/* BPF_MAP_TYPE_HASH for the version of the local metadata of each cluster,
+ * keyed by gossip port (host byte order) and kept in sync by userspace */
 struct {
   __uint(type, BPF_MAP_TYPE_HASH);
   __type(key, __u16);
-  __type(value, struct metadata);
+  __type(value, __u64);
+  __uint(max_entries, 64);
+} metadata_map SEC(".maps"); // map for metadata version
+
+/* BPF_MAP_TYPE_ARRAY for the layout version of the pinned maps, only used by
+ * userspace to decide whether maps pinned by a previous daemon can be reused */
+struct {
+  __uint(type, BPF_MAP_TYPE_ARRAY);
+  __type(key, __u32);
+  __type(value, __u64);
   __uint(max_entries, 1);
-} metadata_map SEC(".maps"); // map for metadata
+} version_map SEC(".maps");
+
+/* BPF_MAP_TYPE_LRU_HASH for the broadcast message IDs already seen, value is
+ * the time the message was first seen */
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, __u64);
+  __type(value, __u64);
+  __uint(max_entries, 8192);
+} seen_map SEC(".maps");
+
+/* BPF_MAP_TYPE_PERCPU_ARRAY for the XDP counters, read by userspace */
+struct {
+  __uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+  __type(key, __u32);
+  __type(value, __u64);
+  __uint(max_entries, STAT_MAX);
+} stats_map SEC(".maps");
+
+/* Key of allow_map, an IPv4 prefix */
+struct allow_key {
+  __u32 prefixlen;
+  __u32 addr;
+};
+
+/* BPF_MAP_TYPE_LPM_TRIE for the sources allowed to reach the AF_XDP socket
+ * (node addresses as /32 and operator CIDRs) */
+struct {
+  __uint(type, BPF_MAP_TYPE_LPM_TRIE);
+  __type(key, struct allow_key);
+  __type(value, __u8);
+  __uint(max_entries, 4096);
+  __uint(map_flags, BPF_F_NO_PREALLOC);
+} allow_map SEC(".maps");
+
+/* Token bucket of a source, tokens are in packets * NSEC_PER_SEC */
+struct bucket {
+  __u64 tokens;
+  __u64 last; // Time of the last refill
+};
+
+/* BPF_MAP_TYPE_LRU_HASH for the token bucket of each source address */
+struct {
+  __uint(type, BPF_MAP_TYPE_LRU_HASH);
+  __type(key, __u32);
+  __type(value, struct bucket);
+  __uint(max_entries, 4096);
+} rate_map SEC(".maps");
+
+/* BPF_MAP_TYPE_HASH for additional gossip ports (host byte order) */
+struct {
+  __uint(type, BPF_MAP_TYPE_HASH);
+  __type(key, __u16);
+  __type(value, __u8);
+  __uint(max_entries, 64);
+} ports_map SEC(".maps");
 
 /* BPF_MAP_TYPE_XSKMAP for xsk_map */
 struct {
@@ -100,75 +255,88 @@ struct {
   __uint(max_entries, MAX_SOCKS);
 } qidconf_map SEC(".maps"); // map for qidconf
 
-/* Compute ip checksum for cloned packet before TC_ACT_OK. */
-static __always_inline __u16 compute_ip_checksum(struct iphdr *ip) {
-  __u32 csum = 0;
-  __u16 *next_ip_u16 = (__u16 *)ip;
+/* BPF_MAP_TYPE_PROG_ARRAY holding the XDP program chained after this one,
+ * packets that are not for eGossip are handed to it */
+struct {
+  __uint(type, BPF_MAP_TYPE_PROG_ARRAY);
+  __type(key, __u32);
+  __type(value, __u32);
+  __uint(max_entries, 1);
+} xdp_chain SEC(".maps");
+
+/* Parse the Ethernet frame starting at off down to the UDP header: up to
+ * VLAN_MAX_DEPTH VLAN tags are skipped and the IP header length is taken from
+ * IHL. Returns 0 and fills o for an IPv4/UDP frame (first fragment only). */
+static __always_inline int parse_udp(void *data, void *data_end, __u32 off,
+                                     struct gossip_off *o) {
+  struct ethhdr *eth = data + off;
+  if ((void *)(eth + 1) > data_end)
+    return -1;
+  __be16 proto = eth->h_proto;
+  off += sizeof(*eth);
 
-  ip->check = 0;
-#pragma clang loop unroll(full)
-  for (int i = 0; i < (sizeof(*ip) >> 1); i++) {
-    csum += *next_ip_u16++;
+#pragma unroll
+  for (int i = 0; i < VLAN_MAX_DEPTH; i++) {
+    if (proto != bpf_htons(ETH_P_8021Q) && proto != bpf_htons(ETH_P_8021AD))
+      break;
+    struct vlan_hdr *vlan = data + off;
+    if ((void *)(vlan + 1) > data_end)
+      return -1;
+    proto = vlan->encap_proto;
+    off += sizeof(*vlan);
   }
 
-  return ~((csum & 0xffff) + (csum >> 16));
-}
+  if (proto != bpf_htons(ETH_P_IP))
+    return -1;
 
-/* Type handler for checking packet type. */
-static __always_inline int type_handler(const char *payload) {
-  // Search for the key in the payload
-  if (payload[0] != '{') {
+  struct iphdr *ip = data + off;
+  if ((void *)(ip + 1) > data_end)
     return -1;
-  } else {
-    if (payload[2] == 'T' && payload[5] == 'e' && payload[7] == ':') {
-      if (payload[8] == '1') {
-        return 1;
-      } else if (payload[8] == '2') {
-        return 2;
-      } else if (payload[8] == '3') {
-        return 3;
-      }
-    }
-  }
-  return -1;
-}
 
-/* Map key handler for checking broadcast target map key. */
-static __always_inline __u16 mapkey_handler(const char *payload) {
-  if (payload[21] != 'M' || payload[23] != 'p' || payload[26] != 'y') {
-    return 1;
-  }
+  __u32 ihl = ip->ihl * 4;
+  if (ihl < sizeof(*ip) || ip->protocol != IPPROTO_UDP)
+    return -1;
 
-  // Extract the four digits from the payload
-  int hundreds = payload[29] - '0';
-  int tens = payload[30] - '0';
-  int ones = payload[31] - '0';
+  /* Later fragments carry no UDP header */
+  if (ip->frag_off & bpf_htons(IP_FRAG_OFF))
+    return -1;
 
-  // Convert to an actual number
-  return hundreds * 100 + tens * 10 + ones;
-}
-/* Metadata handler */
-static __always_inline int64_t metadata_handler(const char *payload,
-                                                __u8 *cursor, void *data_end) {
-  int64_t value = 0;
-#pragma clang loop unroll(full)
-  for (int i = 0; i < MAX_INT64_LEN; i++) {
-    if (cursor + (i + 1) > data_end) {
-      return XDP_DROP;
-    }
+  o->ip = off;
+  off += ihl;
 
-    if (*cursor < '0' || *cursor > '9') {
-      return XDP_DROP; // not a number
-    }
+  struct udphdr *udp = data + off;
+  if ((void *)(udp + 1) > data_end)
+    return -1;
 
-    if (*(cursor + i) == ',') {
-      break;
-    }
+  o->udp = off;
+  o->hdr = off + sizeof(*udp);
+  return 0;
+}
 
-    value = value * 10 + (*(cursor + i) - '0');
+/* Offset of the Ethernet frame encapsulated in the VXLAN or Geneve datagram
+ * at o, 0 if the datagram is not a tunnel packet. */
+static __always_inline __u32 tunnel_inner(void *data, void *data_end,
+                                          struct gossip_off *o) {
+  struct udphdr *udp = data + o->udp;
+  if ((void *)(udp + 1) > data_end)
+    return 0;
+
+  if (udp->dest == bpf_htons(VXLAN_PORT)) {
+    struct vxlan_hdr *vxlan = data + o->hdr;
+    if ((void *)(vxlan + 1) > data_end || !(vxlan->flags & VXLAN_FLAG_VNI))
+      return 0;
+    return o->hdr + sizeof(*vxlan);
   }
 
-  return value;
+  if (udp->dest == bpf_htons(GENEVE_PORT)) {
+    struct geneve_hdr *geneve = data + o->hdr;
+    if ((void *)(geneve + 1) > data_end || geneve->ver_opt_len >> 6 != 0 ||
+        geneve->proto != bpf_htons(ETH_P_TEB))
+      return 0;
+    return o->hdr + sizeof(*geneve) + (geneve->ver_opt_len & 0x3f) * 4;
+  }
+
+  return 0;
 }
 
 /* Debug function for convet u32 type ip variable into readable number. */
@@ -195,107 +363,226 @@ static __always_inline void swap_src_dst_mac(void *data) {
   p[5] = dst[2];
 }
 
-// Function to extract a JSON segment
-static __always_inline int
-extractJsonSegment(const char *payload, int payloadSize, struct xdp_md *ctx) {
-  char output[MAX_SEGMENT_SIZE]; // Fixed-size buffer
-  int i = 0, j = 0, startFound = 0;
-  char target[] = "\"Metadata\":{";
-  int targetLength = sizeof(target) - 1; // Length of the target string
-
-  // Search for the target segment
-  if (payloadSize < targetLength) {
-    bpf_printk("Payload too small.\n");
-    return XDP_DROP;
+/* Set the gossip header flags, updating the UDP checksum. */
+static __always_inline int set_flags(struct __sk_buff *skb,
+                                     struct gossip_off *o, __u8 flags) {
+  /* Type and flags share a 16-bit word of the checksum */
+  __u32 word_off = o->hdr + offsetof(struct gossip_hdr, type);
+  __u8 old_word[2];
+  if (bpf_skb_load_bytes(skb, word_off, old_word, sizeof(old_word)) < 0)
+    return -1;
+  __u8 new_word[2] = {old_word[0], flags};
+
+  if (bpf_l4_csum_replace(skb, o->udp + offsetof(struct udphdr, check),
+                          *(__be16 *)old_word, *(__be16 *)new_word,
+                          BPF_F_MARK_MANGLED_0 | sizeof(__be16)) < 0)
+    return -1;
+
+  return bpf_skb_store_bytes(skb, word_off, new_word, sizeof(new_word), 0);
+}
+
+/* State of a broadcast: the packet is cloned to every target but the last
+ * one, the original packet goes to the last target. Cloning in a loop (instead
+ * of recursively) is not limited by XMIT_RECURSION_LIMIT. */
+struct clone_state {
+  struct node_info last;
+  __u16 count;
+  /* Whether last holds a target. Branching on it instead of on count keeps
+   * count imprecise for the verifier, so it does not explore every count. */
+  int has_last;
+  /* Header offsets and the rewritten fields as currently in the packet, the
+   * checksums are updated from them without reading the packet again. Kept
+   * behind the fields above, whose stack layout the verifier is sensitive
+   * to. */
+  struct gossip_off off;
+  __be32 daddr;
+  __be16 dest;
+  __be16 hdr_count;
+};
+
+/* Start a broadcast of the packet whose headers are at off. */
+static __always_inline int init_state(struct __sk_buff *skb,
+                                      struct gossip_off *off,
+                                      struct clone_state *st) {
+  void *data = (void *)(long)skb->data;
+  void *data_end = (void *)(long)skb->data_end;
+
+  struct iphdr *ip = data + off->ip;
+  struct udphdr *udp = data + off->udp;
+  struct gossip_hdr *hdr = data + off->hdr;
+  if ((void *)(ip + 1) > data_end || (void *)(udp + 1) > data_end ||
+      (void *)(hdr + 1) > data_end)
+    return -1;
+
+  st->off = *off;
+  st->daddr = ip->daddr;
+  st->dest = udp->dest;
+  st->hdr_count = hdr->count;
+  return 0;
+}
+
+/* Rewrite the packet destination to a broadcast target, count is the index of
+ * the target among all targets of the broadcast. The IP and UDP checksums are
+ * updated incrementally, a zero (disabled) UDP checksum is left as is. */
+static __always_inline int rewrite_target(struct __sk_buff *skb,
+                                          struct clone_state *st,
+                                          struct node_info *target,
+                                          __u16 count) {
+  __u32 ip_off = st->off.ip, udp_off = st->off.udp, hdr_off = st->off.hdr;
+  __be32 old_ip = st->daddr;
+  __be16 old_port = st->dest;
+  __be16 old_count = st->hdr_count;
+  __be32 new_ip = target->ip;
+  __be16 new_port = bpf_htons(target->port);
+  __be16 new_count = bpf_htons(count);
+
+  /* The destination address is part of the UDP pseudo header */
+  __u32 udp_csum_off = udp_off + offsetof(struct udphdr, check);
+  if (bpf_l4_csum_replace(skb, udp_csum_off, old_ip, new_ip,
+                          BPF_F_PSEUDO_HDR | BPF_F_MARK_MANGLED_0 |
+                              sizeof(new_ip)) < 0 ||
+      bpf_l4_csum_replace(skb, udp_csum_off, old_port, new_port,
+                          BPF_F_MARK_MANGLED_0 | sizeof(new_port)) < 0 ||
+      bpf_l4_csum_replace(skb, udp_csum_off, old_count, new_count,
+                          BPF_F_MARK_MANGLED_0 | sizeof(new_count)) < 0 ||
+      bpf_l3_csum_replace(skb, ip_off + offsetof(struct iphdr, check), old_ip,
+                          new_ip, sizeof(new_ip)) < 0)
+    return -1;
+
+  if (bpf_skb_store_bytes(skb, ip_off + offsetof(struct iphdr, daddr), &new_ip,
+                          sizeof(new_ip), 0) < 0 ||
+      bpf_skb_store_bytes(skb, udp_off + offsetof(struct udphdr, dest),
+                          &new_port, sizeof(new_port), 0) < 0 ||
+      bpf_skb_store_bytes(skb, hdr_off + offsetof(struct gossip_hdr, count),
+                          &new_count, sizeof(new_count), 0) < 0 ||
+      bpf_skb_store_bytes(skb, offsetof(struct ethhdr, h_dest), target->mac,
+                          ETH_ALEN, 0) < 0)
+    return -1;
+
+  st->daddr = new_ip;
+  st->dest = new_port;
+  st->hdr_count = new_count;
+  return 0;
+}
+
+/* Add a broadcast target, the previous target gets a clone. */
+static __always_inline int add_target(struct __sk_buff *skb,
+                                      struct clone_state *st,
+                                      struct node_info *target) {
+  if (st->has_last) {
+    if (rewrite_target(skb, st, &st->last, st->count - 1) < 0)
+      return -1;
+#ifdef DEBUG_TC
+    int res = bpf_clone_redirect(skb, skb->ifindex, 0);
+    bpf_printk("[fastbroad_prog] clone packet, res: %d, num: %d\n", res,
+               st->count - 1);
+#else
+    bpf_clone_redirect(skb, skb->ifindex, 0);
+#endif
+  }
+
+  st->last = *target;
+  st->has_last = 1;
+  st->count++;
+  return 0;
+}
+
+/* Address the original packet to the last target. */
+static __always_inline int finish_targets(struct __sk_buff *skb,
+                                          struct clone_state *st) {
+  if (!st->has_last || st->last.ip == 0 || st->last.port == 0) {
+#ifdef DEBUG_TC
+    bpf_printk("[fastbroad_prog] TC_ACT_SHOT (No target)\n");
+#endif
+    return TC_ACT_SHOT;
   }
 
-  for (i = 0; i < payloadSize - targetLength; i++) {
-    startFound = 1;
+  if (rewrite_target(skb, st, &st->last, st->count - 1) < 0)
+    return TC_ACT_SHOT;
+
+#ifdef DEBUG_TC
+  bpf_printk("[fastbroad_prog] egress packet acceptd, info: num=%d\n",
+             st->count - 1);
+#endif
+
+  return TC_ACT_UNSPEC;
+}
 
-    // if (payload + (i + 1) > payloadSize) {
-    //     bpf_printk("Payload too small.\n");
-    //     return XDP_DROP;
-    // }
+/* Broadcast to the n nodes of the kernel node list starting at index start
+ * (wrapping around). */
+static __always_inline int nodelist_broadcast(struct __sk_buff *skb,
+                                              struct gossip_off *o,
+                                              __u32 start, __u32 n) {
+  __u32 zero = 0;
+  __u32 *len = bpf_map_lookup_elem(&nodelist_len, &zero);
+  if (!len || *len == 0)
+    return TC_ACT_SHOT;
 
-    for (j = 0; j < targetLength; j++) {
-      if (payload[i + j] != target[j]) {
-        startFound = 0;
-        break;
-      }
-    }
+  __u32 size = *len;
+  if (size > MAX_NODES)
+    size = MAX_NODES;
+  if (n > size)
+    n = size;
+  if (n > MAX_FANOUT)
+    n = MAX_FANOUT;
 
-    if (startFound) {
-      int outputIndex = 0;
-      int bracketCount = 1;
-
-      // Copy the content starting from the '{'
-      for (j = i + targetLength;
-           j < payloadSize && outputIndex < MAX_SEGMENT_SIZE - 1; j++) {
-        output[outputIndex++] = payload[j];
-
-        // Counting brackets to find the end of the JSON segment
-        if (payload[j] == '{') {
-          bracketCount++;
-        } else if (payload[j] == '}') {
-          bracketCount--;
-          if (bracketCount == 0)
-            break;
-        }
-      }
+  struct clone_state st = {};
+  if (init_state(skb, o, &st) < 0)
+    return TC_ACT_SHOT;
 
-      output[outputIndex] = '\0'; // Null-terminate the string
-      bpf_printk("Extracted content: %s\n", output);
-      return 1;
-    }
+  for (__u32 i = 0; i < n; i++) {
+    __u32 idx = (start + i) % size;
+    struct node_info *target = bpf_map_lookup_elem(&nodelist_map, &idx);
+    if (!target)
+      break;
+    if (add_target(skb, &st, target) < 0)
+      return TC_ACT_SHOT;
   }
 
-  bpf_printk("Target segment not found.\n");
+  return finish_targets(skb, &st);
 }
 
-/* ebpf TC Hook for Fastbroadcast. */
+/* ebpf TC Hook for Fastbroadcast. Packets that are not dropped are returned
+ * with TC_ACT_UNSPEC, which hands them to the next program of the hook (next
+ * tc filter or TCX link), so that eGossip runs alongside other programs. */
 SEC("classifier")
 int fastbroadcast(struct __sk_buff *skb) {
-  const int l3_off = ETH_HLEN;                      // IP header offset
-  const int l4_off = l3_off + sizeof(struct iphdr); // L4 header offset
-
   void *data = (void *)(long)skb->data;
   void *data_end = (void *)(long)skb->data_end;
-  if (data_end < data + l4_off)
-    return TC_ACT_OK;
 
-  struct ethhdr *eth = data;
-  if (eth->h_proto != htons(ETH_P_IP)) {
-    return TC_ACT_OK;
-  }
+  /* Tags offloaded to the skb (vlan_tci) are not in the packet data, inline
+   * tags are skipped by parse_udp */
+  struct gossip_off off;
+  if (parse_udp(data, data_end, 0, &off) < 0)
+    return TC_ACT_UNSPEC;
 
-  struct iphdr *ip = data + l3_off;
-  if (ip->protocol != IPPROTO_UDP) {
-    return TC_ACT_OK;
-  }
+  struct iphdr *ip = data + off.ip;
+  struct gossip_hdr *hdr = data + off.hdr;
+  if ((void *)(ip + 1) > data_end || (void *)(hdr + 1) > data_end)
+    return TC_ACT_UNSPEC;
 
-  struct udphdr *udp = data + l4_off;
-  char *payload = data + l4_off + sizeof(struct udphdr);
-  if (payload + sizeof(__u64) > data_end) {
-    return TC_ACT_OK;
+  if (hdr->magic != bpf_htons(GOSSIP_MAGIC) || hdr->type != 1) {
+    return TC_ACT_UNSPEC; // Not a broadcast packet, allow it
   }
 
-  if (payload + 40 >= data_end) {
-    return TC_ACT_OK;
+  /* Copies cloned below re-enter this hook, they are already addressed. */
+  if (hdr->flags & FLAG_CLONED) {
+    return TC_ACT_UNSPEC;
   }
 
-  if (payload > data_end) {
-    return TC_ACT_OK;
-  }
+  /* Targets picked from the kernel node list */
+  if (hdr->flags & FLAG_NODELIST) {
+    __u32 start = bpf_ntohs(hdr->mapkey);
+    __u32 n = bpf_ntohs(hdr->count);
 
-  if (type_handler(payload) != 1) {
-    return TC_ACT_OK; // Valid packet but not broadcast packet, allow it
-  }
+    if (set_flags(skb, &off, hdr->flags | FLAG_CLONED) < 0)
+      return TC_ACT_SHOT;
 
-  __u16 key = mapkey_handler(payload);
-  if (key == 1) {
-    return TC_ACT_OK;
+    return nodelist_broadcast(skb, &off, start, n);
   }
 
+  __u16 key = bpf_ntohs(hdr->mapkey);
+
   /* Lookup ebpf map */
   struct targets *tgt_list = bpf_map_lookup_elem(&targets_map, &key);
   if (!tgt_list) {
@@ -308,94 +595,135 @@ int fastbroadcast(struct __sk_buff *skb) {
                "key=%d, from %u.%u.%u.%u ->  %u.%u.%u.%u \n",
                key, b3, b2, b1, c4, c3, c2, c1);
 #endif
-    return TC_ACT_OK;
+    return TC_ACT_UNSPEC;
   }
 
-  /* Clone packet if curr < max_count */
-  char nxt;
-  u16 curr = payload[18];
-  char curr_char = payload[18];
+  if (set_flags(skb, &off, hdr->flags | FLAG_CLONED) < 0)
+    return TC_ACT_SHOT;
 
-  if (curr < tgt_list->max_count) {
-    nxt = payload[18] + 1;
-    payload[18] = nxt;
-#ifdef DEBUG_TC
-    int res = bpf_clone_redirect(skb, skb->ifindex, 0);
-    bpf_printk("[fastbroad_prog] clone packet, res: %d, curr: %d, max: %d\n",
-               res, curr - '0', tgt_list->max_count - '0');
-#else
-    bpf_clone_redirect(skb, skb->ifindex, 0);
-#endif
-  }
+  struct clone_state st = {};
+  if (init_state(skb, &off, &st) < 0)
+    return TC_ACT_SHOT;
 
-  /* bpf_redirect may change the content of skb, so we need to re-initialize */
-  data_end = (void *)(long)skb->data_end;
-  data = (void *)(long)skb->data;
-  eth = data;
-  ip = data + l3_off;
-  udp = data + l4_off;
-  payload = data + l4_off + sizeof(struct udphdr);
+  for (int c = 0; c < MAX_CHAIN; c++) {
+    __u16 max_count = tgt_list->max_count;
+    if (max_count > MAX_TARGETS)
+      max_count = MAX_TARGETS;
 
-  if (payload + sizeof(__u64) > data_end)
-    return TC_ACT_OK;
+    for (int i = 0; i < max_count; i++) {
+      if (add_target(skb, &st, &tgt_list->target_list[i]) < 0)
+        return TC_ACT_SHOT;
+    }
 
-  if (payload + 45 >= data_end) {
-    return TC_ACT_SHOT;
-  }
+    /* Follow the chained entry holding the following targets */
+    key = tgt_list->next;
+    if (!key)
+      break;
 
-  if (payload > data_end) {
-    return TC_ACT_SHOT;
+    tgt_list = bpf_map_lookup_elem(&targets_map, &key);
+    if (!tgt_list)
+      break;
   }
 
-  if (tgt_list->max_count - '0' < tgt_list->max_count - curr) {
-#ifdef DEBUG_TC
-    bpf_printk("[fastbroad_prog] TC_ACT_SHOT (Counting error)\n");
-#endif
-    return TC_ACT_SHOT;
-  }
+  return finish_targets(skb, &st);
+}
 
-  int num = (tgt_list->max_count - '0') - (tgt_list->max_count - curr);
+/* Whether a swap packet (types 2 and 3) carries metadata that is not newer
+ * than the local metadata of the cluster on its port, userspace would neither store it nor respond:
+ * a response is stale if its version is not newer, a request if its version is
+ * the same (an older request is answered with the local metadata). */
+static __always_inline int stale_metadata(struct gossip_hdr *hdr,
+                                          __be16 dest) {
+  if (hdr->magic != bpf_htons(GOSSIP_MAGIC))
+    return 0;
+  if (hdr->type != 2 && hdr->type != 3)
+    return 0;
+  if (hdr->flags & (FLAG_UPDATES | FLAG_RTT))
+    return 0;
+
+  __u16 port = bpf_ntohs(dest);
+  __u64 *cached = bpf_map_lookup_elem(&metadata_map, &port);
+  if (!cached)
+    return 0;
+
+  __u64 version = bpf_be64_to_cpu(hdr->version);
+  if (hdr->type == 3)
+    return version <= *cached;
+  return version == *cached;
+}
 
-#ifdef DEBUG_TC
-  bpf_printk("[fastbroad_prog] egress packet: num:%d, curr: %d, max_count:%d\n",
-             num, payload[18] - '0', tgt_list->max_count - '0');
-#endif
+/* Whether a broadcast was already seen within the dedup window, the message
+ * ID is recorded otherwise. */
+static __always_inline int duplicate(struct gossip_hdr *hdr) {
+  __u64 id = hdr->msg_id;
+  if (hdr->magic != bpf_htons(GOSSIP_MAGIC) || id == 0)
+    return 0;
 
-  if (num < 0 || num >= MAX_TARGETS) {
-    return TC_ACT_SHOT;
-  }
+  __u64 now = bpf_ktime_get_ns();
+  __u64 *first = bpf_map_lookup_elem(&seen_map, &id);
+  if (first && now - *first < DEDUP_WINDOW_NS)
+    return 1;
 
-  if (tgt_list->target_list[num].ip == 0 ||
-      tgt_list->target_list[num].port == 0) {
-#ifdef DEBUG_TC
-    __u8 b1, b2, b3, b4;
-    ip_to_bytes(ip->saddr, &b1, &b2, &b3, &b4);
-    bpf_printk("ERROR key=%d, max=%d, num=%d, ip:%u.%u.%u.%u\n", key,
-               tgt_list->max_count - '0', num, b4, b3, b2, b1);
-#endif
-    return TC_ACT_OK;
+  bpf_map_update_elem(&seen_map, &id, &now, BPF_ANY);
+  return 0;
+}
+
+/* Whether a source address is allowed, always true without allowlist. */
+static __always_inline int allowed(__u32 saddr) {
+  if (!ALLOWLIST)
+    return 1;
+
+  struct allow_key key = {.prefixlen = 32, .addr = saddr};
+  return bpf_map_lookup_elem(&allow_map, &key) != NULL;
+}
+
+/* Take a token from the bucket of a source, returns 0 if the bucket is empty.
+ * The buckets are shared by all CPUs without locking, the limit is
+ * approximate. */
+static __always_inline int take_token(__u32 saddr) {
+  if (!RATE_LIMIT)
+    return 1;
+
+  __u64 now = bpf_ktime_get_ns();
+  __u64 burst = (RATE_BURST ? RATE_BURST : RATE_LIMIT) * NSEC_PER_SEC;
+
+  struct bucket *b = bpf_map_lookup_elem(&rate_map, &saddr);
+  if (!b) {
+    struct bucket fresh = {.tokens = burst - NSEC_PER_SEC, .last = now};
+    bpf_map_update_elem(&rate_map, &saddr, &fresh, BPF_ANY);
+    return 1;
   }
 
-  /* Update cloned packet content */
-  udp->dest = htons(tgt_list->target_list[num].port);
-  udp->check = 0;
-  ip->daddr = tgt_list->target_list[num].ip;
-  ip->check = compute_ip_checksum(ip);
-  memcpy(eth->h_dest, tgt_list->target_list[num].mac, ETH_ALEN);
+  /* Refill, the elapsed time is capped so that the product cannot overflow */
+  __u64 elapsed = now - b->last;
+  if (elapsed > 10 * NSEC_PER_SEC)
+    elapsed = 10 * NSEC_PER_SEC;
+  __u64 tokens = b->tokens + elapsed * RATE_LIMIT;
+  if (tokens > burst)
+    tokens = burst;
+  b->last = now;
+
+  if (tokens < NSEC_PER_SEC) {
+    b->tokens = tokens;
+    return 0;
+  }
+  b->tokens = tokens - NSEC_PER_SEC;
+  return 1;
+}
 
-#ifdef DEBUG_TC
-  __u8 b1, b2, b3, b4;
-  __u8 c1, c2, c3, c4;
-  ip_to_bytes(ip->saddr, &b1, &b2, &b3, &b4);
-  ip_to_bytes(ip->daddr, &c1, &c2, &c3, &c4);
-
-  bpf_printk("[fastbroad_prog] egress packet acceptd, info: key=%d, max=%d, "
-             "num=%d, from:%u.%u.%u.%u -> %u.%u.%u.%u \n",
-             key, tgt_list->max_count - '0', num, b4, b3, b2, b1, c4, c3, c2,
-             c1);
-#endif
+/* Whether a UDP destination port is a gossip port. */
+static __always_inline int gossip_port(__be16 dest) {
+  __u16 port = bpf_ntohs(dest);
+  if (port == PORT)
+    return 1;
+  return bpf_map_lookup_elem(&ports_map, &port) != NULL;
+}
 
-  return TC_ACT_OK;
+/* Increment an XDP counter. */
+static __always_inline void count_stat(__u32 stat) {
+  __u64 *value = bpf_map_lookup_elem(&stats_map, &stat);
+  if (value)
+    *value += 1;
 }
 
 /* ebpf XDP Hook for Fastdrop. */
@@ -406,54 +734,85 @@ int xdp_sock_prog(struct xdp_md *ctx) {
 
   // A set entry here means that the correspnding queue_id
   // has an active AF_XDP socket bound to it.
-  if (bpf_map_lookup_elem(&qidconf_map, &index)) {
+  int *qidconf = bpf_map_lookup_elem(&qidconf_map, &index);
+  if (qidconf && *qidconf) {
     // redirect packets to an xdp socket that match the given IPv4 or IPv6
     // protocol; pass all other packets to the kernel
     void *data = (void *)(long)ctx->data;
     void *data_end = (void *)(long)ctx->data_end;
-    struct ethhdr *eth = data;
 
-    __u16 h_proto = eth->h_proto;
-    if ((void *)eth + sizeof(*eth) > data_end)
+    struct gossip_off off;
+    if (parse_udp(data, data_end, 0, &off) < 0) {
+#ifdef DEBUG_XDP
+      bpf_printk("Not an IPv4/UDP packet.\n");
+#endif
       goto out;
+    }
 
-    if (bpf_htons(h_proto) != ETH_P_IP)
+    /* Gossip packets of an overlay, the inner headers are checked below */
+    if (TUNNELS) {
+      __u32 inner = tunnel_inner(data, data_end, &off);
+      if (inner && parse_udp(data, data_end, inner, &off) < 0)
+        goto out;
+    }
+
+    struct iphdr *ip = data + off.ip;
+    struct udphdr *udp = data + off.udp;
+    if ((void *)(ip + 1) > data_end || (void *)(udp + 1) > data_end)
       goto out;
 
-    struct iphdr *ip = data + sizeof(*eth);
-    if ((void *)ip + sizeof(*ip) > data_end) {
+    if (!gossip_port(udp->dest)) {
 #ifdef DEBUG_XDP
-      bpf_printk("ip + sizeof(*ip) > data_end\n");
+      bpf_printk("Not the port.\n");
 #endif
       goto out;
     }
 
-    if (ip->protocol != IPPROTO_UDP) { // Only UDP packets
+    /* Drop unknown and flooding sources */
+    if (!allowed(ip->saddr)) {
 #ifdef DEBUG_XDP
-      bpf_printk("ip->protocol != IPPROTO_UDP\n");
+      bpf_printk("Source not allowed.\n");
 #endif
-      goto out;
+      count_stat(STAT_DENIED);
+      return XDP_DROP;
     }
 
-    struct udphdr *udp = (void *)ip + sizeof(*ip);
-    if ((void *)udp + sizeof(*udp) > data_end) {
-      goto out;
+    if (!take_token(ip->saddr)) {
+#ifdef DEBUG_XDP
+      bpf_printk("Source rate limited.\n");
+#endif
+      count_stat(STAT_LIMITED);
+      return XDP_DROP;
     }
 
-    if (udp->dest != bpf_htons(PORT)) {
+    /* Drop stale swap packets and duplicated broadcasts before they reach
+     * userspace */
+    struct gossip_hdr *hdr = data + off.hdr;
+    if ((void *)hdr + sizeof(*hdr) <= data_end) {
+      if (stale_metadata(hdr, udp->dest)) {
 #ifdef DEBUG_XDP
-      bpf_printk("Not the port.\n");
+        bpf_printk("Stale metadata, type %d.\n", hdr->type);
 #endif
-      goto out;
+        count_stat(STAT_STALE);
+        return XDP_DROP;
+      }
+
+      if (duplicate(hdr)) {
+#ifdef DEBUG_XDP
+        bpf_printk("Duplicate message %llx.\n", hdr->msg_id);
+#endif
+        count_stat(STAT_DUPLICATE);
+        return XDP_DROP;
+      }
     }
 
+    count_stat(STAT_REDIRECTED);
     return bpf_redirect_map(&xsks_map, index, 0);
   }
 
-drop:
-  return XDP_DROP;
-
 out:
+  /* Only returns if no program is chained */
+  bpf_tail_call(ctx, &xdp_chain, 0);
   return XDP_PASS;
 }
 
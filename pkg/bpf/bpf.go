@@ -1,21 +1,49 @@
 package bpf
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+	"net/netip"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/asavie/xdp"
-	"github.com/cilium/cilium/pkg/option"
 	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
 	common "github.com/kerwenwwer/eGossip/pkg/common"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	MAX_TARGETS = 64
+	MAX_TARGETS = 64   // Max targets of a single targets_map entry
+	MAX_CHAIN   = 4    // Max chained targets_map entries of a broadcast
+	MAX_NODES   = 1024 // Max nodes of the kernel node list (nodelist_map)
+	MAX_FANOUT  = 256  // Max targets of a broadcast picked from the kernel node list
+)
+
+const (
+	// DefaultPinPath is the bpffs directory holding the pinned maps, programs and links of eGossip
+	DefaultPinPath = "/sys/fs/bpf/egossip"
+	// MapsVersion is the layout version of the pinned maps, bump it when the key or value layout of a map changes
+	MapsVersion uint64 = 2
+	// DefaultTCPriority is the priority of the tc filter, used on kernels without TCX
+	DefaultTCPriority = 1
+	// ChainAttached chains the XDP program found on the interface after the eGossip one (Options.XDPChain)
+	ChainAttached = "attached"
+
+	tcHandle = 0xe605 // Handle of the tc filter ("eG"), handle 1 is commonly used by other software
+)
+
+var (
+	// ErrTargetsKeyInUse is returned when a targets_map key still holds the targets of a broadcast in flight
+	ErrTargetsKeyInUse = errors.New("targets map key in use")
+	// ErrTargetsMapFull is returned when targets_map has no free entry
+	ErrTargetsMapFull = errors.New("targets map full")
 )
 
 type TargetInfoInterface interface {
@@ -25,13 +53,39 @@ type TargetInfoInterface interface {
 }
 
 type BpfObjects struct {
-	objs *bpfObjects
+	objs       *bpfObjects
+	pinPath    string               // bpffs directory of the pinned objects (empty: not pinned)
+	links      map[string]link.Link // bpf_links of the attached programs, by pin name
+	tcPriority uint16               // Priority of the tc filter (kernels without TCX)
+	xdpChain   string               // XDP program chained by AttachXDP (see Options.XDPChain)
+
+	allowMu sync.Mutex
+	allowed map[netip.Prefix]int // References of the prefixes of allow_map, shared by the clusters of the daemon
+}
+
+// Close releases the objects and links, pinned objects stay in bpffs and keep the programs attached
+func (BpfObjs *BpfObjects) Close() error {
+	for _, l := range BpfObjs.links {
+		l.Close()
+	}
+	return BpfObjs.objs.Close()
 }
 
 //go:generate go run github.com/cilium/ebpf/cmd/bpf2go -cc clang -cflags "-O2 -Wall" bpf ./bpf.c
 
-// Configuration of QdiscAttrs for clsact qdisc and replace default value (typically is noqueue)
-func replaceQdisc(link netlink.Link) error {
+// Configuration of QdiscAttrs for clsact qdisc, added next to the default qdisc (typically is noqueue) unless the link already has one.
+// A clsact qdisc added by eGossip is recorded so that Cleanup only removes its own
+func ensureClsact(link netlink.Link) error {
+	qdiscs, err := netlink.QdiscList(link)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if q.Type() == "clsact" {
+			return nil
+		}
+	}
+
 	// - LinkIndex specifies the network interface where the qdisc is applied.
 	// - Handle is set to a standard value for clsact, which doesn't require a unique identifier.
 	// - Parent is set to HANDLE_CLSACT, positioning clsact at the ingress/egress, not in a qdisc hierarchy.
@@ -57,12 +111,84 @@ func replaceQdisc(link netlink.Link) error {
 		QdiscType:  "clsact",
 	}
 
-	return netlink.QdiscReplace(qdisc)
+	if err := netlink.QdiscAdd(qdisc); err != nil {
+		return err
+	}
+	return markClsact(link.Attrs().Name)
+}
+
+// Options configures the BPF programs at load time, the values are rewritten into the program constants
+type Options struct {
+	Port        uint16        // Gossip port redirected to the AF_XDP socket (default: 8000)
+	Ports       []uint16      // Additional gossip ports redirected to the AF_XDP socket
+	DedupWindow time.Duration // Window in which a broadcast already seen is dropped by the XDP program (default: 10s)
+	Allowlist   bool          // Whether the XDP program only accepts sources added with AllowPrefix
+	RateLimit   uint64        // Packets per second accepted from a single source by the XDP program (0: no limit)
+	RateBurst   uint64        // Token bucket size of the rate limit (default: RateLimit)
+	PinPath     string        // bpffs directory where maps, programs and links are pinned and reused on restart (empty: no pinning)
+	TCPriority  uint16        // Priority of the tc filter on kernels without TCX (default: DefaultTCPriority)
+	XDPChain    string        // XDP program receiving the packets that are not for eGossip: ChainAttached or the bpffs path of a pinned program
+	Tunnels     bool          // Whether the XDP program also redirects gossip packets encapsulated in VXLAN (4789) or Geneve (6081)
 }
 
-func LoadObjects() (*BpfObjects, error) {
+// LoadObjects loads the BPF programs and maps, opts may be nil to use the default options
+func LoadObjects(opts *Options) (*BpfObjects, error) {
+	spec, err := loadBpf()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts != nil {
+		consts := map[string]interface{}{
+			"RATE_LIMIT": opts.RateLimit,
+			"RATE_BURST": opts.RateBurst,
+		}
+		if opts.Port != 0 {
+			consts["PORT"] = opts.Port
+		}
+		if opts.DedupWindow != 0 {
+			consts["DEDUP_WINDOW_NS"] = uint64(opts.DedupWindow.Nanoseconds())
+		}
+		if opts.Allowlist {
+			consts["ALLOWLIST"] = uint8(1)
+		}
+		if opts.Tunnels {
+			consts["TUNNELS"] = uint8(1)
+		}
+		if err := spec.RewriteConstants(consts); err != nil {
+			return nil, err
+		}
+	}
+
+	var pinPath string
+	if opts != nil {
+		pinPath = opts.PinPath
+	}
+
+	var collOpts ebpf.CollectionOptions
+	if pinPath != "" {
+		if err := preparePinPath(pinPath, spec); err != nil {
+			return nil, err
+		}
+		for name, m := range spec.Maps {
+			// .rodata/.bss hold the constants of this load and are never shared
+			if !strings.HasPrefix(name, ".") {
+				m.Pinning = ebpf.PinByName
+			}
+		}
+		collOpts.Maps.PinPath = pinPath
+	}
+
 	var objs bpfObjects
-	if err := loadBpfObjects(&objs, nil); err != nil {
+	err = spec.LoadAndAssign(&objs, &collOpts)
+	if errors.Is(err, ebpf.ErrMapIncompatible) {
+		// A pinned map no longer matches its spec (MapsVersion was not bumped), start over with fresh maps
+		if err := unpinMaps(pinPath, spec); err != nil {
+			return nil, err
+		}
+		err = spec.LoadAndAssign(&objs, &collOpts)
+	}
+	if err != nil {
 		var ve *ebpf.VerifierError
 		if errors.As(err, &ve) {
 			fmt.Fprintf(os.Stderr, "Verifier errors:\n%s\n", ve.Error())
@@ -70,11 +196,161 @@ func LoadObjects() (*BpfObjects, error) {
 		return nil, err
 	}
 
-	return &BpfObjects{&objs}, nil
+	if err := objs.VersionMap.Put(uint32(0), MapsVersion); err != nil {
+		objs.Close()
+		return nil, err
+	}
+
+	if opts != nil {
+		if err := setPorts(objs.PortsMap, opts.Ports); err != nil {
+			objs.Close()
+			return nil, err
+		}
+	}
+
+	if pinPath != "" {
+		// Programs are pinned for inspection and cleanup, a pin left by the previous daemon is replaced
+		for name, prog := range map[string]*ebpf.Program{
+			"fastbroadcast": objs.Fastbroadcast,
+			"xdp_sock_prog": objs.XdpSockProg,
+		} {
+			path := filepath.Join(pinPath, name)
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				objs.Close()
+				return nil, err
+			}
+			if err := prog.Pin(path); err != nil {
+				objs.Close()
+				return nil, err
+			}
+		}
+	}
+
+	BpfObjs := &BpfObjects{objs: &objs, pinPath: pinPath, links: map[string]link.Link{}, tcPriority: DefaultTCPriority,
+		allowed: map[netip.Prefix]int{}}
+	if opts != nil {
+		if opts.TCPriority != 0 {
+			BpfObjs.tcPriority = opts.TCPriority
+		}
+		BpfObjs.xdpChain = opts.XDPChain
+	}
+	return BpfObjs, nil
+}
+
+// preparePinPath creates the pin directory and removes the pinned maps of an incompatible MapsVersion
+func preparePinPath(pinPath string, spec *ebpf.CollectionSpec) error {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(filepath.Dir(pinPath), &fs); err != nil {
+		return err
+	}
+	if fs.Type != unix.BPF_FS_MAGIC {
+		return fmt.Errorf("%s is not on a bpf filesystem", pinPath)
+	}
+	if err := os.MkdirAll(pinPath, 0o700); err != nil {
+		return err
+	}
+
+	m, err := ebpf.LoadPinnedMap(filepath.Join(pinPath, "version_map"), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	var version uint64
+	if err := m.Lookup(uint32(0), &version); err != nil {
+		return err
+	}
+	if version == MapsVersion {
+		return nil
+	}
+	return unpinMaps(pinPath, spec)
+}
+
+// unpinMaps removes the maps of spec pinned under pinPath
+func unpinMaps(pinPath string, spec *ebpf.CollectionSpec) error {
+	for name := range spec.Maps {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(pinPath, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// setPorts makes ports_map hold exactly the given ports, a reused map may still hold the ports of a previous configuration
+func setPorts(m *ebpf.Map, ports []uint16) error {
+	want := make(map[uint16]bool, len(ports))
+	for _, port := range ports {
+		want[port] = true
+	}
+
+	var (
+		port  uint16
+		value uint8
+		stale []uint16
+	)
+	iter := m.Iterate()
+	for iter.Next(&port, &value) {
+		if !want[port] {
+			stale = append(stale, port)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	for _, port := range stale {
+		if err := m.Delete(port); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			return err
+		}
+	}
+
+	for _, port := range ports {
+		if err := m.Put(port, uint8(1)); err != nil {
+			return fmt.Errorf("port %d: %w", port, err)
+		}
+	}
+	return nil
+}
+
+// AddPort redirects an additional gossip port to the AF_XDP socket, e.g. the port of a cluster created at runtime
+func AddPort(BpfObjs *BpfObjects, port uint16) error {
+	if err := BpfObjs.objs.PortsMap.Put(port, uint8(1)); err != nil {
+		return fmt.Errorf("port %d: %w", port, err)
+	}
+	return nil
+}
+
+// RemovePort stops redirecting a port added with AddPort
+func RemovePort(BpfObjs *BpfObjects, port uint16) error {
+	if err := BpfObjs.objs.PortsMap.Delete(port); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// tcFilterName is the name of the TC filter of a link, used to tell it apart from the filters of other software
+func tcFilterName(ifName string) string {
+	return fmt.Sprintf("%s-%s", "fastboradcast_prog", ifName)
 }
 
+// AttachTC attaches the TC program to the egress of an interface, at the head of the TCX links where the kernel supports
+// TCX and as a tc filter (clsact qdisc) otherwise. Other programs of the hook keep running after it
 func AttachTC(BpfObjs *BpfObjects, link netlink.Link) error {
-	if err := replaceQdisc(link); err != nil {
+	err := attachTCX(BpfObjs, link.Attrs().Index)
+	if err == nil {
+		// A tc filter attached by a daemon running on an older kernel would clone the packets a second time
+		return RemoveTC(link.Attrs().Name, netlink.HANDLE_MIN_EGRESS)
+	}
+	if !errors.Is(err, ebpf.ErrNotSupported) {
+		return err
+	}
+
+	if err := ensureClsact(link); err != nil {
 		return err
 	}
 
@@ -82,12 +358,12 @@ func AttachTC(BpfObjs *BpfObjects, link netlink.Link) error {
 		FilterAttrs: netlink.FilterAttrs{
 			LinkIndex: link.Attrs().Index,
 			Parent:    netlink.HANDLE_MIN_EGRESS,
-			Handle:    1,
+			Handle:    tcHandle,
 			Protocol:  unix.ETH_P_ALL,
-			Priority:  option.Config.TCFilterPriority,
+			Priority:  BpfObjs.tcPriority,
 		},
 		Fd:           BpfObjs.objs.Fastbroadcast.FD(),
-		Name:         fmt.Sprintf("%s-%s", "fastboradcast_prog", link.Attrs().Name),
+		Name:         tcFilterName(link.Attrs().Name),
 		DirectAction: true,
 	}
 
@@ -98,6 +374,7 @@ func AttachTC(BpfObjs *BpfObjects, link netlink.Link) error {
 	return nil
 }
 
+// RemoveTC deletes the eGossip filter of a link, filters of other software (e.g. Cilium) are left untouched
 func RemoveTC(ifName string, tcDir uint32) error {
 	link, err := netlink.LinkByName(ifName)
 	if err != nil {
@@ -110,6 +387,11 @@ func RemoveTC(ifName string, tcDir uint32) error {
 	}
 
 	for _, f := range filters {
+		bf, ok := f.(*netlink.BpfFilter)
+		// Handle 1 was used by older daemons
+		if !ok || bf.Name != tcFilterName(ifName) || (bf.Handle != tcHandle && bf.Handle != 1) {
+			continue
+		}
 		if err := netlink.FilterDel(f); err != nil {
 			return err
 		}
@@ -118,22 +400,173 @@ func RemoveTC(ifName string, tcDir uint32) error {
 	return nil
 }
 
+// attachTCX attaches the TC program at the head of the TCX egress links of an interface
+func attachTCX(BpfObjs *BpfObjects, Ifindex int) error {
+	prog := BpfObjs.objs.Fastbroadcast
+	return attachLink(BpfObjs, fmt.Sprintf("link_tcx_%d", Ifindex), prog, func() (link.Link, error) {
+		return link.AttachTCX(link.TCXOptions{
+			Interface: Ifindex,
+			Program:   prog,
+			Attach:    ebpf.AttachTCXEgress,
+			Anchor:    link.Head(),
+		})
+	})
+}
+
+// AttachXDP attaches the XDP program to an interface through a bpf_link, after chaining the program set by Options.XDPChain
 func AttachXDP(BpfObjs *BpfObjects, Ifindex int) (*xdp.Program, error) {
-	// Create XDP program
-	p := &xdp.Program{Program: BpfObjs.objs.bpfPrograms.XdpSockProg,
+	prog := BpfObjs.objs.bpfPrograms.XdpSockProg
+
+	switch BpfObjs.xdpChain {
+	case "":
+	case ChainAttached:
+		if BpfObjs.pinPath == "" {
+			return nil, errors.New("chain the attached XDP program: a pin path is required to restore it on detach")
+		}
+		if err := adoptXDP(BpfObjs, Ifindex); err != nil {
+			return nil, fmt.Errorf("chain the attached XDP program: %w", err)
+		}
+	default:
+		chained, err := ebpf.LoadPinnedProgram(BpfObjs.xdpChain, nil)
+		if err != nil {
+			return nil, fmt.Errorf("chain XDP program %s: %w", BpfObjs.xdpChain, err)
+		}
+		err = ChainXDP(BpfObjs, chained)
+		chained.Close()
+		if err != nil {
+			return nil, fmt.Errorf("chain XDP program %s: %w", BpfObjs.xdpChain, err)
+		}
+	}
+
+	err := attachLink(BpfObjs, fmt.Sprintf("link_xdp_%d", Ifindex), prog, func() (link.Link, error) {
+		return link.AttachXDP(link.XDPOptions{Program: prog, Interface: Ifindex})
+	})
+	if err != nil {
+		return nil, errors.Join(err, restoreXDP(BpfObjs.pinPath, Ifindex))
+	}
+
+	// The AF_XDP socket registration of the program wrapper is used, its Attach/Close (netlink based) are not
+	return &xdp.Program{Program: prog,
 		Queues:  BpfObjs.objs.bpfMaps.QidconfMap,
-		Sockets: BpfObjs.objs.bpfMaps.XsksMap}
+		Sockets: BpfObjs.objs.bpfMaps.XsksMap}, nil
+}
 
-	// Attach XDP program to interface
-	if err := p.Attach(Ifindex); err != nil {
-		fmt.Printf("error: failed to attach xdp program to interface: %v\n", err)
-		return nil, err
+// attachLink attaches a program through a bpf_link. With a pin path the link is pinned under name and outlives the daemon,
+// a link pinned by a previous daemon is updated in place so the hook is never left without the program
+func attachLink(BpfObjs *BpfObjects, name string, prog *ebpf.Program, attach func() (link.Link, error)) error {
+	if BpfObjs.pinPath == "" {
+		l, err := attach()
+		if err != nil {
+			return err
+		}
+		BpfObjs.links[name] = l
+		return nil
+	}
+
+	path := filepath.Join(BpfObjs.pinPath, name)
+	pinned, err := link.LoadPinnedLink(path, nil)
+	if err == nil {
+		if err := pinned.Update(prog); err == nil {
+			BpfObjs.links[name] = pinned
+			return nil
+		}
+		// The link is defunct (e.g. the interface was recreated), attach a new one
+		pinned.Unpin()
+		pinned.Close()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	l, err := attach()
+	if err != nil {
+		return err
+	}
+	if err := l.Pin(path); err != nil {
+		l.Close()
+		return err
+	}
+	BpfObjs.links[name] = l
+	return nil
+}
+
+// DetachXDP detaches the XDP program from an interface, including a link pinned by this or a previous daemon, and
+// reattaches the program adopted from other software (Options.XDPChain)
+func DetachXDP(BpfObjs *BpfObjects, Ifindex int) error {
+	name := fmt.Sprintf("link_xdp_%d", Ifindex)
+	l, ok := BpfObjs.links[name]
+	if !ok {
+		// A link pinned by a previous daemon
+		if BpfObjs.pinPath != "" {
+			if err := unpinLink(filepath.Join(BpfObjs.pinPath, name)); err != nil {
+				return err
+			}
+		}
+		return restoreXDP(BpfObjs.pinPath, Ifindex)
+	}
+	delete(BpfObjs.links, name)
+
+	if BpfObjs.pinPath != "" {
+		if err := l.Unpin(); err != nil {
+			l.Close()
+			return err
+		}
+	}
+	if err := l.Close(); err != nil {
+		return err
+	}
+	return restoreXDP(BpfObjs.pinPath, Ifindex)
+}
+
+// ChainXDP hands the packets that are not for eGossip to prog, an XDP program run through a tail call
+func ChainXDP(BpfObjs *BpfObjects, prog *ebpf.Program) error {
+	return BpfObjs.objs.XdpChain.Put(uint32(0), prog)
+}
+
+// adoptXDP chains the XDP program attached to an interface by other software and detaches it, so that the eGossip
+// program can be attached in its place. The program is pinned and its attach mode recorded, DetachXDP and Cleanup
+// reattach it. Programs attached through a bpf_link cannot be adopted
+func adoptXDP(BpfObjs *BpfObjects, Ifindex int) error {
+	l, err := netlink.LinkByIndex(Ifindex)
+	if err != nil {
+		return err
+	}
+	x := l.Attrs().Xdp
+	if x == nil || !x.Attached || x.ProgId == 0 {
+		return nil
+	}
+
+	prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(x.ProgId))
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	info, err := prog.Info()
+	if err != nil {
+		return err
+	}
+	if info.Name == "xdp_sock_prog" {
+		// Already ours (pinned link of a previous daemon), the program it chained is still in xdp_chain
+		return nil
 	}
 
-	return p, nil
+	flags := xdpModeFlags(x.AttachMode)
+	if err := recordAdopted(BpfObjs.pinPath, Ifindex, prog, flags); err != nil {
+		return err
+	}
+	if err := ChainXDP(BpfObjs, prog); err != nil {
+		forgetAdopted(BpfObjs.pinPath, Ifindex)
+		return err
+	}
+	// Without the mode flags, the program of another mode (e.g. generic) would be left attached
+	if err := netlink.LinkSetXdpFdWithFlags(l, -1, flags); err != nil {
+		forgetAdopted(BpfObjs.pinPath, Ifindex)
+		return err
+	}
+	return nil
 }
 
-func TcPushtoMap(BpfObjs *BpfObjects, key uint16, targets []common.Node) error {
+// TcPushtoMap stores the targets of a broadcast under key, next is the key of the chained entry holding the following targets (0 if none)
+func TcPushtoMap(BpfObjs *BpfObjects, key uint16, next uint16, targets []common.Node) error {
 	mapRef := BpfObjs.objs.TargetsMap
 	var value bpfTargets
 
@@ -148,13 +581,13 @@ func TcPushtoMap(BpfObjs *BpfObjects, key uint16, targets []common.Node) error {
 		return fmt.Errorf("too many targets: %d", targetCount)
 	}
 
-	value.MaxCount = uint16('0' + targetCount - 1)
+	value.MaxCount = uint16(targetCount)
+	value.Next = next
 
 	i := 0
 
 	for _, v := range targets {
 		if i >= MAX_TARGETS {
-			log.Fatalf("too many targets: %d", i)
 			break
 		}
 
@@ -165,8 +598,159 @@ func TcPushtoMap(BpfObjs *BpfObjects, key uint16, targets []common.Node) error {
 		i++
 	}
 
-	if err := mapRef.Put(key, value); err != nil {
+	// Never overwrite the targets of a broadcast still in flight (the key counter may have wrapped around)
+	if err := mapRef.Update(key, value, ebpf.UpdateNoExist); err != nil {
+		if errors.Is(err, ebpf.ErrKeyExist) {
+			return fmt.Errorf("key %d: %w", key, ErrTargetsKeyInUse)
+		}
+		if errors.Is(err, unix.E2BIG) {
+			return fmt.Errorf("key %d: %w", key, ErrTargetsMapFull)
+		}
 		return err
 	}
 	return nil
 }
+
+// TcDeleteFromMap reclaims the targets_map entry of a finished broadcast
+func TcDeleteFromMap(BpfObjs *BpfObjects, key uint16) error {
+	if err := BpfObjs.objs.TargetsMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// TcClearMap deletes the targets_map entries of the keys first to last, e.g. the leftovers of a previous daemon in
+// pinned maps whose reclaim timers never fired
+func TcClearMap(BpfObjs *BpfObjects, first uint16, last uint16) error {
+	for key := int(first); key <= int(last); key++ {
+		if err := TcDeleteFromMap(BpfObjs, uint16(key)); err != nil {
+			return fmt.Errorf("key %d: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// SetMetadataVersion stores the version of the local metadata of the cluster on port in metadata_map, the XDP program drops
+// swap packets to that port that are not newer
+func SetMetadataVersion(BpfObjs *BpfObjects, port uint16, version int64) error {
+	return BpfObjs.objs.MetadataMap.Put(port, uint64(version))
+}
+
+// DeleteMetadataVersion removes the metadata version of a cluster that no longer runs on port
+func DeleteMetadataVersion(BpfObjs *BpfObjects, port uint16) error {
+	if err := BpfObjs.objs.MetadataMap.Delete(port); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SetNodelistEntry stores a node at index idx of nodelist_map
+func SetNodelistEntry(BpfObjs *BpfObjects, idx uint32, node common.Node) error {
+	if idx >= MAX_NODES {
+		return fmt.Errorf("node list index out of range: %d", idx)
+	}
+
+	value := bpfNodeInfo{
+		Ip:   common.IpToUint32(node.Addr),
+		Port: uint16(node.Port),
+		Mac:  common.MacStringToInt8Array(node.Mac),
+	}
+	return BpfObjs.objs.NodelistMap.Put(idx, value)
+}
+
+// SetNodelistLen stores the number of live nodes of nodelist_map, the TC program only picks targets among the first n entries
+func SetNodelistLen(BpfObjs *BpfObjects, n uint32) error {
+	return BpfObjs.objs.NodelistLen.Put(uint32(0), n)
+}
+
+// Indexes of the XDP counters in stats_map (must match enum xdp_stat in bpf.c)
+const (
+	statRedirected = iota
+	statDuplicate
+	statStale
+	statDenied
+	statLimited
+)
+
+// XdpStats are the counters of the XDP program, summed over all CPUs
+type XdpStats struct {
+	Redirected uint64 // Packets redirected to the AF_XDP socket
+	Duplicate  uint64 // Broadcasts dropped as already seen within the dedup window
+	Stale      uint64 // Swap packets dropped as stale
+	Denied     uint64 // Packets dropped from sources not in the allowlist
+	Limited    uint64 // Packets dropped by the rate limit of their source
+}
+
+// ReadXdpStats reads the counters of the XDP program
+func ReadXdpStats(BpfObjs *BpfObjects) (XdpStats, error) {
+	var stats XdpStats
+	for stat, value := range map[uint32]*uint64{
+		statRedirected: &stats.Redirected,
+		statDuplicate:  &stats.Duplicate,
+		statStale:      &stats.Stale,
+		statDenied:     &stats.Denied,
+		statLimited:    &stats.Limited,
+	} {
+		var perCPU []uint64
+		if err := BpfObjs.objs.StatsMap.Lookup(stat, &perCPU); err != nil {
+			return XdpStats{}, err
+		}
+		for _, v := range perCPU {
+			*value += v
+		}
+	}
+	return stats, nil
+}
+
+// AllowPrefix allows the sources of an IPv4 prefix to reach the AF_XDP socket (allowlist mode).
+// Prefixes are reference counted, as the clusters of a daemon may allow the same node
+func AllowPrefix(BpfObjs *BpfObjects, prefix netip.Prefix) error {
+	key, err := allowKey(prefix)
+	if err != nil {
+		return err
+	}
+
+	BpfObjs.allowMu.Lock()
+	defer BpfObjs.allowMu.Unlock()
+	prefix = prefix.Masked()
+	if BpfObjs.allowed[prefix] == 0 {
+		if err := BpfObjs.objs.AllowMap.Put(key, uint8(1)); err != nil {
+			return err
+		}
+	}
+	BpfObjs.allowed[prefix]++
+	return nil
+}
+
+// DenyPrefix releases an IPv4 prefix added with AllowPrefix, it is removed once no cluster allows it
+func DenyPrefix(BpfObjs *BpfObjects, prefix netip.Prefix) error {
+	key, err := allowKey(prefix)
+	if err != nil {
+		return err
+	}
+
+	BpfObjs.allowMu.Lock()
+	defer BpfObjs.allowMu.Unlock()
+	prefix = prefix.Masked()
+	if BpfObjs.allowed[prefix] > 1 {
+		BpfObjs.allowed[prefix]--
+		return nil
+	}
+	delete(BpfObjs.allowed, prefix)
+	if err := BpfObjs.objs.AllowMap.Delete(key); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// allowKey converts an IPv4 prefix into an allow_map key (address in network byte order)
+func allowKey(prefix netip.Prefix) (bpfAllowKey, error) {
+	if !prefix.Addr().Is4() {
+		return bpfAllowKey{}, fmt.Errorf("not an IPv4 prefix: %s", prefix)
+	}
+	addr := prefix.Masked().Addr().As4()
+	return bpfAllowKey{
+		Prefixlen: uint32(prefix.Bits()),
+		Addr:      binary.NativeEndian.Uint32(addr[:]),
+	}, nil
+}
@@ -1,5 +1,5 @@
 // Code generated by bpf2go; DO NOT EDIT.
-//go:build 386 || amd64 || amd64p32 || arm || arm64 || loong64 || mips64le || mips64p32le || mipsle || ppc64le || riscv64
+//go:build 386 || amd64 || arm || arm64 || loong64 || mips64le || mipsle || ppc64le || riscv64
 
 package bpf
 
@@ -12,19 +12,26 @@ import (
 	"github.com/cilium/ebpf"
 )
 
-type bpfMetadata struct {
-	Metadata   [256]int8
-	UpdateTime int64
+type bpfAllowKey struct {
+	Prefixlen uint32
+	Addr      uint32
+}
+
+type bpfBucket struct {
+	Tokens uint64
+	Last   uint64
+}
+
+type bpfNodeInfo struct {
+	Ip   uint32
+	Port uint16
+	Mac  [6]int8
 }
 
 type bpfTargets struct {
-	TargetList [64]struct {
-		Ip   uint32
-		Port uint16
-		Mac  [6]int8
-	}
-	MaxCount uint16
-	_        [2]byte
+	TargetList [64]bpfNodeInfo
+	MaxCount   uint16
+	Next       uint16
 }
 
 // loadBpf returns the embedded CollectionSpec for bpf.
@@ -76,10 +83,18 @@ type bpfProgramSpecs struct {
 //
 // It can be passed ebpf.CollectionSpec.Assign.
 type bpfMapSpecs struct {
+	AllowMap    *ebpf.MapSpec `ebpf:"allow_map"`
 	MetadataMap *ebpf.MapSpec `ebpf:"metadata_map"`
+	NodelistLen *ebpf.MapSpec `ebpf:"nodelist_len"`
 	NodelistMap *ebpf.MapSpec `ebpf:"nodelist_map"`
+	PortsMap    *ebpf.MapSpec `ebpf:"ports_map"`
 	QidconfMap  *ebpf.MapSpec `ebpf:"qidconf_map"`
+	RateMap     *ebpf.MapSpec `ebpf:"rate_map"`
+	SeenMap     *ebpf.MapSpec `ebpf:"seen_map"`
+	StatsMap    *ebpf.MapSpec `ebpf:"stats_map"`
 	TargetsMap  *ebpf.MapSpec `ebpf:"targets_map"`
+	VersionMap  *ebpf.MapSpec `ebpf:"version_map"`
+	XdpChain    *ebpf.MapSpec `ebpf:"xdp_chain"`
 	XsksMap     *ebpf.MapSpec `ebpf:"xsks_map"`
 }
 
@@ -102,19 +117,35 @@ func (o *bpfObjects) Close() error {
 //
 // It can be passed to loadBpfObjects or ebpf.CollectionSpec.LoadAndAssign.
 type bpfMaps struct {
+	AllowMap    *ebpf.Map `ebpf:"allow_map"`
 	MetadataMap *ebpf.Map `ebpf:"metadata_map"`
+	NodelistLen *ebpf.Map `ebpf:"nodelist_len"`
 	NodelistMap *ebpf.Map `ebpf:"nodelist_map"`
+	PortsMap    *ebpf.Map `ebpf:"ports_map"`
 	QidconfMap  *ebpf.Map `ebpf:"qidconf_map"`
+	RateMap     *ebpf.Map `ebpf:"rate_map"`
+	SeenMap     *ebpf.Map `ebpf:"seen_map"`
+	StatsMap    *ebpf.Map `ebpf:"stats_map"`
 	TargetsMap  *ebpf.Map `ebpf:"targets_map"`
+	VersionMap  *ebpf.Map `ebpf:"version_map"`
+	XdpChain    *ebpf.Map `ebpf:"xdp_chain"`
 	XsksMap     *ebpf.Map `ebpf:"xsks_map"`
 }
 
 func (m *bpfMaps) Close() error {
 	return _BpfClose(
+		m.AllowMap,
 		m.MetadataMap,
+		m.NodelistLen,
 		m.NodelistMap,
+		m.PortsMap,
 		m.QidconfMap,
+		m.RateMap,
+		m.SeenMap,
+		m.StatsMap,
 		m.TargetsMap,
+		m.VersionMap,
+		m.XdpChain,
 		m.XsksMap,
 	)
 }
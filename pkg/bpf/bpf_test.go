@@ -0,0 +1,1331 @@
+package bpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	common "github.com/kerwenwwer/eGossip/pkg/common"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	tcActUnspec = 0xffffffff // TC_ACT_UNSPEC (-1), handed to the next program
+	tcActShot   = 2          // TC_ACT_SHOT
+
+	xdpAborted = 0 // XDP_ABORTED
+	xdpDrop    = 1 // XDP_DROP
+	xdpPass    = 2 // XDP_PASS
+
+	testSrcPort = 47001 // UDP source port of the crafted packets, used to pick out clones
+	testTimeout = 200 * time.Millisecond
+
+	ethLen = 14
+	ipLen  = 20
+	udpLen = 8
+	hdrOff = ethLen + ipLen + udpLen // Offset of the gossip header
+)
+
+// loadTestObjects loads the compiled objects, the test is skipped without the privileges to load BPF programs
+func loadTestObjects(t *testing.T) *BpfObjects {
+	t.Helper()
+	return loadTestObjectsWith(t, nil)
+}
+
+// loadTestObjectsWith loads the compiled objects with the given options
+func loadTestObjectsWith(t *testing.T, opts *Options) *BpfObjects {
+	t.Helper()
+
+	objs, err := LoadObjects(opts)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("loading BPF programs requires CAP_BPF:", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { objs.objs.Close() })
+
+	return objs
+}
+
+// testTargets returns n broadcast targets with distinct addresses, ports and MACs
+func testTargets(n int) []common.Node {
+	targets := make([]common.Node, n)
+	for i := range targets {
+		targets[i] = common.Node{
+			Addr: fmt.Sprintf("10.1.%d.%d", i/250, i%250+1),
+			Port: 9000 + i,
+			Mac:  fmt.Sprintf("02:00:00:00:%02x:%02x", i/256, i%256),
+		}
+	}
+	return targets
+}
+
+// buildPacket crafts an Ethernet/IPv4/UDP frame carrying an encoded gossip packet
+func buildPacket(t *testing.T, p common.Packet, flags uint8, dstPort uint16) []byte {
+	t.Helper()
+
+	payload, err := common.EncodePacket(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload[3] = flags
+
+	bs := make([]byte, hdrOff, hdrOff+len(payload))
+
+	// Ethernet
+	copy(bs[0:6], []byte{0x02, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(bs[6:12], []byte{0x02, 0xee, 0xee, 0xee, 0xee, 0xee})
+	binary.BigEndian.PutUint16(bs[12:14], unix.ETH_P_IP)
+
+	// IPv4
+	ip := bs[ethLen : ethLen+ipLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen+udpLen+len(payload)))
+	ip[8] = 64
+	ip[9] = unix.IPPROTO_UDP
+	copy(ip[12:16], net.IPv4(10, 0, 0, 1).To4())
+	copy(ip[16:20], net.IPv4(10, 0, 0, 2).To4())
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+
+	// UDP
+	udp := bs[ethLen+ipLen : hdrOff]
+	binary.BigEndian.PutUint16(udp[0:2], testSrcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen+len(payload)))
+
+	bs = append(bs, payload...)
+	binary.BigEndian.PutUint16(bs[ethLen+ipLen+6:hdrOff], udpChecksum(bs))
+
+	return bs
+}
+
+// ipChecksum computes the IPv4 header checksum, it is 0 for a header with a valid checksum
+func ipChecksum(ip []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(ip); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(ip[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// udpChecksum computes the UDP checksum of a frame (including the pseudo header), it is 0 for a datagram with a valid checksum
+func udpChecksum(frame []byte) uint16 {
+	ip := frame[ethLen : ethLen+ipLen]
+	udp := frame[ethLen+ipLen:]
+
+	pseudo := make([]byte, 12, 12+len(udp)+1)
+	copy(pseudo[0:8], ip[12:20])
+	pseudo[9] = unix.IPPROTO_UDP
+	binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(udp)))
+	pseudo = append(pseudo, udp...)
+	if len(pseudo)%2 == 1 {
+		pseudo = append(pseudo, 0)
+	}
+
+	return ipChecksum(pseudo)
+}
+
+// assertTarget checks that a frame is addressed to target and carries count in the gossip header
+func assertTarget(t *testing.T, frame []byte, target common.Node, count uint16) {
+	t.Helper()
+
+	if len(frame) < hdrOff+common.HeaderSize {
+		t.Fatalf("frame too short: %d bytes", len(frame))
+	}
+
+	mac, _ := net.ParseMAC(target.Mac)
+	if !bytes.Equal(frame[0:6], mac) {
+		t.Errorf("dest MAC = %v, want %v", net.HardwareAddr(frame[0:6]), mac)
+	}
+
+	ip := frame[ethLen : ethLen+ipLen]
+	if got := net.IP(ip[16:20]).String(); got != target.Addr {
+		t.Errorf("dest IP = %s, want %s", got, target.Addr)
+	}
+	if sum := ipChecksum(ip); sum != 0 {
+		t.Errorf("invalid IP checksum %#04x", binary.BigEndian.Uint16(ip[10:12]))
+	}
+
+	udp := frame[ethLen+ipLen : hdrOff]
+	if got := binary.BigEndian.Uint16(udp[2:4]); got != uint16(target.Port) {
+		t.Errorf("dest port = %d, want %d", got, target.Port)
+	}
+	if binary.BigEndian.Uint16(udp[6:8]) == 0 {
+		t.Errorf("UDP checksum zeroed")
+	} else if sum := udpChecksum(frame); sum != 0 {
+		t.Errorf("invalid UDP checksum %#04x", binary.BigEndian.Uint16(udp[6:8]))
+	}
+
+	hdr := frame[hdrOff:]
+	if hdr[3]&common.FlagCloned == 0 {
+		t.Errorf("cloned flag not set")
+	}
+	if got := binary.BigEndian.Uint16(hdr[4:6]); got != count {
+		t.Errorf("count = %d, want %d", got, count)
+	}
+}
+
+// captureClones opens a packet socket on the loopback interface, the clones of a test run are redirected to it
+func captureClones(t *testing.T) int {
+	t.Helper()
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		t.Skip("capturing clones requires CAP_NET_RAW:", err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: lo.Index}); err != nil {
+		t.Fatal(err)
+	}
+	tv := unix.NsecToTimeval(testTimeout.Nanoseconds())
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		t.Fatal(err)
+	}
+
+	return fd
+}
+
+// readClones reads the clones sent by the program (outgoing gossip frames of the test source port) until the socket times out
+func readClones(t *testing.T, fd int) [][]byte {
+	t.Helper()
+	return readClonesWith(t, fd, func(frame []byte) []byte { return frame })
+}
+
+// readClonesWith reads the clones like readClones, normalize turns a captured frame into an untagged frame without IP
+// options (nil to skip the frame)
+func readClonesWith(t *testing.T, fd int, normalize func([]byte) []byte) [][]byte {
+	t.Helper()
+
+	var clones [][]byte
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := unix.Recvfrom(fd, buf, 0)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			return clones
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ll, ok := from.(*unix.SockaddrLinklayer); !ok || ll.Pkttype != unix.PACKET_OUTGOING {
+			continue
+		}
+		frame := normalize(append([]byte(nil), buf[:n]...))
+		if len(frame) < hdrOff+common.HeaderSize ||
+			binary.BigEndian.Uint16(frame[ethLen+ipLen:ethLen+ipLen+2]) != testSrcPort ||
+			binary.BigEndian.Uint16(frame[hdrOff:hdrOff+2]) != common.HeaderMagic {
+			continue
+		}
+		clones = append(clones, frame)
+	}
+}
+
+// tagFrame inserts VLAN tags (outermost first) after the MAC addresses and optWords words of IP options (NOPs) into a
+// frame built by buildPacket, the UDP checksum does not cover either
+func tagFrame(frame []byte, optWords int, tpids ...uint16) []byte {
+	bs := append([]byte(nil), frame[:12]...)
+	for _, tpid := range tpids {
+		bs = binary.BigEndian.AppendUint16(bs, tpid)
+		bs = binary.BigEndian.AppendUint16(bs, 100) // VLAN ID
+	}
+	bs = append(bs, frame[12:ethLen]...)
+
+	ip := append([]byte(nil), frame[ethLen:ethLen+ipLen]...)
+	ip[0] = 0x45 + byte(optWords)
+	binary.BigEndian.PutUint16(ip[2:4], binary.BigEndian.Uint16(ip[2:4])+uint16(4*optWords))
+	ip = append(ip, bytes.Repeat([]byte{1}, 4*optWords)...) // IPOPT_NOOP
+	binary.BigEndian.PutUint16(ip[10:12], 0)
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+
+	bs = append(bs, ip...)
+	return append(bs, frame[ethLen+ipLen:]...)
+}
+
+// untagFrame reverses tagFrame after checking the IP checksum, nil if the frame does not start with the given number
+// of VLAN tags
+func untagFrame(t *testing.T, frame []byte, optWords int, tags int) []byte {
+	t.Helper()
+
+	l3 := ethLen + 4*tags
+	if len(frame) < l3+ipLen+4*optWords || binary.BigEndian.Uint16(frame[l3-2:l3]) != unix.ETH_P_IP ||
+		int(frame[l3]&0x0f) != 5+optWords {
+		return nil
+	}
+	ip := frame[l3 : l3+ipLen+4*optWords]
+	if sum := ipChecksum(ip); sum != 0 {
+		t.Errorf("invalid IP checksum %#04x", binary.BigEndian.Uint16(ip[10:12]))
+	}
+
+	bs := append([]byte(nil), frame[:12]...)
+	bs = append(bs, frame[l3-2:l3]...)
+
+	plain := append([]byte(nil), ip[:ipLen]...)
+	plain[0] = 0x45
+	binary.BigEndian.PutUint16(plain[2:4], binary.BigEndian.Uint16(plain[2:4])-uint16(4*optWords))
+	binary.BigEndian.PutUint16(plain[10:12], 0)
+	binary.BigEndian.PutUint16(plain[10:12], ipChecksum(plain))
+
+	bs = append(bs, plain...)
+	return append(bs, frame[l3+len(ip):]...)
+}
+
+// tunnelFrame encapsulates a frame in an outer Ethernet/IPv4/UDP datagram to dstPort (VXLAN or Geneve, by port) with
+// optWords words of Geneve options
+func tunnelFrame(frame []byte, dstPort uint16, optWords int) []byte {
+	var tunnel []byte
+	if dstPort == 4789 {
+		tunnel = []byte{0x08, 0, 0, 0, 0, 0, 42, 0} // I flag, VNI 42
+	} else {
+		tunnel = []byte{byte(optWords), 0, 0x65, 0x58, 0, 0, 42, 0} // Version 0, Transparent Ethernet Bridging, VNI 42
+		tunnel = append(tunnel, make([]byte, 4*optWords)...)
+	}
+	payload := append(tunnel, frame...)
+
+	bs := make([]byte, hdrOff, hdrOff+len(payload))
+	copy(bs[0:12], frame[0:12])
+	binary.BigEndian.PutUint16(bs[12:14], unix.ETH_P_IP)
+
+	ip := bs[ethLen : ethLen+ipLen]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(ipLen+udpLen+len(payload)))
+	ip[8] = 64
+	ip[9] = unix.IPPROTO_UDP
+	copy(ip[12:16], net.IPv4(192, 168, 0, 1).To4())
+	copy(ip[16:20], net.IPv4(192, 168, 0, 2).To4())
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+
+	// The outer UDP checksum is left at 0, as tunnel endpoints commonly do
+	udp := bs[ethLen+ipLen : hdrOff]
+	binary.BigEndian.PutUint16(udp[0:2], testSrcPort)
+	binary.BigEndian.PutUint16(udp[2:4], dstPort)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen+len(payload)))
+
+	return append(bs, payload...)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// runProgram runs a program once on a frame and returns its verdict and output frame
+func runProgram(t *testing.T, prog *ebpf.Program, frame []byte) (uint32, []byte) {
+	t.Helper()
+
+	out := make([]byte, len(frame)+256)
+	ret, err := prog.Run(&ebpf.RunOptions{Data: frame, DataOut: out})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ret, out[:len(frame)]
+}
+
+func TestFastbroadcastRewrite(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	for _, n := range []int{1, 3, MAX_TARGETS} {
+		t.Run(fmt.Sprintf("targets=%d", n), func(t *testing.T) {
+			key := uint16(100 + n)
+			targets := testTargets(n)
+			if err := TcPushtoMap(objs, key, 0, targets); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { TcDeleteFromMap(objs, key) })
+
+			fd := captureClones(t)
+			frame := buildPacket(t, common.Packet{Type: 1, Mapkey: key}, 0, 8000)
+
+			ret, out := runProgram(t, objs.objs.Fastbroadcast, frame)
+			if ret != tcActUnspec {
+				t.Fatalf("verdict = %d, want TC_ACT_UNSPEC", ret)
+			}
+
+			// The original packet goes to the last target
+			assertTarget(t, out, targets[n-1], uint16(n-1))
+
+			// Every other target gets a clone, in order
+			clones := readClones(t, fd)
+			if len(clones) != n-1 {
+				t.Fatalf("got %d clones, want %d", len(clones), n-1)
+			}
+			for i, clone := range clones {
+				assertTarget(t, clone, targets[i], uint16(i))
+			}
+		})
+	}
+}
+
+func TestFastbroadcastChain(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	// Two chained entries, the head key is pushed last as in pushTargets
+	targets := testTargets(MAX_TARGETS + 2)
+	const head, tail = 200, 201
+	if err := TcPushtoMap(objs, tail, 0, targets[MAX_TARGETS:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := TcPushtoMap(objs, head, tail, targets[:MAX_TARGETS]); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		TcDeleteFromMap(objs, head)
+		TcDeleteFromMap(objs, tail)
+	})
+
+	fd := captureClones(t)
+	frame := buildPacket(t, common.Packet{Type: 1, Mapkey: head}, 0, 8000)
+
+	ret, out := runProgram(t, objs.objs.Fastbroadcast, frame)
+	if ret != tcActUnspec {
+		t.Fatalf("verdict = %d, want TC_ACT_UNSPEC", ret)
+	}
+	assertTarget(t, out, targets[len(targets)-1], uint16(len(targets)-1))
+
+	clones := readClones(t, fd)
+	if len(clones) != len(targets)-1 {
+		t.Fatalf("got %d clones, want %d", len(clones), len(targets)-1)
+	}
+	for i, clone := range clones {
+		assertTarget(t, clone, targets[i], uint16(i))
+	}
+}
+
+func TestFastbroadcastNodelist(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	nodes := testTargets(5)
+	for i, node := range nodes {
+		if err := SetNodelistEntry(objs, uint32(i), node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := SetNodelistLen(objs, uint32(len(nodes))); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		start uint16
+		count uint16
+		want  []common.Node
+	}{
+		{"window", 1, 3, nodes[1:4]},
+		{"wrap around", 3, 3, []common.Node{nodes[3], nodes[4], nodes[0]}},
+		{"larger than list", 2, 8, []common.Node{nodes[2], nodes[3], nodes[4], nodes[0], nodes[1]}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := captureClones(t)
+			frame := buildPacket(t, common.Packet{Type: 1, Mapkey: tt.start, Count: tt.count}, common.FlagNodeList, 8000)
+
+			ret, out := runProgram(t, objs.objs.Fastbroadcast, frame)
+			if ret != tcActUnspec {
+				t.Fatalf("verdict = %d, want TC_ACT_UNSPEC", ret)
+			}
+			last := len(tt.want) - 1
+			assertTarget(t, out, tt.want[last], uint16(last))
+
+			clones := readClones(t, fd)
+			if len(clones) != last {
+				t.Fatalf("got %d clones, want %d", len(clones), last)
+			}
+			for i, clone := range clones {
+				assertTarget(t, clone, tt.want[i], uint16(i))
+			}
+		})
+	}
+
+	// An empty node list drops the broadcast
+	if err := SetNodelistLen(objs, 0); err != nil {
+		t.Fatal(err)
+	}
+	frame := buildPacket(t, common.Packet{Type: 1, Count: 3}, common.FlagNodeList, 8000)
+	if ret, _ := runProgram(t, objs.objs.Fastbroadcast, frame); ret != tcActShot {
+		t.Fatalf("empty node list: verdict = %d, want TC_ACT_SHOT", ret)
+	}
+}
+
+func TestFastbroadcastZeroChecksum(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	const key = 250
+	targets := testTargets(2)
+	if err := TcPushtoMap(objs, key, 0, targets); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { TcDeleteFromMap(objs, key) })
+
+	// A zero UDP checksum means no checksum (IPv4), it must stay zero
+	frame := buildPacket(t, common.Packet{Type: 1, Mapkey: key}, 0, 8000)
+	binary.BigEndian.PutUint16(frame[ethLen+ipLen+6:hdrOff], 0)
+
+	ret, out := runProgram(t, objs.objs.Fastbroadcast, frame)
+	if ret != tcActUnspec {
+		t.Fatalf("verdict = %d, want TC_ACT_UNSPEC", ret)
+	}
+	if got := binary.BigEndian.Uint16(out[ethLen+ipLen+6 : hdrOff]); got != 0 {
+		t.Errorf("UDP checksum = %#04x, want 0", got)
+	}
+	if sum := ipChecksum(out[ethLen : ethLen+ipLen]); sum != 0 {
+		t.Errorf("invalid IP checksum")
+	}
+}
+
+func TestFastbroadcastPassthrough(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	const key = 300
+	if err := TcPushtoMap(objs, key, 0, testTargets(2)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { TcDeleteFromMap(objs, key) })
+
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"swap request", buildPacket(t, common.Packet{Type: 2, Mapkey: key}, 0, 8000)},
+		{"swap response", buildPacket(t, common.Packet{Type: 3, Mapkey: key}, 0, 8000)},
+		{"already cloned", buildPacket(t, common.Packet{Type: 1, Mapkey: key}, common.FlagCloned, 8000)},
+		{"no targets", buildPacket(t, common.Packet{Type: 1, Mapkey: key + 1}, 0, 8000)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fd := captureClones(t)
+
+			ret, out := runProgram(t, objs.objs.Fastbroadcast, tt.frame)
+			if ret != tcActUnspec {
+				t.Fatalf("verdict = %d, want TC_ACT_UNSPEC", ret)
+			}
+			if !bytes.Equal(out, tt.frame) {
+				t.Errorf("packet modified")
+			}
+			if clones := readClones(t, fd); len(clones) != 0 {
+				t.Errorf("got %d clones, want 0", len(clones))
+			}
+		})
+	}
+}
+
+func TestFastbroadcastNoTarget(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	// An entry without any valid target drops the broadcast
+	const key = 400
+	if err := TcPushtoMap(objs, key, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { TcDeleteFromMap(objs, key) })
+
+	frame := buildPacket(t, common.Packet{Type: 1, Mapkey: key}, 0, 8000)
+	if ret, _ := runProgram(t, objs.objs.Fastbroadcast, frame); ret != tcActShot {
+		t.Fatalf("verdict = %d, want TC_ACT_SHOT", ret)
+	}
+}
+
+func TestTcClearMap(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	// Leftovers in the range 1100-1999 are deleted, the keys of other ranges are kept
+	keys := []uint16{1100, 1500, 1999, 999, 2100}
+	for _, key := range keys {
+		if err := TcPushtoMap(objs, key, 0, testTargets(1)); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { TcDeleteFromMap(objs, key) })
+	}
+	if err := TcClearMap(objs, 1100, 1999); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		var value bpfTargets
+		err := objs.objs.TargetsMap.Lookup(key, &value)
+		if kept := key < 1100 || key > 1999; kept != (err == nil) {
+			t.Errorf("key %d: lookup error %v, want kept %v", key, err, kept)
+		}
+	}
+}
+
+func TestXdpSockProg(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	gossip := buildPacket(t, common.Packet{Type: 1}, 0, 8000)
+	otherPort := buildPacket(t, common.Packet{Type: 1}, 0, 8001)
+	tcp := append([]byte(nil), gossip...)
+	tcp[ethLen+9] = unix.IPPROTO_TCP
+
+	// Without a socket bound to the queue every packet goes to the kernel
+	for _, frame := range [][]byte{gossip, otherPort, tcp} {
+		if ret, _ := runProgram(t, objs.objs.XdpSockProg, frame); ret != xdpPass {
+			t.Fatalf("verdict = %d, want XDP_PASS", ret)
+		}
+	}
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Gossip packets are redirected to the socket map, which is empty here so
+	// bpf_redirect_map returns XDP_ABORTED, anything else goes to the kernel
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, gossip); ret != xdpAborted {
+		t.Errorf("gossip packet: verdict = %d, want XDP_ABORTED (redirect)", ret)
+	}
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, otherPort); ret != xdpPass {
+		t.Errorf("other port: verdict = %d, want XDP_PASS", ret)
+	}
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, tcp); ret != xdpPass {
+		t.Errorf("tcp packet: verdict = %d, want XDP_PASS", ret)
+	}
+}
+
+func TestXdpStaleMetadata(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMetadataVersion(objs, 8000, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		typ     uint8
+		version int64
+		flags   uint8
+		want    uint32
+	}{
+		{"response same", 3, 100, 0, xdpDrop},
+		{"response older", 3, 50, 0, xdpDrop},
+		{"response newer", 3, 101, 0, xdpAborted},
+		{"request same", 2, 100, 0, xdpDrop},
+		{"request older", 2, 50, 0, xdpAborted},
+		{"request newer", 2, 101, 0, xdpAborted},
+		{"response with updates", 3, 50, common.FlagUpdates, xdpAborted},
+		{"request measuring rtt", 2, 100, common.FlagRTT, xdpAborted},
+		{"heartbeat", 1, 50, 0, xdpAborted},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := common.Packet{Type: tt.typ, Metadata: common.Metadata{Update: tt.version}}
+			frame := buildPacket(t, p, tt.flags, 8000)
+
+			// XDP_ABORTED: redirected to the (empty) socket map
+			if ret, _ := runProgram(t, objs.objs.XdpSockProg, frame); ret != tt.want {
+				t.Errorf("verdict = %d, want %d", ret, tt.want)
+			}
+		})
+	}
+
+	// Each cluster has the metadata version of its own port
+	if err := AddPort(objs, 9100); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetMetadataVersion(objs, 9100, 200); err != nil {
+		t.Fatal(err)
+	}
+	p := common.Packet{Type: 3, Metadata: common.Metadata{Update: 150}}
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, buildPacket(t, p, 0, 9100)); ret != xdpDrop {
+		t.Errorf("other cluster, response older: verdict = %d, want XDP_DROP", ret)
+	}
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, buildPacket(t, p, 0, 8000)); ret != xdpAborted {
+		t.Errorf("default cluster, response newer: verdict = %d, want XDP_ABORTED", ret)
+	}
+
+	if err := DeleteMetadataVersion(objs, 9100); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemovePort(objs, 9100); err != nil {
+		t.Fatal(err)
+	}
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, buildPacket(t, p, 0, 9100)); ret != xdpPass {
+		t.Errorf("removed cluster: verdict = %d, want XDP_PASS", ret)
+	}
+}
+
+func TestXdpDuplicate(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	first := buildPacket(t, common.Packet{Type: 1, Node: common.Node{ID: "a"}, Time: 1}, 0, 8000)
+	forward := buildPacket(t, common.Packet{Type: 1, Node: common.Node{ID: "a"}, Time: 1, TTL: 3}, 0, 8000)
+	next := buildPacket(t, common.Packet{Type: 1, Node: common.Node{ID: "a"}, Time: 2}, 0, 8000)
+	swap := buildPacket(t, common.Packet{Type: 3, Node: common.Node{ID: "a"}, Time: 1, Metadata: common.Metadata{Update: 1}}, 0, 8000)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  uint32
+	}{
+		{"first copy", first, xdpAborted},
+		{"same copy", first, xdpDrop},
+		{"forwarded copy", forward, xdpDrop},
+		{"next heartbeat", next, xdpAborted},
+		{"swap response", swap, xdpAborted},
+		{"swap response again", swap, xdpAborted},
+	}
+
+	// XDP_ABORTED: redirected to the (empty) socket map
+	for _, tt := range tests {
+		if ret, _ := runProgram(t, objs.objs.XdpSockProg, tt.frame); ret != tt.want {
+			t.Errorf("%s: verdict = %d, want %d", tt.name, ret, tt.want)
+		}
+	}
+
+	stats, err := ReadXdpStats(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (XdpStats{Redirected: 4, Duplicate: 2}); stats != want {
+		t.Errorf("stats = %+v, want %+v", stats, want)
+	}
+}
+
+func TestXdpAllowlist(t *testing.T) {
+	objs := loadTestObjectsWith(t, &Options{Allowlist: true})
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The crafted packets come from 10.0.0.1
+	frame := buildPacket(t, common.Packet{Type: 1}, 0, 8000)
+
+	steps := []struct {
+		name  string
+		allow []string
+		deny  []string
+		want  uint32
+	}{
+		{"unknown source", nil, nil, xdpDrop},
+		{"other node", []string{"10.0.0.9/32"}, nil, xdpDrop},
+		{"node address", []string{"10.0.0.1/32"}, nil, xdpAborted},
+		{"node removed", nil, []string{"10.0.0.1/32"}, xdpDrop},
+		{"node of two clusters", []string{"10.0.0.1/32", "10.0.0.1/32"}, []string{"10.0.0.1/32"}, xdpAborted},
+		{"node removed from both", nil, []string{"10.0.0.1/32"}, xdpDrop},
+		{"operator CIDR", []string{"10.0.0.0/24"}, nil, xdpAborted},
+	}
+
+	// XDP_ABORTED: redirected to the (empty) socket map
+	for _, step := range steps {
+		for _, p := range step.allow {
+			if err := AllowPrefix(objs, netip.MustParsePrefix(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, p := range step.deny {
+			if err := DenyPrefix(objs, netip.MustParsePrefix(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if ret, _ := runProgram(t, objs.objs.XdpSockProg, frame); ret != step.want {
+			t.Errorf("%s: verdict = %d, want %d", step.name, ret, step.want)
+		}
+	}
+
+	stats, err := ReadXdpStats(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Denied != 4 {
+		t.Errorf("denied = %d, want 4", stats.Denied)
+	}
+}
+
+func TestXdpRateLimit(t *testing.T) {
+	// One packet per second with a burst of 5, the test runs well within a second
+	objs := loadTestObjectsWith(t, &Options{RateLimit: 1, RateBurst: 5})
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := buildPacket(t, common.Packet{Type: 1}, 0, 8000)
+
+	var accepted, dropped int
+	for i := 0; i < 8; i++ {
+		ret, _ := runProgram(t, objs.objs.XdpSockProg, frame)
+		switch ret {
+		case xdpAborted: // Redirected to the (empty) socket map
+			accepted++
+		case xdpDrop:
+			dropped++
+		default:
+			t.Fatalf("verdict = %d", ret)
+		}
+	}
+	if accepted != 5 || dropped != 3 {
+		t.Errorf("accepted %d, dropped %d, want 5 and 3", accepted, dropped)
+	}
+
+	stats, err := ReadXdpStats(objs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Limited != 3 {
+		t.Errorf("limited = %d, want 3", stats.Limited)
+	}
+}
+
+func TestXdpPorts(t *testing.T) {
+	objs := loadTestObjectsWith(t, &Options{Port: 9100, Ports: []uint16{9200}})
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		port uint16
+		want uint32
+	}{
+		{9100, xdpAborted}, // Redirected to the (empty) socket map
+		{9200, xdpAborted},
+		{8000, xdpPass},
+		{9300, xdpPass},
+	}
+
+	for _, tt := range tests {
+		frame := buildPacket(t, common.Packet{Type: 1}, 0, tt.port)
+		if ret, _ := runProgram(t, objs.objs.XdpSockProg, frame); ret != tt.want {
+			t.Errorf("port %d: verdict = %d, want %d", tt.port, ret, tt.want)
+		}
+	}
+}
+
+func TestFastbroadcastVlan(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	tests := []struct {
+		name     string
+		tpids    []uint16
+		optWords int
+	}{
+		{"802.1Q", []uint16{unix.ETH_P_8021Q}, 0},
+		{"802.1ad", []uint16{unix.ETH_P_8021AD, unix.ETH_P_8021Q}, 0},
+		{"options", nil, 3},
+		{"802.1Q+options", []uint16{unix.ETH_P_8021Q}, 10},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := uint16(300 + i)
+			targets := testTargets(3)
+			if err := TcPushtoMap(objs, key, 0, targets); err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { TcDeleteFromMap(objs, key) })
+
+			fd := captureClones(t)
+			frame := tagFrame(buildPacket(t, common.Packet{Type: 1, Mapkey: key}, 0, 8000), tt.optWords, tt.tpids...)
+
+			ret, out := runProgram(t, objs.objs.Fastbroadcast, frame)
+			if ret != tcActUnspec {
+				t.Fatalf("verdict = %d, want TC_ACT_UNSPEC", ret)
+			}
+			if !bytes.Equal(out[12:12+4*len(tt.tpids)], frame[12:12+4*len(tt.tpids)]) {
+				t.Errorf("VLAN tags changed")
+			}
+			plain := untagFrame(t, out, tt.optWords, len(tt.tpids))
+			if plain == nil {
+				t.Fatal("output frame lost its tags or options")
+			}
+			assertTarget(t, plain, targets[2], 2)
+
+			clones := readClonesWith(t, fd, func(frame []byte) []byte {
+				return untagFrame(t, frame, tt.optWords, len(tt.tpids))
+			})
+			if len(clones) != 2 {
+				t.Fatalf("got %d clones, want 2", len(clones))
+			}
+			for i, clone := range clones {
+				assertTarget(t, clone, targets[i], uint16(i))
+			}
+		})
+	}
+
+	// More tags than parsed, and later fragments, are left alone
+	tripleTagged := tagFrame(buildPacket(t, common.Packet{Type: 1, Mapkey: 300}, 0, 8000), 0,
+		unix.ETH_P_8021AD, unix.ETH_P_8021Q, unix.ETH_P_8021Q)
+	fragment := buildPacket(t, common.Packet{Type: 1, Mapkey: 300}, 0, 8000)
+	binary.BigEndian.PutUint16(fragment[ethLen+6:ethLen+8], 100) // Fragment offset
+	for _, frame := range [][]byte{tripleTagged, fragment} {
+		ret, out := runProgram(t, objs.objs.Fastbroadcast, frame)
+		if ret != tcActUnspec || !bytes.Equal(out, frame) {
+			t.Errorf("verdict = %d, want TC_ACT_UNSPEC and an unchanged frame", ret)
+		}
+	}
+}
+
+func TestXdpVlan(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	gossip := buildPacket(t, common.Packet{Type: 1}, 0, 8000)
+	otherPort := buildPacket(t, common.Packet{Type: 1}, 0, 8001)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  uint32
+	}{
+		{"802.1Q", tagFrame(gossip, 0, unix.ETH_P_8021Q), xdpAborted}, // Redirected to the (empty) socket map
+		{"802.1ad", tagFrame(gossip, 0, unix.ETH_P_8021AD, unix.ETH_P_8021Q), xdpAborted},
+		{"options", tagFrame(gossip, 10, unix.ETH_P_8021Q), xdpAborted},
+		{"other port", tagFrame(otherPort, 2, unix.ETH_P_8021Q), xdpPass},
+		{"three tags", tagFrame(gossip, 0, unix.ETH_P_8021AD, unix.ETH_P_8021Q, unix.ETH_P_8021Q), xdpPass},
+		{"truncated", tagFrame(gossip, 0, unix.ETH_P_8021Q)[:ethLen+4+ipLen], xdpPass},
+	}
+
+	for _, tt := range tests {
+		if ret, _ := runProgram(t, objs.objs.XdpSockProg, tt.frame); ret != tt.want {
+			t.Errorf("%s: verdict = %d, want %d", tt.name, ret, tt.want)
+		}
+	}
+}
+
+func TestXdpTunnels(t *testing.T) {
+	gossip := buildPacket(t, common.Packet{Type: 1}, 0, 8000)
+	otherPort := buildPacket(t, common.Packet{Type: 1}, 0, 8001)
+
+	tests := []struct {
+		name  string
+		frame []byte
+		want  uint32 // With Options.Tunnels, XDP_PASS without
+	}{
+		{"vxlan", tunnelFrame(gossip, 4789, 0), xdpAborted}, // Redirected to the (empty) socket map
+		{"vxlan tagged", tunnelFrame(tagFrame(gossip, 1, unix.ETH_P_8021Q), 4789, 0), xdpAborted},
+		{"geneve", tunnelFrame(gossip, 6081, 0), xdpAborted},
+		{"geneve options", tunnelFrame(gossip, 6081, 4), xdpAborted},
+		{"vxlan other port", tunnelFrame(otherPort, 4789, 0), xdpPass},
+		{"geneve other port", tunnelFrame(otherPort, 6081, 2), xdpPass},
+	}
+
+	for _, tunnels := range []bool{false, true} {
+		objs := loadTestObjectsWith(t, &Options{Tunnels: tunnels})
+		if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range tests {
+			want := tt.want
+			if !tunnels {
+				want = xdpPass
+			}
+			if ret, _ := runProgram(t, objs.objs.XdpSockProg, tt.frame); ret != want {
+				t.Errorf("%s (tunnels %v): verdict = %d, want %d", tt.name, tunnels, ret, want)
+			}
+		}
+	}
+}
+
+func TestPinnedReuse(t *testing.T) {
+	pinPath := fmt.Sprintf("%s-test-%d", DefaultPinPath, os.Getpid())
+	t.Cleanup(func() { os.RemoveAll(pinPath) })
+
+	load := func(ports ...uint16) *BpfObjects {
+		t.Helper()
+		objs, err := LoadObjects(&Options{Ports: ports, PinPath: pinPath})
+		if errors.Is(err, unix.EPERM) {
+			t.Skip("loading BPF programs requires CAP_BPF:", err)
+		}
+		if err != nil {
+			t.Skip("no bpf filesystem:", err)
+		}
+		return objs
+	}
+	version := func(objs *BpfObjects) (v uint64) {
+		t.Helper()
+		if err := objs.objs.MetadataMap.Lookup(uint16(9200), &v); err != nil && !errors.Is(err, ebpf.ErrKeyNotExist) {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	objs := load(9200)
+	if err := SetMetadataVersion(objs, 9200, 42); err != nil {
+		t.Fatal(err)
+	}
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AttachXDP(objs, lo.Index); err != nil {
+		t.Fatal(err)
+	}
+	objs.Close()
+
+	// The maps and the XDP link outlive the objects of the previous load
+	if _, err := os.Stat(fmt.Sprintf("%s/link_xdp_%d", pinPath, lo.Index)); err != nil {
+		t.Fatal(err)
+	}
+	objs = load(9300)
+	if v := version(objs); v != 42 {
+		t.Errorf("metadata version = %d, want 42", v)
+	}
+	var value uint8
+	if err := objs.objs.PortsMap.Lookup(uint16(9200), &value); !errors.Is(err, ebpf.ErrKeyNotExist) {
+		t.Errorf("stale port 9200 still in ports_map: %v", err)
+	}
+	if err := objs.objs.PortsMap.Lookup(uint16(9300), &value); err != nil {
+		t.Errorf("port 9300 not in ports_map: %v", err)
+	}
+	if _, err := AttachXDP(objs, lo.Index); err != nil {
+		t.Fatal("update of the pinned link:", err)
+	}
+
+	// Maps pinned with another layout version are not reused
+	if err := objs.objs.VersionMap.Put(uint32(0), MapsVersion+1); err != nil {
+		t.Fatal(err)
+	}
+	objs.Close()
+	objs = load()
+	defer objs.Close()
+	if v := version(objs); v != 0 {
+		t.Errorf("metadata version = %d, want 0", v)
+	}
+}
+
+// addTestLink creates a veth pair removed at the end of the test, the test is skipped without CAP_NET_ADMIN
+func addTestLink(t *testing.T, name string) netlink.Link {
+	t.Helper()
+
+	if err := netlink.LinkAdd(&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: name}, PeerName: name + "p"}); err != nil {
+		t.Skip("creating a veth pair requires CAP_NET_ADMIN:", err)
+	}
+	l, err := netlink.LinkByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		netlink.LinkDel(l)
+		os.Remove(clsactMarker(name))
+	})
+	return l
+}
+
+// hasClsact reports whether a link has a clsact qdisc
+func hasClsact(t *testing.T, l netlink.Link) bool {
+	t.Helper()
+
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range qdiscs {
+		if q.Type() == "clsact" {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCleanup(t *testing.T) {
+	pinPath := fmt.Sprintf("%s-cleanup-%d", DefaultPinPath, os.Getpid())
+	t.Cleanup(func() { os.RemoveAll(pinPath) })
+
+	objs, err := LoadObjects(&Options{PinPath: pinPath})
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("loading BPF programs requires CAP_BPF:", err)
+	}
+	if err != nil {
+		t.Skip("no bpf filesystem:", err)
+	}
+	defer objs.Close()
+
+	t.Run("owned", func(t *testing.T) {
+		l := addTestLink(t, "egtest0")
+		if err := AttachTC(objs, l); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AttachXDP(objs, l.Attrs().Index); err != nil {
+			t.Fatal(err)
+		}
+		// The daemon has exited, only the pin holds the XDP link
+		for _, xl := range objs.links {
+			xl.Close()
+		}
+		clear(objs.links)
+
+		if err := Cleanup("egtest0", pinPath); err != nil {
+			t.Fatal(err)
+		}
+
+		if filters, _ := netlink.FilterList(l, netlink.HANDLE_MIN_EGRESS); len(filters) != 0 {
+			t.Errorf("filters left: %v", filters)
+		}
+		if hasClsact(t, l) {
+			t.Error("clsact qdisc left")
+		}
+		if l, _ := netlink.LinkByName("egtest0"); l.Attrs().Xdp != nil && l.Attrs().Xdp.Attached {
+			t.Error("XDP program left")
+		}
+		if _, err := os.Stat(pinPath); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("pin path left: %v", err)
+		}
+	})
+
+	t.Run("foreign", func(t *testing.T) {
+		objs := loadTestObjects(t)
+		l := addTestLink(t, "egtest1")
+
+		// A clsact qdisc and a filter of other software, added before eGossip
+		if err := netlink.QdiscAdd(&netlink.GenericQdisc{
+			QdiscAttrs: netlink.QdiscAttrs{LinkIndex: l.Attrs().Index, Handle: netlink.MakeHandle(0xffff, 0), Parent: netlink.HANDLE_CLSACT},
+			QdiscType:  "clsact",
+		}); err != nil {
+			t.Fatal(err)
+		}
+		foreign := &netlink.BpfFilter{
+			FilterAttrs: netlink.FilterAttrs{
+				LinkIndex: l.Attrs().Index,
+				Parent:    netlink.HANDLE_MIN_EGRESS,
+				Handle:    1,
+				Protocol:  unix.ETH_P_ALL,
+				Priority:  2,
+			},
+			Fd:           objs.objs.Fastbroadcast.FD(),
+			Name:         "foreign",
+			DirectAction: true,
+		}
+		if err := netlink.FilterAdd(foreign); err != nil {
+			t.Fatal(err)
+		}
+		if err := AttachTC(objs, l); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := Cleanup("egtest1", ""); err != nil {
+			t.Fatal(err)
+		}
+
+		filters, err := netlink.FilterList(l, netlink.HANDLE_MIN_EGRESS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filters) != 1 || filters[0].(*netlink.BpfFilter).Name != "foreign" {
+			t.Errorf("filters = %v, want the foreign filter only", filters)
+		}
+		if !hasClsact(t, l) {
+			t.Error("foreign clsact qdisc removed")
+		}
+	})
+}
+
+func TestAdoptedXDPRestore(t *testing.T) {
+	pinPath := fmt.Sprintf("%s-adopt-%d", DefaultPinPath, os.Getpid())
+	t.Cleanup(func() { os.RemoveAll(pinPath) })
+
+	objs, err := LoadObjects(&Options{PinPath: pinPath, XDPChain: ChainAttached})
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("loading BPF programs requires CAP_BPF:", err)
+	}
+	if err != nil {
+		t.Skip("no bpf filesystem:", err)
+	}
+	defer objs.Close()
+
+	// An XDP program of other software, attached in generic mode
+	foreign, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Name:         "foreign",
+		Type:         ebpf.XDP,
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, xdpPass), asm.Return()},
+		License:      "GPL",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer foreign.Close()
+	info, err := foreign.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreignID, _ := info.ID()
+
+	l := addTestLink(t, "egtest2")
+	ifindex := l.Attrs().Index
+	t.Cleanup(func() { forgetAdopted(pinPath, ifindex) })
+
+	attached := func(t *testing.T) *netlink.LinkXdp {
+		t.Helper()
+		l, err := netlink.LinkByIndex(ifindex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.Attrs().Xdp
+	}
+	adopt := func(t *testing.T) {
+		t.Helper()
+		if err := netlink.LinkSetXdpFdWithFlags(l, foreign.FD(), unix.XDP_FLAGS_SKB_MODE); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AttachXDP(objs, ifindex); err != nil {
+			t.Fatal(err)
+		}
+		if x := attached(t); x == nil || x.ProgId == uint32(foreignID) {
+			t.Fatal("foreign program still attached after AttachXDP")
+		}
+	}
+	assertRestored := func(t *testing.T) {
+		t.Helper()
+		x := attached(t)
+		if x == nil || !x.Attached || x.ProgId != uint32(foreignID) {
+			t.Fatalf("XDP program = %+v, want the foreign program %d", x, foreignID)
+		}
+		if x.AttachMode != nl.XDP_ATTACHED_SKB {
+			t.Errorf("attach mode = %d, want generic (%d)", x.AttachMode, nl.XDP_ATTACHED_SKB)
+		}
+		if _, err := os.Stat(adoptedPin(pinPath, ifindex)); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("adopted program still pinned: %v", err)
+		}
+	}
+
+	t.Run("detach", func(t *testing.T) {
+		adopt(t)
+		if err := DetachXDP(objs, ifindex); err != nil {
+			t.Fatal(err)
+		}
+		assertRestored(t)
+	})
+
+	t.Run("cleanup", func(t *testing.T) {
+		adopt(t)
+		// The daemon has exited, only the pin holds the XDP link
+		for _, xl := range objs.links {
+			xl.Close()
+		}
+		clear(objs.links)
+
+		if err := Cleanup("egtest2", pinPath); err != nil {
+			t.Fatal(err)
+		}
+		assertRestored(t)
+	})
+
+	t.Run("no pin path", func(t *testing.T) {
+		objs := loadTestObjectsWith(t, &Options{XDPChain: ChainAttached})
+		if _, err := AttachXDP(objs, ifindex); err == nil {
+			t.Error("foreign program adopted without a pin path to restore it")
+		}
+		if x := attached(t); x == nil || x.ProgId != uint32(foreignID) {
+			t.Error("foreign program detached")
+		}
+	})
+}
+
+func TestXdpChain(t *testing.T) {
+	objs := loadTestObjects(t)
+
+	if err := objs.objs.QidconfMap.Put(int32(0), int32(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// A program of other software, dropping everything it is handed
+	chained, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.XDP,
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, xdpDrop), asm.Return()},
+		License:      "GPL",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chained.Close()
+
+	gossip := buildPacket(t, common.Packet{Type: 1}, 0, 8000)
+	other := buildPacket(t, common.Packet{Type: 1}, 0, 9300)
+
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, other); ret != xdpPass {
+		t.Fatalf("no chain: verdict = %d, want XDP_PASS", ret)
+	}
+
+	if err := ChainXDP(objs, chained); err != nil {
+		t.Fatal(err)
+	}
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, other); ret != xdpDrop {
+		t.Errorf("chained: verdict = %d, want XDP_DROP of the chained program", ret)
+	}
+	if ret, _ := runProgram(t, objs.objs.XdpSockProg, gossip); ret != xdpAborted {
+		t.Errorf("gossip packet: verdict = %d, want a redirect to the (empty) socket map", ret)
+	}
+}
+
+func TestAttachTCCoexist(t *testing.T) {
+	objs := loadTestObjects(t)
+	defer func() {
+		for _, l := range objs.links {
+			l.Close()
+		}
+	}()
+
+	l := addTestLink(t, "egtest2")
+
+	// A filter of other software at the default priority and the handle eGossip used to use
+	if err := netlink.QdiscAdd(&netlink.GenericQdisc{
+		QdiscAttrs: netlink.QdiscAttrs{LinkIndex: l.Attrs().Index, Handle: netlink.MakeHandle(0xffff, 0), Parent: netlink.HANDLE_CLSACT},
+		QdiscType:  "clsact",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlink.FilterAdd(&netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: l.Attrs().Index,
+			Parent:    netlink.HANDLE_MIN_EGRESS,
+			Handle:    1,
+			Protocol:  unix.ETH_P_ALL,
+			Priority:  DefaultTCPriority,
+		},
+		Fd:           objs.objs.Fastbroadcast.FD(),
+		Name:         "foreign",
+		DirectAction: true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AttachTC(objs, l); err != nil {
+		t.Fatal(err)
+	}
+
+	filters, err := netlink.FilterList(l, netlink.HANDLE_MIN_EGRESS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var foreign bool
+	for _, f := range filters {
+		if bf, ok := f.(*netlink.BpfFilter); ok && bf.Name == "foreign" {
+			foreign = true
+		}
+	}
+	if !foreign {
+		t.Errorf("foreign filter replaced, filters = %v", filters)
+	}
+	if len(objs.links) == 0 && len(filters) != 2 {
+		t.Errorf("tc fallback: filters = %v, want the foreign and the eGossip filter", filters)
+	}
+}
@@ -0,0 +1,263 @@
+package bpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/link"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// StateDir holds the state of eGossip that cannot be kept in bpffs
+const StateDir = "/run/egossip"
+
+// clsactMarker is the file recording that eGossip added the clsact qdisc of a link
+func clsactMarker(ifName string) string {
+	return filepath.Join(StateDir, "clsact-"+ifName)
+}
+
+// markClsact records that eGossip added the clsact qdisc of a link
+func markClsact(ifName string) error {
+	if err := os.MkdirAll(StateDir, 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(clsactMarker(ifName), nil, 0o600)
+}
+
+// adoptedPin is the pin of the XDP program adopted from other software on an interface (Options.XDPChain)
+func adoptedPin(pinPath string, Ifindex int) string {
+	return filepath.Join(pinPath, fmt.Sprintf("adopted_xdp_%d", Ifindex))
+}
+
+// adoptedMarker is the file recording the attach flags of the XDP program adopted on an interface
+func adoptedMarker(Ifindex int) string {
+	return filepath.Join(StateDir, fmt.Sprintf("xdp-adopted-%d", Ifindex))
+}
+
+// xdpModeFlags returns the attach flags of an XDP attach mode (nl.XDP_ATTACHED_*)
+func xdpModeFlags(mode uint32) int {
+	switch mode {
+	case nl.XDP_ATTACHED_DRV:
+		return unix.XDP_FLAGS_DRV_MODE
+	case nl.XDP_ATTACHED_SKB:
+		return unix.XDP_FLAGS_SKB_MODE
+	case nl.XDP_ATTACHED_HW:
+		return unix.XDP_FLAGS_HW_MODE
+	}
+	return 0
+}
+
+// recordAdopted pins the XDP program adopted on an interface and records its attach flags
+func recordAdopted(pinPath string, Ifindex int, prog *ebpf.Program, flags int) error {
+	if err := os.MkdirAll(StateDir, 0o700); err != nil {
+		return err
+	}
+	if err := os.WriteFile(adoptedMarker(Ifindex), []byte(strconv.Itoa(flags)), 0o600); err != nil {
+		return err
+	}
+	if err := prog.Pin(adoptedPin(pinPath, Ifindex)); err != nil {
+		os.Remove(adoptedMarker(Ifindex))
+		return err
+	}
+	return nil
+}
+
+// forgetAdopted removes the pin and the attach mode of the XDP program adopted on an interface
+func forgetAdopted(pinPath string, Ifindex int) {
+	os.Remove(adoptedPin(pinPath, Ifindex))
+	os.Remove(adoptedMarker(Ifindex))
+}
+
+// restoreXDP reattaches the XDP program adopted on an interface in its former mode, once the eGossip program is detached.
+// A program attached meanwhile by other software is left in place
+func restoreXDP(pinPath string, Ifindex int) error {
+	if pinPath == "" {
+		return nil
+	}
+	prog, err := ebpf.LoadPinnedProgram(adoptedPin(pinPath, Ifindex), nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+
+	l, err := netlink.LinkByIndex(Ifindex)
+	if err != nil {
+		return err
+	}
+	flags := 0
+	if data, err := os.ReadFile(adoptedMarker(Ifindex)); err == nil {
+		flags, _ = strconv.Atoi(string(data))
+	}
+	err = netlink.LinkSetXdpFdWithFlags(l, prog.FD(), flags|unix.XDP_FLAGS_UPDATE_IF_NOEXIST)
+	if err != nil && !errors.Is(err, unix.EBUSY) && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("restore the adopted XDP program: %w", err)
+	}
+	forgetAdopted(pinPath, Ifindex)
+	return nil
+}
+
+// Cleanup removes the eGossip programs from a link: its TCX link or tc filter, its XDP program, the objects pinned under pinPath
+// (if no other interface uses them) and the clsact qdisc if eGossip added it and no other filter uses it. Programs of other software are left
+// untouched, an XDP program adopted by the eGossip one (Options.XDPChain) is attached again
+func Cleanup(ifName string, pinPath string) error {
+	l, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return err
+	}
+
+	if pinPath != "" {
+		if err := unpinLink(filepath.Join(pinPath, fmt.Sprintf("link_tcx_%d", l.Attrs().Index))); err != nil {
+			return fmt.Errorf("TCX link: %w", err)
+		}
+	}
+	if err := RemoveTC(ifName, netlink.HANDLE_MIN_EGRESS); err != nil {
+		return fmt.Errorf("TC filter: %w", err)
+	}
+
+	if err := detachXDP(l, pinPath); err != nil {
+		return fmt.Errorf("XDP program: %w", err)
+	}
+
+	if err := removeClsact(l); err != nil {
+		return fmt.Errorf("clsact qdisc: %w", err)
+	}
+
+	if pinPath != "" {
+		if err := removePins(pinPath); err != nil {
+			return fmt.Errorf("pinned objects: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// detachXDP detaches the XDP program of a link, attached through a pinned bpf_link or through netlink (older daemons),
+// and reattaches the XDP program it adopted
+func detachXDP(l netlink.Link, pinPath string) error {
+	if pinPath != "" {
+		if err := unpinLink(filepath.Join(pinPath, fmt.Sprintf("link_xdp_%d", l.Attrs().Index))); err != nil {
+			return err
+		}
+	}
+
+	// Reload the link attributes, the XDP program may have changed above
+	l, err := netlink.LinkByIndex(l.Attrs().Index)
+	if err != nil {
+		return err
+	}
+	x := l.Attrs().Xdp
+	if x == nil || !x.Attached || x.ProgId == 0 {
+		return restoreXDP(pinPath, l.Attrs().Index)
+	}
+
+	prog, err := ebpf.NewProgramFromID(ebpf.ProgramID(x.ProgId))
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	info, err := prog.Info()
+	if err != nil {
+		return err
+	}
+	if info.Name != "xdp_sock_prog" {
+		// Other software attached a program since, the adopted one is not restored over it
+		if pinPath != "" {
+			forgetAdopted(pinPath, l.Attrs().Index)
+		}
+		return nil
+	}
+	if err := netlink.LinkSetXdpFd(l, -1); err != nil {
+		if errors.Is(err, unix.EBUSY) {
+			return fmt.Errorf("attached through a bpf_link held by a running daemon: %w", err)
+		}
+		return err
+	}
+	return restoreXDP(pinPath, l.Attrs().Index)
+}
+
+// unpinLink removes a pinned bpf_link, which detaches its program once no running daemon holds it
+func unpinLink(path string) error {
+	pinned, err := link.LoadPinnedLink(path, nil)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer pinned.Close()
+	return pinned.Unpin()
+}
+
+// removeClsact deletes the clsact qdisc of a link if eGossip added it and it holds no filters anymore
+func removeClsact(l netlink.Link) error {
+	marker := clsactMarker(l.Attrs().Name)
+	if _, err := os.Stat(marker); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	for _, parent := range []uint32{netlink.HANDLE_MIN_INGRESS, netlink.HANDLE_MIN_EGRESS} {
+		filters, err := netlink.FilterList(l, parent)
+		if err != nil {
+			return err
+		}
+		if len(filters) != 0 {
+			// Other software attached filters since, the qdisc is left (and still recorded as ours)
+			return nil
+		}
+	}
+
+	qdiscs, err := netlink.QdiscList(l)
+	if err != nil {
+		return err
+	}
+	for _, q := range qdiscs {
+		if q.Type() == "clsact" {
+			if err := netlink.QdiscDel(q); err != nil {
+				return err
+			}
+		}
+	}
+	return os.Remove(marker)
+}
+
+// removePins removes the maps and programs pinned under pinPath, and pinPath itself. They are kept while the
+// pinned link or the adopted XDP program of another interface still uses them
+func removePins(pinPath string) error {
+	for _, pattern := range []string{"link_*", "adopted_xdp_*"} {
+		pins, err := filepath.Glob(filepath.Join(pinPath, pattern))
+		if err != nil {
+			return err
+		}
+		if len(pins) != 0 {
+			return nil
+		}
+	}
+
+	spec, err := loadBpf()
+	if err != nil {
+		return err
+	}
+	if err := unpinMaps(pinPath, spec); err != nil {
+		return err
+	}
+
+	for _, name := range []string{filepath.Join(pinPath, "fastbroadcast"), filepath.Join(pinPath, "xdp_sock_prog")} {
+		if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	if err := os.Remove(pinPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
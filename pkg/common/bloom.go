@@ -0,0 +1,53 @@
+package common
+
+import (
+	"hash/fnv"
+)
+
+// Number of hash functions of the bloom filter
+const bloomHashes = 4
+
+// BloomFilter is a fixed size bloom filter of infected nodes, carried in the packet instead of the Infected map
+type BloomFilter []byte
+
+// NewBloomFilter creates an empty bloom filter of the given size (in bits, rounded up to bytes)
+func NewBloomFilter(bits int) BloomFilter {
+	return make(BloomFilter, (bits+7)/8)
+}
+
+// Add inserts a key ("Addr:Port") into the bloom filter
+func (b BloomFilter) Add(key string) {
+	if len(b) == 0 {
+		return
+	}
+	h1, h2 := bloomHash(key)
+	m := uint64(len(b) * 8)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		b[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// Test reports whether a key ("Addr:Port") may be in the bloom filter (false positives are possible, false negatives are not)
+func (b BloomFilter) Test(key string) bool {
+	if len(b) == 0 {
+		return false
+	}
+	h1, h2 := bloomHash(key)
+	m := uint64(len(b) * 8)
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % m
+		if b[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash derives the two base hashes of the double hashing scheme from a 64-bit FNV-1a hash
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum & 0xffffffff, (sum >> 32) | 1
+}
@@ -0,0 +1,69 @@
+package common
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNewBloomFilter(t *testing.T) {
+	for _, tt := range []struct{ bits, bytes int }{{0, 0}, {1, 1}, {8, 1}, {9, 2}, {1024, 128}} {
+		if got := len(NewBloomFilter(tt.bits)); got != tt.bytes {
+			t.Errorf("NewBloomFilter(%d) = %d bytes, want %d", tt.bits, got, tt.bytes)
+		}
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	key := func(i int) string { return fmt.Sprintf("10.0.%d.%d:8000", i/256, i%256) }
+
+	tests := []struct {
+		name   string
+		bits   int
+		keys   int
+		maxFPR float64 // Maximum false positive rate over keys that were not added
+	}{
+		// (1-e^(-4·50/1024))^4 ≈ 0.1%
+		{"sparse", 1024, 50, 0.01},
+		// (1-e^(-4·200/1024))^4 ≈ 5.6%
+		{"loaded", 1024, 200, 0.1},
+		// Every bit is set, every key is a false positive
+		{"saturated", 8, 100, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBloomFilter(tt.bits)
+			for i := 0; i < tt.keys; i++ {
+				b.Add(key(i))
+			}
+
+			// No false negatives
+			for i := 0; i < tt.keys; i++ {
+				if !b.Test(key(i)) {
+					t.Fatalf("added key %s not found", key(i))
+				}
+			}
+
+			const others = 10000
+			fp := 0
+			for i := tt.keys; i < tt.keys+others; i++ {
+				if b.Test(key(i)) {
+					fp++
+				}
+			}
+			if rate := float64(fp) / others; rate > tt.maxFPR {
+				t.Errorf("false positive rate = %.4f, want at most %.4f", rate, tt.maxFPR)
+			}
+		})
+	}
+}
+
+func TestBloomFilterEmpty(t *testing.T) {
+	var b BloomFilter
+	b.Add("10.0.0.1:8000") // No-op without bits
+	if b.Test("10.0.0.1:8000") {
+		t.Error("a filter without bits reports a key")
+	}
+	if NewBloomFilter(1024).Test("10.0.0.1:8000") {
+		t.Error("an empty filter reports a key")
+	}
+}
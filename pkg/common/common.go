@@ -2,6 +2,7 @@ package common
 
 import (
 	"bufio"
+	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"log"
@@ -16,12 +17,12 @@ import (
 
 // Node represents a node
 type Node struct {
-	Addr        string `json:"Addr"`        // Node IP address (fill in public IP in public network environment)
-	Port        int    `json:"Port"`        // Port number
-	Mac         string `json:"Mac"`         // Node MAC address
-	Name        string `json:"Name"`        // Node name (customizable)
-	PrivateData string `json:"PrivateData"` // Node private data (customizable)
-	LinkName    string // bind xdp to this interface
+	ID       string `json:"ID"`   // Stable node ID (configured name or generated UUID), key of the node list
+	Addr     string `json:"Addr"` // Node IP address (fill in public IP in public network environment)
+	Port     int    `json:"Port"` // Port number
+	Mac      string `json:"Mac"`  // Node MAC address
+	Name     string `json:"Name"` // Node name (customizable)
+	LinkName string // bind xdp to this interface
 }
 
 type BroadcastTargets struct {
@@ -44,19 +45,41 @@ func (t BroadcastTargets) GetMac() [6]int8 {
 
 // Packet data
 type Packet struct {
-	Type   uint8  // 0 not used 1: heartbeat packet, 2: initiator sends an exchange request to the recipient, 3: recipient responds to the initiator, data exchange completed
-	Count  uint16 // Broadcast packet count (0-64)
-	Mapkey uint16 // Map key
+	Type   uint8  `json:"-"` // 0 not used 1: heartbeat packet, 2: initiator sends an exchange request to the recipient, 3: recipient responds to the initiator, data exchange completed (carried in the binary header)
+	Flags  uint8  `json:"-"` // Header flags (FlagCloned, FlagUpdates, FlagRTT), carried in the binary header
+	Count  uint16 `json:"-"` // Index of this copy among the broadcast targets, set by the TC program (carried in the binary header)
+	Mapkey uint16 `json:"-"` // targets_map key of the broadcast (carried in the binary header)
 	// Metadata information
 	Metadata Metadata // New metadata information, if the packet is a metadata update packet (isUpdate=true), then replace the original cluster metadata with newData
 
 	// Node information
 	Node     Node            // Node information in the heartbeat packet
-	Infected map[string]bool // List of nodes already infected by this packet, the key is a string concatenated by Addr:Port, and the value determines whether the node has been infected (true: yes, false: no)
+	Infected map[string]bool `json:",omitempty"` // List of nodes already infected by this packet, the key is a string concatenated by Addr:Port, and the value determines whether the node has been infected (true: yes, false: no)
+	Bloom    BloomFilter     `json:",omitempty"` // Bloom filter of nodes already infected by this packet (bloom infection mode)
+	TTL      uint8           `json:",omitempty"` // Remaining hops of this packet (ttl infection mode)
+	Time     int64           // Origin timestamp of the broadcast, identifies the broadcast together with the origin node ID
 	IsUpdate bool            // Whether it is a metadata update packet (0: no, 1: yes)
+	Members  int             `json:",omitempty"` // Size of the origin's node list (adaptive mode), the cycle and timeout are scaled from the largest one announced
 
 	SecretKey string // Cluster key, if it doesn't match, reject processing this packet
-	CountStr  string
+
+	Private NodeMetadata // Private metadata of the node in the heartbeat packet
+
+	Updates []Update // Membership and metadata updates piggybacked on this packet
+}
+
+// Update types
+const (
+	UpdateNode     uint8 = 1 // Node joined or changed its attributes / private metadata
+	UpdateMetadata uint8 = 2 // Cluster metadata published
+)
+
+// Update is a membership or metadata change disseminated by piggybacking on heartbeat and swap packets
+type Update struct {
+	Type     uint8        // Update type (1: node, 2: cluster metadata)
+	Node     Node         // Node information, if it is a node update
+	Private  NodeMetadata // Node private metadata, if it is a node update
+	Metadata Metadata     // Cluster metadata, if it is a metadata update
 }
 
 // Metadata information
@@ -66,29 +89,58 @@ type Metadata struct {
 	Data   []byte // Metadata content
 }
 
+// NodeMetadata private metadata of a single node, versioned independently from the node identity
+type NodeMetadata struct {
+	Labels map[string]string // Node labels (e.g. role, zone, capacity)
+	Data   []byte            // Opaque node private data
+	Update int64             // Private metadata version (update timestamp)
+}
+
 type AtomicCounter struct {
-	val int32
+	val      int32
+	min, max int32 // Range of the values, wrapped around
 }
 
 func NewAtomicCounter() *AtomicCounter {
-	return &AtomicCounter{val: 100}
+	return NewAtomicCounterRange(100, 999)
+}
+
+// NewAtomicCounterRange returns a counter cycling through [min, max], e.g. the bpf map keys reserved for a cluster
+func NewAtomicCounterRange(min, max uint16) *AtomicCounter {
+	return &AtomicCounter{val: int32(min), min: int32(min), max: int32(max)}
+}
+
+// Range returns the first and last values of the counter
+func (ac *AtomicCounter) Range() (uint16, uint16) {
+	return uint16(ac.min), uint16(ac.max)
 }
 
 func (ac *AtomicCounter) Next() uint16 {
 	// Increment the current value and get the new value
 	newVal := atomic.AddInt32(&ac.val, 1)
 
-	// If the new value exceeds 999, wrap it around to 100.
+	// If the new value exceeds max, wrap it around to min.
 	// Use CAS (Compare-And-Swap) to ensure atomicity.
-	for newVal > 999 {
-		if atomic.CompareAndSwapInt32(&ac.val, newVal, 100) {
-			return 100
+	for newVal > ac.max {
+		if atomic.CompareAndSwapInt32(&ac.val, newVal, ac.min) {
+			return uint16(ac.min)
 		}
 		newVal = atomic.AddInt32(&ac.val, 1)
 	}
 	return uint16(newVal)
 }
 
+// NewNodeID generates a random (version 4) UUID as node ID
+func NewNodeID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		log.Fatalf("Failed to generate node ID: %v", err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // Variant RFC 4122
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
 // IpToUint32 converts IP to uint32
 func IpToUint32(ipStr string) uint32 {
 	ip := net.ParseIP(ipStr)
@@ -0,0 +1,89 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+)
+
+/*
+ * Binary packet header, placed in front of the JSON encoded packet so that the
+ * BPF programs can read the packet type and broadcast state at fixed offsets
+ * (must match struct gossip_hdr in pkg/bpf/bpf.c). All fields are in network byte order.
+ *
+ *   0       2      3       4       6        8                  16           24
+ *   +-------+------+-------+-------+--------+------------------+------------+
+ *   | Magic | Type | Flags | Count | Mapkey | Metadata version | Message ID |
+ *   +-------+------+-------+-------+--------+------------------+------------+
+ */
+
+const (
+	HeaderSize  = 24     // Size of the binary header (in bytes)
+	HeaderMagic = 0x6547 // "eG"
+
+	FlagCloned   uint8 = 1 << 0 // Set by the TC program on every copy of a broadcast, the copy is not cloned again
+	FlagUpdates  uint8 = 1 << 1 // The packet carries piggybacked updates, it is never dropped as stale by the XDP program
+	FlagRTT      uint8 = 1 << 2 // The swap packet measures the RTT (adaptive mode), it is never dropped as stale by the XDP program
+	FlagNodeList uint8 = 1 << 3 // The TC program picks Count targets of the kernel node list starting at index Mapkey, instead of a targets_map entry
+)
+
+// EncodePacket encodes a packet as the binary header followed by the JSON packet
+func EncodePacket(p Packet) ([]byte, error) {
+	body, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := make([]byte, HeaderSize, HeaderSize+len(body))
+	binary.BigEndian.PutUint16(bs[0:2], HeaderMagic)
+	flags := p.Flags &^ FlagCloned // A forwarded broadcast is cloned again
+	if len(p.Updates) > 0 {
+		flags |= FlagUpdates
+	}
+
+	bs[2] = p.Type
+	bs[3] = flags
+	binary.BigEndian.PutUint16(bs[4:6], p.Count)
+	binary.BigEndian.PutUint16(bs[6:8], p.Mapkey)
+	binary.BigEndian.PutUint64(bs[8:16], uint64(p.Metadata.Update))
+	binary.BigEndian.PutUint64(bs[16:24], MessageID(p))
+
+	return append(bs, body...), nil
+}
+
+// MessageID identifies a broadcast (heartbeat or metadata update) by its origin node and timestamp, every copy and forward of the broadcast has the same ID.
+// Other packets have no message ID (0), they are never dropped as duplicates by the XDP program.
+func MessageID(p Packet) uint64 {
+	if p.Type != 1 || p.Time == 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(p.Node.ID))
+	binary.Write(h, binary.BigEndian, p.Time)
+	if id := h.Sum64(); id != 0 {
+		return id
+	}
+	return 1
+}
+
+// DecodePacket decodes a packet (binary header followed by the JSON packet)
+func DecodePacket(bs []byte, p *Packet) error {
+	if len(bs) < HeaderSize {
+		return fmt.Errorf("packet too short: %d bytes", len(bs))
+	}
+	if magic := binary.BigEndian.Uint16(bs[0:2]); magic != HeaderMagic {
+		return fmt.Errorf("bad packet magic: %#04x", magic)
+	}
+
+	if err := json.Unmarshal(bs[HeaderSize:], p); err != nil {
+		return err
+	}
+
+	p.Type = bs[2]
+	p.Flags = bs[3]
+	p.Count = binary.BigEndian.Uint16(bs[4:6])
+	p.Mapkey = binary.BigEndian.Uint16(bs[6:8])
+	return nil
+}
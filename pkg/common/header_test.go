@@ -0,0 +1,189 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testPacket() Packet {
+	return Packet{
+		Type:      1,
+		Flags:     FlagRTT,
+		Count:     3,
+		Mapkey:    1234,
+		Metadata:  Metadata{Data: []byte("config"), Update: 0x0102030405060708},
+		Node:      Node{ID: "n1", Addr: "10.0.0.1", Port: 8000, Name: "n1"},
+		Infected:  map[string]bool{"10.0.0.1:8000": true},
+		Time:      1700000000000000000,
+		SecretKey: "key",
+		Private:   NodeMetadata{Labels: map[string]string{"zone": "a"}, Update: 42},
+	}
+}
+
+func TestHeaderLayout(t *testing.T) {
+	p := testPacket()
+	bs, err := EncodePacket(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// struct gossip_hdr of pkg/bpf/bpf.c, in network byte order
+	want := []byte{
+		0x65, 0x47, // magic
+		1,             // type
+		byte(FlagRTT), // flags
+		0x00, 0x03,    // count
+		0x04, 0xd2, // mapkey
+		1, 2, 3, 4, 5, 6, 7, 8, // metadata version
+	}
+	want = binary.BigEndian.AppendUint64(want, MessageID(p)) // msg_id
+	if len(want) != HeaderSize {
+		t.Fatalf("expected header is %d bytes, HeaderSize is %d", len(want), HeaderSize)
+	}
+	if !bytes.Equal(bs[:HeaderSize], want) {
+		t.Errorf("header = % x, want % x", bs[:HeaderSize], want)
+	}
+	if bs[HeaderSize] != '{' {
+		t.Errorf("body starts with %q, want the JSON packet", bs[HeaderSize])
+	}
+}
+
+func TestEncodeFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   uint8
+		updates []Update
+		want    uint8
+	}{
+		{"none", 0, nil, 0},
+		{"cloned cleared", FlagCloned | FlagRTT, nil, FlagRTT},
+		{"updates set", 0, []Update{{Type: UpdateNode}}, FlagUpdates},
+		{"nodelist kept", FlagNodeList, nil, FlagNodeList},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := EncodePacket(Packet{Type: 1, Flags: tt.flags, Updates: tt.updates})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bs[3] != tt.want {
+				t.Errorf("flags = %#x, want %#x", bs[3], tt.want)
+			}
+		})
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	p := testPacket()
+	bs, err := EncodePacket(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got Packet
+	if err := DecodePacket(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, p) {
+		t.Errorf("decoded packet = %+v, want %+v", got, p)
+	}
+}
+
+func TestDecodeHeaderFields(t *testing.T) {
+	bs, err := EncodePacket(testPacket())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The TC program rewrites count, mapkey and flags in the header only, the JSON body is left as sent
+	binary.BigEndian.PutUint16(bs[4:6], 7)
+	binary.BigEndian.PutUint16(bs[6:8], 999)
+	bs[3] |= FlagCloned
+
+	var got Packet
+	if err := DecodePacket(bs, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Count != 7 || got.Mapkey != 999 {
+		t.Errorf("count, mapkey = %d, %d, want the header values 7, 999", got.Count, got.Mapkey)
+	}
+	if got.Flags != FlagRTT|FlagCloned {
+		t.Errorf("flags = %#x, want %#x", got.Flags, FlagRTT|FlagCloned)
+	}
+	if strings.Contains(string(bs[HeaderSize:]), "Mapkey") {
+		t.Error("mapkey is also encoded in the JSON body")
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	valid, err := EncodePacket(testPacket())
+	if err != nil {
+		t.Fatal(err)
+	}
+	badMagic := append([]byte(nil), valid...)
+	badMagic[0] = 0x45
+
+	tests := []struct {
+		name string
+		bs   []byte
+		want string
+	}{
+		{"empty", nil, "too short"},
+		{"truncated header", valid[:HeaderSize-1], "too short"},
+		{"header only", valid[:HeaderSize], "unexpected end of JSON"},
+		{"truncated body", valid[:len(valid)-1], "unexpected end of JSON"},
+		{"bad magic", badMagic, "bad packet magic"},
+		{"json only", valid[HeaderSize:], "bad packet magic"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Packet
+			err := DecodePacket(tt.bs, &p)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageID(t *testing.T) {
+	p := testPacket()
+	id := MessageID(p)
+	if id == 0 {
+		t.Fatal("heartbeat without message ID")
+	}
+
+	// Every copy and forward of a broadcast has the same ID
+	forward := p
+	forward.Count, forward.Mapkey, forward.Flags = 9, 4321, FlagCloned
+	forward.Infected = map[string]bool{"10.0.0.1:8000": true, "10.0.0.2:8000": true}
+	if got := MessageID(forward); got != id {
+		t.Errorf("forwarded broadcast ID = %#x, want %#x", got, id)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(p *Packet)
+	}{
+		{"other origin", func(p *Packet) { p.Node.ID = "n2" }},
+		{"other time", func(p *Packet) { p.Time++ }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := p
+			tt.modify(&q)
+			if got := MessageID(q); got == id || got == 0 {
+				t.Errorf("ID = %#x, want an ID other than %#x and 0", got, id)
+			}
+		})
+	}
+
+	for _, q := range []Packet{{Type: 2, Time: 1, Node: p.Node}, {Type: 3, Time: 1}, {Type: 1, Time: 0}} {
+		if got := MessageID(q); got != 0 {
+			t.Errorf("type %d, time %d: ID = %#x, want 0", q.Type, q.Time, got)
+		}
+	}
+}
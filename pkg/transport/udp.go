@@ -36,25 +36,24 @@ func UdpWrite(logger *logger.Logger, addr string, port int, data []byte) {
 	}(socket)
 }
 
-// udpListen
-func UdpListen(logger *logger.Logger, addr string, port int, size int, mq chan []byte) {
-
+// UdpBind opens the UDP socket receiving the datagrams to addr:port
+func UdpBind(addr string, port int) (*net.UDPConn, error) {
 	udpAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", addr, port))
 	if err != nil {
-		logger.Sugar().Panicln(errMsgUDPErrorPrefix, err)
-		return
-	}
-	conn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		logger.Sugar().Panicln(errMsgUDPErrorPrefix, err)
-		return
+		return nil, err
 	}
-	defer func(conn *net.UDPConn) {
-		err = conn.Close()
-		if err != nil {
-			logger.Sugar().Panicln(errMsgUDPErrorPrefix, err)
-		}
-	}(conn)
+	return net.ListenUDP("udp", udpAddr)
+}
+
+// UdpListen receives datagrams on conn until done is closed (nil error) or the socket fails, conn is closed on return
+func UdpListen(logger *logger.Logger, conn *net.UDPConn, size int, mq chan []byte, done <-chan struct{}) error {
+	// Closing the connection unblocks the read below
+	closed := make(chan struct{})
+	go func() {
+		<-done
+		conn.Close()
+		close(closed)
+	}()
 
 	for {
 		// recive data
@@ -63,12 +62,18 @@ func UdpListen(logger *logger.Logger, addr string, port int, size int, mq chan [
 		// listen for UDP packets to the port
 		n, _, err := conn.ReadFromUDP(bs)
 		if err != nil {
-			logger.Sugar().Panicln(errMsgUDPErrorPrefix, err)
-			continue
+			select {
+			case <-done:
+				<-closed
+				return nil
+			default:
+			}
+			conn.Close()
+			return err
 		}
 
 		if n >= size {
-			logger.Sugar().Panicln(errMsgUDPErrorPrefix, fmt.Sprintf("received data size (%v) exceeds the limit (%v)", n, size))
+			logger.Sugar().Warnln(errMsgUDPErrorPrefix, fmt.Sprintf("received data size (%v) exceeds the limit (%v)", n, size))
 			continue
 		}
 
@@ -76,6 +81,11 @@ func UdpListen(logger *logger.Logger, addr string, port int, size int, mq chan [
 		b := bs[:n]
 
 		// put data in to a message queue
-		mq <- b
+		select {
+		case mq <- b:
+		case <-done:
+			<-closed
+			return nil
+		}
 	}
 }
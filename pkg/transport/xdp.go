@@ -1,14 +1,235 @@
 package transport
 
 import (
-
-	//"log"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"unsafe"
 
 	"github.com/asavie/xdp"
 	"github.com/kerwenwwer/eGossip/pkg/logger"
+	"golang.org/x/sys/unix"
 )
 
-func XdpListen(xsk *xdp.Socket, mq chan []byte) {
+// XskConfig configures the UMEM and the rings of an AF_XDP socket, ring sizes are powers of 2
+type XskConfig struct {
+	NumFrames          int  // Frames of the UMEM, at least FillRingSize
+	FrameSize          int  // Size of a UMEM frame (2048 or 4096)
+	FillRingSize       int  // Descriptors of the fill ring (frames handed to the kernel for receiving)
+	CompletionRingSize int  // Descriptors of the completion ring
+	RxRingSize         int  // Descriptors of the rx ring (received frames)
+	TxRingSize         int  // Descriptors of the tx ring (0: receive only)
+	ZeroCopy           bool // Requests a zero-copy bind, falls back to copy mode when the driver does not support it
+	NeedWakeup         bool // Requests need-wakeup, the driver is only woken up (by poll) when the fill ring ran empty
+}
+
+// DefaultXskConfig sizes the UMEM for broadcast storms: 4096 frames of 4 KiB (16 MiB) and 2048 descriptors on the receive path
+var DefaultXskConfig = XskConfig{
+	NumFrames:          4096,
+	FrameSize:          4096,
+	FillRingSize:       2048,
+	CompletionRingSize: 64,
+	RxRingSize:         2048,
+	TxRingSize:         64,
+	NeedWakeup:         true,
+}
+
+// Validate checks the sizes of the configuration
+func (cfg XskConfig) Validate() error {
+	if cfg.FrameSize != 2048 && cfg.FrameSize != 4096 {
+		return fmt.Errorf("invalid frame size: %d (2048 or 4096)", cfg.FrameSize)
+	}
+	for name, size := range map[string]int{
+		"fill":       cfg.FillRingSize,
+		"completion": cfg.CompletionRingSize,
+		"rx":         cfg.RxRingSize,
+	} {
+		if size <= 0 || size&(size-1) != 0 {
+			return fmt.Errorf("invalid %s ring size: %d (power of 2)", name, size)
+		}
+	}
+	if cfg.TxRingSize < 0 || cfg.TxRingSize&(cfg.TxRingSize-1) != 0 {
+		return fmt.Errorf("invalid tx ring size: %d (power of 2 or 0)", cfg.TxRingSize)
+	}
+	if cfg.NumFrames < cfg.FillRingSize {
+		return fmt.Errorf("invalid number of frames: %d (at least the fill ring size %d)", cfg.NumFrames, cfg.FillRingSize)
+	}
+	return nil
+}
+
+// NewXsk creates an AF_XDP socket on a queue of an interface. The requested bind flags are tried first, then without
+// zero-copy and without need-wakeup
+func NewXsk(ifindex int, queue int, cfg XskConfig) (*xdp.Socket, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	var attempts []uint16
+	for _, zc := range []bool{true, false} {
+		for _, nw := range []bool{true, false} {
+			if (zc && !cfg.ZeroCopy) || (nw && !cfg.NeedWakeup) {
+				continue
+			}
+			flags := uint16(unix.XDP_COPY)
+			if zc {
+				flags = unix.XDP_ZEROCOPY
+			}
+			if nw {
+				flags |= unix.XDP_USE_NEED_WAKEUP
+			}
+			attempts = append(attempts, flags)
+		}
+	}
+
+	options := xdp.SocketOptions{
+		NumFrames:              cfg.NumFrames,
+		FrameSize:              cfg.FrameSize,
+		FillRingNumDescs:       cfg.FillRingSize,
+		CompletionRingNumDescs: cfg.CompletionRingSize,
+		RxRingNumDescs:         cfg.RxRingSize,
+		TxRingNumDescs:         cfg.TxRingSize,
+	}
+
+	var errs []error
+	for _, flags := range attempts {
+		attempt := options
+		xsk, err := bindXsk(ifindex, queue, &attempt, flags)
+		if err == nil {
+			return xsk, nil
+		}
+		errs = append(errs, fmt.Errorf("bind flags %#x: %w", flags, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// socketFlagsMu serializes the sockets created by bindXsk
+var socketFlagsMu sync.Mutex
+
+// bindXsk creates an AF_XDP socket bound with flags. The xdp package only reads the bind flags from the global
+// xdp.DefaultSocketFlags, they are set for the duration of the call and restored before any other socket is created
+func bindXsk(ifindex int, queue int, options *xdp.SocketOptions, flags uint16) (*xdp.Socket, error) {
+	socketFlagsMu.Lock()
+	defer socketFlagsMu.Unlock()
+
+	saved := xdp.DefaultSocketFlags
+	defer func() { xdp.DefaultSocketFlags = saved }()
+	xdp.DefaultSocketFlags = flags
+
+	return xdp.NewSocket(ifindex, queue, options)
+}
+
+// XskStats are the ring fill levels and the kernel counters of an AF_XDP socket
+type XskStats struct {
+	ZeroCopy       bool   // Whether the socket is bound in zero-copy mode
+	FillRing       int    // Descriptors on the fill ring, waiting for a frame
+	FillRingSize   int    // Size of the fill ring
+	RxRing         int    // Received frames on the rx ring, not consumed yet
+	RxRingSize     int    // Size of the rx ring
+	RxDropped      uint64 // Frames dropped by the kernel (e.g. too large)
+	RxInvalidDescs uint64 // Invalid descriptors on the fill ring
+	RxRingFull     uint64 // Frames dropped as the rx ring was full
+	FillRingEmpty  uint64 // Frames dropped as the fill ring was empty
+}
+
+// ReadXskStats reads the ring fill levels and the kernel counters of an AF_XDP socket created with cfg. The rings are
+// only touched by the goroutine listening on the socket, the fill levels are those it recorded after its last poll
+func ReadXskStats(xsk *xdp.Socket, cfg XskConfig, queues *XdpQueues) (XskStats, error) {
+	stats := XskStats{
+		FillRing:     cfg.FillRingSize - int(queues.freeFillSlots.Load()),
+		FillRingSize: cfg.FillRingSize,
+		RxRing:       int(queues.received.Load()),
+		RxRingSize:   cfg.RxRingSize,
+	}
+	if !queues.listening.Load() {
+		stats.FillRing = 0
+	}
+
+	s, err := xsk.Stats()
+	if err != nil {
+		return XskStats{}, err
+	}
+	stats.RxDropped = s.KernelStats.Rx_dropped
+	stats.RxInvalidDescs = s.KernelStats.Rx_invalid_descs
+	stats.RxRingFull = s.KernelStats.Rx_ring_full
+	stats.FillRingEmpty = s.KernelStats.Rx_fill_ring_empty_descs
+
+	// struct xdp_options holds a single u32 of flags
+	var flags uint32
+	size := uint32(unsafe.Sizeof(flags))
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(xsk.FD()), unix.SOL_XDP, unix.XDP_OPTIONS,
+		uintptr(unsafe.Pointer(&flags)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return XskStats{}, errno
+	}
+	stats.ZeroCopy = flags&unix.XDP_OPTIONS_ZEROCOPY != 0
+
+	return stats, nil
+}
+
+const errMsgXDPErrorPrefix = "[XDP Error]:"
+
+// XdpQueues are the message queues of the clusters sharing an AF_XDP socket, by gossip port
+type XdpQueues struct {
+	mu        sync.RWMutex
+	queues    map[uint16]xdpQueue
+	listening atomic.Bool
+
+	// Ring fill levels recorded by XdpListen after each poll
+	freeFillSlots atomic.Int64
+	received      atomic.Int64
+}
+
+type xdpQueue struct {
+	mq   chan []byte
+	done <-chan struct{} // Closed when the cluster stops receiving
+}
+
+// NewXdpQueues returns an empty set of message queues
+func NewXdpQueues() *XdpQueues {
+	return &XdpQueues{queues: make(map[uint16]xdpQueue)}
+}
+
+// Register routes the payloads to port into mq until done is closed
+func (q *XdpQueues) Register(port uint16, mq chan []byte, done <-chan struct{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.queues[port] = xdpQueue{mq: mq, done: done}
+}
+
+// Unregister stops routing the payloads to port
+func (q *XdpQueues) Unregister(port uint16) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.queues, port)
+}
+
+// Listen runs XdpListen on the socket unless a cluster already does, the first caller does not return
+func (q *XdpQueues) Listen(logger *logger.Logger, xsk *xdp.Socket) {
+	if q.listening.CompareAndSwap(false, true) {
+		XdpListen(logger, xsk, q)
+	}
+}
+
+// put hands a payload to the queue of its port, payloads to a port without a queue are dropped
+func (q *XdpQueues) put(port uint16, payload []byte) bool {
+	q.mu.RLock()
+	queue, ok := q.queues[port]
+	q.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	select {
+	case queue.mq <- payload:
+	case <-queue.done:
+	}
+	return true
+}
+
+// XdpListen receives frames on an AF_XDP socket and puts their UDP payload into the message queue of their port. Payloads
+// are copied out of the UMEM before their frames go back to the fill ring, invalid frames are dropped
+func XdpListen(logger *logger.Logger, xsk *xdp.Socket, queues *XdpQueues) {
 	for {
 		// If there are any free slots on the Fill queue...
 		if n := xsk.NumFreeFillSlots(); n > 0 {
@@ -24,21 +245,119 @@ func XdpListen(xsk *xdp.Socket, mq chan []byte) {
 		// frame onto the Rx ring queue.
 		numRx, _, err := xsk.Poll(-1)
 		if err != nil {
-			logger.NewNopLogger().Sugar().Panicln("error: %v\n", err)
+			logger.Sugar().Panicln(errMsgXDPErrorPrefix, err)
 			return
 		}
+		queues.freeFillSlots.Store(int64(xsk.NumFreeFillSlots()))
+		queues.received.Store(int64(numRx))
 
 		if numRx > 0 {
 			// Consume the descriptors filled with received frames
-			// from the Rx ring queue.
+			// from the Rx ring queue. Receive already marks their
+			// frames free, the next Fill hands them to the kernel
+			// again, so nothing may keep pointing into the UMEM.
 			rxDescs := xsk.Receive(numRx)
-			// Print the received frames and also modify them
-			// in-place replacing the destination MAC address with
-			// broadcast address.
 			for i := 0; i < len(rxDescs); i++ {
-				pktData := xsk.GetFrame(rxDescs[i])
-				mq <- pktData
+				dport, payload, err := udpPayload(xsk.GetFrame(rxDescs[i]))
+				if err != nil {
+					logger.Sugar().Warnln(errMsgXDPErrorPrefix, "Dropped frame:", err)
+					continue
+				}
+				if !queues.put(dport, bytes.Clone(payload)) {
+					logger.Sugar().Warnln(errMsgXDPErrorPrefix, "Dropped frame: no cluster on port", dport)
+				}
 			}
 		}
 	}
 }
+
+const (
+	maxVlanTags = 2    // 802.1ad outer tag and 802.1Q inner tag
+	vxlanPort   = 4789 // VXLAN UDP port
+	genevePort  = 6081 // Geneve UDP port
+)
+
+// udpPayload returns the destination port and the UDP payload of an Ethernet frame carrying IPv4, those of the inner
+// frame for a VXLAN or Geneve packet (redirected with bpf.Options.Tunnels)
+func udpPayload(frame []byte) (uint16, []byte, error) {
+	dport, payload, err := parseUDP(frame)
+	if err != nil {
+		return 0, nil, err
+	}
+	if inner := tunnelInner(dport, payload); inner != nil {
+		dport, payload, err = parseUDP(inner)
+	}
+	return dport, payload, err
+}
+
+// tunnelInner returns the Ethernet frame encapsulated in a VXLAN or Geneve payload, nil for other payloads. A gossip
+// header ("eG") is neither a valid VXLAN nor a valid Geneve header
+func tunnelInner(dport uint16, payload []byte) []byte {
+	if len(payload) < 8 {
+		return nil
+	}
+	switch dport {
+	case vxlanPort:
+		if payload[0]&0x08 != 0 { // I flag, the VNI is valid
+			return payload[8:]
+		}
+	case genevePort:
+		off := 8 + int(payload[0]&0x3f)*4 // Options length in 4-byte words
+		if payload[0]>>6 == 0 && binary.BigEndian.Uint16(payload[2:4]) == 0x6558 && len(payload) >= off {
+			return payload[off:]
+		}
+	}
+	return nil
+}
+
+// parseUDP returns the destination port and the payload of an Ethernet frame carrying a UDP datagram over IPv4. VLAN
+// tags and IP options are skipped, the IP total length and the UDP length are checked against the frame
+func parseUDP(frame []byte) (uint16, []byte, error) {
+	if len(frame) < 14 {
+		return 0, nil, fmt.Errorf("frame too short: %d bytes", len(frame))
+	}
+	etherType := binary.BigEndian.Uint16(frame[12:14])
+	off := 14
+	for tags := 0; etherType == 0x8100 || etherType == 0x88a8; tags++ {
+		if tags == maxVlanTags {
+			return 0, nil, fmt.Errorf("more than %d VLAN tags", maxVlanTags)
+		}
+		if len(frame) < off+4 {
+			return 0, nil, errors.New("truncated VLAN tag")
+		}
+		etherType = binary.BigEndian.Uint16(frame[off+2 : off+4])
+		off += 4
+	}
+	if etherType != 0x0800 {
+		return 0, nil, fmt.Errorf("not IPv4: ethertype %#04x", etherType)
+	}
+
+	ip := frame[off:]
+	if len(ip) < 20 || ip[0]>>4 != 4 {
+		return 0, nil, errors.New("invalid IPv4 header")
+	}
+	ihl := int(ip[0]&0x0f) * 4
+	totalLen := int(binary.BigEndian.Uint16(ip[2:4]))
+	if ihl < 20 || totalLen < ihl || totalLen > len(ip) {
+		return 0, nil, fmt.Errorf("invalid IPv4 lengths: header %d, total %d, frame %d", ihl, totalLen, len(ip))
+	}
+	if ip[9] != unix.IPPROTO_UDP {
+		return 0, nil, fmt.Errorf("not UDP: protocol %d", ip[9])
+	}
+	// Fragments (more fragments flag or an offset) cannot be reassembled here
+	if binary.BigEndian.Uint16(ip[6:8])&0x3fff != 0 {
+		return 0, nil, errors.New("fragmented datagram")
+	}
+
+	// Ethernet padding behind the IP total length is ignored
+	udp := ip[ihl:totalLen]
+	if len(udp) < 8 {
+		return 0, nil, errors.New("truncated UDP header")
+	}
+	udpLen := int(binary.BigEndian.Uint16(udp[4:6]))
+	if udpLen < 8 || udpLen > len(udp) {
+		return 0, nil, fmt.Errorf("invalid UDP length: %d, datagram %d", udpLen, len(udp))
+	}
+
+	return binary.BigEndian.Uint16(udp[2:4]), udp[8:udpLen], nil
+}
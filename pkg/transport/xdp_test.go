@@ -0,0 +1,247 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+)
+
+// frameOptions describes a hand-built Ethernet frame
+type frameOptions struct {
+	vlans     []uint16 // Ethertypes of the VLAN tags, outermost first
+	version   uint8    // IP version (default: 4)
+	ihl       int      // IPv4 header length in 4-byte words (default: 5)
+	proto     uint8    // IP protocol (default: UDP)
+	frag      uint16   // Flags and fragment offset
+	ipLen     int      // IP total length delta
+	udpLen    int      // UDP length delta
+	padding   int      // Ethernet padding behind the IP packet
+	etherType uint16   // Ethertype (default: IPv4)
+}
+
+// buildFrame returns an Ethernet frame carrying a UDP datagram to dport
+func buildFrame(dport uint16, payload []byte, o frameOptions) []byte {
+	if o.ihl == 0 {
+		o.ihl = 5
+	}
+	if o.version == 0 {
+		o.version = 4
+	}
+	if o.proto == 0 {
+		o.proto = 17
+	}
+	if o.etherType == 0 {
+		o.etherType = 0x0800
+	}
+
+	frame := make([]byte, 12) // Destination and source MAC addresses
+	for _, tpid := range o.vlans {
+		frame = binary.BigEndian.AppendUint16(frame, tpid)
+		frame = binary.BigEndian.AppendUint16(frame, 100) // VLAN ID
+	}
+	frame = binary.BigEndian.AppendUint16(frame, o.etherType)
+
+	hdrLen := max(o.ihl*4, 20) // An invalid IHL still gets a full header
+	udpLen := 8 + len(payload)
+	ip := make([]byte, hdrLen)
+	ip[0] = o.version<<4 | byte(o.ihl)
+	binary.BigEndian.PutUint16(ip[2:4], uint16(hdrLen+udpLen+o.ipLen))
+	binary.BigEndian.PutUint16(ip[6:8], o.frag)
+	ip[8] = 64
+	ip[9] = o.proto
+	copy(ip[12:16], []byte{10, 0, 0, 1})
+	copy(ip[16:20], []byte{10, 0, 0, 2})
+	for i := 20; i < hdrLen; i++ {
+		ip[i] = 1 // NOP options
+	}
+
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:2], 40000)
+	binary.BigEndian.PutUint16(udp[2:4], dport)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(udpLen+o.udpLen))
+
+	frame = append(frame, ip...)
+	frame = append(frame, udp...)
+	frame = append(frame, payload...)
+	return append(frame, make([]byte, o.padding)...)
+}
+
+// vxlan returns a VXLAN header (I flag set) followed by inner
+func vxlan(inner []byte) []byte {
+	return append([]byte{0x08, 0, 0, 0, 0, 0, 42, 0}, inner...)
+}
+
+// geneve returns a Geneve header with opts 4-byte words of options followed by inner
+func geneve(opts int, inner []byte) []byte {
+	hdr := []byte{byte(opts), 0, 0x65, 0x58, 0, 0, 42, 0}
+	return append(append(hdr, make([]byte, opts*4)...), inner...)
+}
+
+func TestParseUDP(t *testing.T) {
+	payload := []byte("eG gossip")
+
+	tests := []struct {
+		name  string
+		frame []byte
+		err   string // Expected error, empty for a valid frame
+	}{
+		{"plain", buildFrame(8000, payload, frameOptions{}), ""},
+		{"vlan", buildFrame(8000, payload, frameOptions{vlans: []uint16{0x8100}}), ""},
+		{"qinq", buildFrame(8000, payload, frameOptions{vlans: []uint16{0x88a8, 0x8100}}), ""},
+		{"three vlan tags", buildFrame(8000, payload, frameOptions{vlans: []uint16{0x88a8, 0x8100, 0x8100}}), "more than 2 VLAN tags"},
+		{"ip options", buildFrame(8000, payload, frameOptions{ihl: 8}), ""},
+		{"max ip options", buildFrame(8000, payload, frameOptions{ihl: 15}), ""},
+		{"ethernet padding", buildFrame(8000, payload, frameOptions{padding: 20}), ""},
+		{"ihl too small", buildFrame(8000, payload, frameOptions{ihl: 4}), "invalid IPv4 lengths"},
+		{"ip version 6", buildFrame(8000, payload, frameOptions{version: 6}), "invalid IPv4 header"},
+		{"ipv6", buildFrame(8000, payload, frameOptions{etherType: 0x86dd}), "not IPv4"},
+		{"tcp", buildFrame(8000, payload, frameOptions{proto: 6}), "not UDP"},
+		{"more fragments", buildFrame(8000, payload, frameOptions{frag: 0x2000}), "fragmented"},
+		{"fragment offset", buildFrame(8000, payload, frameOptions{frag: 0x0010}), "fragmented"},
+		{"dont fragment", buildFrame(8000, payload, frameOptions{frag: 0x4000}), ""},
+		{"ip total length over frame", buildFrame(8000, payload, frameOptions{ipLen: 1}), "invalid IPv4 lengths"},
+		{"ip total length under header", buildFrame(8000, payload, frameOptions{ipLen: -len(payload) - 8 - 1}), "invalid IPv4 lengths"},
+		{"no udp header", buildFrame(8000, payload, frameOptions{ipLen: -len(payload) - 1}), "truncated UDP header"},
+		{"udp length over datagram", buildFrame(8000, payload, frameOptions{udpLen: 1}), "invalid UDP length"},
+		{"udp length under header", buildFrame(8000, payload, frameOptions{udpLen: -len(payload) - 1}), "invalid UDP length"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dport, got, err := parseUDP(tt.frame)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dport != 8000 || !bytes.Equal(got, payload) {
+				t.Errorf("parseUDP = %d, %q, want 8000, %q", dport, got, payload)
+			}
+		})
+	}
+}
+
+func TestUDPPayload(t *testing.T) {
+	payload := []byte("eG gossip")
+	inner := buildFrame(8000, payload, frameOptions{})
+
+	tests := []struct {
+		name      string
+		frame     []byte
+		wantPort  uint16
+		wantBytes []byte
+	}{
+		{"plain", inner, 8000, payload},
+		{"vxlan", buildFrame(vxlanPort, vxlan(inner), frameOptions{}), 8000, payload},
+		{"vxlan inner vlan", buildFrame(vxlanPort, vxlan(buildFrame(8000, payload, frameOptions{vlans: []uint16{0x8100}})), frameOptions{vlans: []uint16{0x8100}}), 8000, payload},
+		{"geneve", buildFrame(genevePort, geneve(0, inner), frameOptions{}), 8000, payload},
+		{"geneve options", buildFrame(genevePort, geneve(3, inner), frameOptions{}), 8000, payload},
+		// Without the I flag, the payload is not a VXLAN packet
+		{"vxlan without vni", buildFrame(vxlanPort, append([]byte{0, 0, 0, 0, 0, 0, 0, 0}, inner...), frameOptions{}), vxlanPort, append([]byte{0, 0, 0, 0, 0, 0, 0, 0}, inner...)},
+		// A gossip header on the tunnel ports is delivered as is
+		{"gossip on vxlan port", buildFrame(vxlanPort, payload, frameOptions{}), vxlanPort, payload},
+		{"gossip on geneve port", buildFrame(genevePort, payload, frameOptions{}), genevePort, payload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dport, got, err := udpPayload(tt.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dport != tt.wantPort || !bytes.Equal(got, tt.wantBytes) {
+				t.Errorf("udpPayload = %d, %q, want %d, %q", dport, got, tt.wantPort, tt.wantBytes)
+			}
+		})
+	}
+}
+
+func TestTunnelInner(t *testing.T) {
+	inner := []byte("inner frame")
+
+	tests := []struct {
+		name    string
+		dport   uint16
+		payload []byte
+		want    []byte
+	}{
+		{"vxlan", vxlanPort, vxlan(inner), inner},
+		{"vxlan header only", vxlanPort, vxlan(nil), []byte{}},
+		{"vxlan short", vxlanPort, vxlan(nil)[:7], nil},
+		{"geneve", genevePort, geneve(0, inner), inner},
+		{"geneve options", genevePort, geneve(2, inner), inner},
+		{"geneve truncated options", genevePort, geneve(2, nil)[:12], nil},
+		{"geneve version 1", genevePort, append([]byte{0x40}, geneve(0, inner)[1:]...), nil},
+		{"geneve not ethernet", genevePort, append([]byte{0, 0, 0x08, 0x00}, geneve(0, inner)[4:]...), nil},
+		{"other port", 8000, vxlan(inner), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tunnelInner(tt.dport, tt.payload)
+			if (got == nil) != (tt.want == nil) || !bytes.Equal(got, tt.want) {
+				t.Errorf("tunnelInner = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUDPPayloadTruncated(t *testing.T) {
+	payload := []byte("eG gossip")
+	tests := []struct {
+		name    string
+		frame   []byte
+		padding int // Ethernet padding, prefixes without (part of) it are still valid
+	}{
+		{"qinq ip options", buildFrame(8000, payload, frameOptions{vlans: []uint16{0x88a8, 0x8100}, ihl: 6}), 0},
+		{"vxlan", buildFrame(vxlanPort, vxlan(buildFrame(8000, payload, frameOptions{vlans: []uint16{0x8100}})), frameOptions{}), 0},
+		{"geneve", buildFrame(genevePort, geneve(2, buildFrame(8000, payload, frameOptions{ihl: 7})), frameOptions{}), 0},
+		{"padding", buildFrame(8000, payload, frameOptions{padding: 8}), 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Every prefix cut into the IP packet is rejected without reading past its end
+			for n := 0; n < len(tt.frame); n++ {
+				_, got, err := udpPayload(tt.frame[:n:n])
+				if n < len(tt.frame)-tt.padding && err == nil {
+					t.Errorf("%d of %d bytes: no error", n, len(tt.frame))
+				}
+				if err == nil && !bytes.Equal(got, payload) {
+					t.Errorf("%d of %d bytes: payload %q, want %q", n, len(tt.frame), got, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestReadXskStats(t *testing.T) {
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := XskConfig{NumFrames: 64, FrameSize: 2048, FillRingSize: 32, CompletionRingSize: 32, RxRingSize: 32}
+	xsk, err := NewXsk(lo.Index, 0, cfg)
+	if err != nil {
+		t.Skip("AF_XDP sockets require CAP_NET_RAW:", err)
+	}
+	defer xsk.Close()
+
+	// The fill levels are those recorded by the listening goroutine, not read from the rings
+	queues := NewXdpQueues()
+	if stats, err := ReadXskStats(xsk, cfg, queues); err != nil || stats.FillRing != 0 || stats.RxRing != 0 {
+		t.Errorf("stats before listening = %+v, %v, want empty rings", stats, err)
+	}
+	queues.listening.Store(true)
+	queues.freeFillSlots.Store(12)
+	queues.received.Store(3)
+	stats, err := ReadXskStats(xsk, cfg, queues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.FillRing != 20 || stats.FillRingSize != 32 || stats.RxRing != 3 || stats.RxRingSize != 32 {
+		t.Errorf("stats = %+v, want fill ring 20/32 and rx ring 3/32", stats)
+	}
+}
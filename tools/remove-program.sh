@@ -1,3 +0,0 @@
-sudo tc filter del dev ens18 egress
-sudo ip link set dev ens18 xdp off
-